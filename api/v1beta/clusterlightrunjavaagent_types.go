@@ -0,0 +1,78 @@
+/*
+Copyright 2022 Lightrun
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterLightrunJavaAgentSpec defines the desired state of ClusterLightrunJavaAgent
+type ClusterLightrunJavaAgentSpec struct {
+	// Label selector of the namespaces where the agent will be rolled out
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector"`
+
+	// Spec of the LightrunJavaAgent created in every matching namespace.
+	// secretName refers to the Secret in the operator namespace, it is copied to every matching namespace
+	Template LightrunJavaAgentSpec `json:"template"`
+}
+
+// NamespaceReconcileStatus is the result of rolling out the agent to a single namespace
+type NamespaceReconcileStatus struct {
+	// Name of the namespace
+	Namespace string `json:"namespace"`
+	// Status of the LightrunJavaAgent in the namespace or Failed if it can't be created
+	Status string `json:"status"`
+	// Reason of the failure
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// ClusterLightrunJavaAgentStatus defines the observed state of ClusterLightrunJavaAgent
+type ClusterLightrunJavaAgentStatus struct {
+	Conditions     []metav1.Condition `json:"conditions,omitempty"`
+	WorkloadStatus string             `json:"workloadStatus,omitempty"`
+	// Per namespace results
+	// +optional
+	Namespaces []NamespaceReconcileStatus `json:"namespaces,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster,shortName=clrja
+//+kubebuilder:printcolumn:priority=0,name="Status",type=string,JSONPath=".status.workloadStatus",description="Status of Workload Reconciliation",format=""
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// ClusterLightrunJavaAgent is the Schema for the clusterlightrunjavaagents API
+type ClusterLightrunJavaAgent struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterLightrunJavaAgentSpec   `json:"spec,omitempty"`
+	Status ClusterLightrunJavaAgentStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// ClusterLightrunJavaAgentList contains a list of ClusterLightrunJavaAgent
+type ClusterLightrunJavaAgentList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterLightrunJavaAgent `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterLightrunJavaAgent{}, &ClusterLightrunJavaAgentList{})
+}
@@ -19,13 +19,14 @@ package v1beta
 import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // Important: Run "make" to regenerate code after modifying this file
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
 // WorkloadType defines the type of workload that can be patched
-// +kubebuilder:validation:Enum=Deployment;StatefulSet
+// +kubebuilder:validation:Enum=Deployment;StatefulSet;DaemonSet;CronJob;Job;Rollout
 type WorkloadType string
 
 const (
@@ -33,17 +34,165 @@ const (
 	WorkloadTypeDeployment WorkloadType = "Deployment"
 	// WorkloadTypeStatefulSet represents a Kubernetes StatefulSet
 	WorkloadTypeStatefulSet WorkloadType = "StatefulSet"
+	// WorkloadTypeDaemonSet represents a Kubernetes DaemonSet
+	WorkloadTypeDaemonSet WorkloadType = "DaemonSet"
+	// WorkloadTypeCronJob represents a Kubernetes CronJob. Agent is added to the Job template
+	WorkloadTypeCronJob WorkloadType = "CronJob"
+	// WorkloadTypeJob represents a Kubernetes Job. Pod template of a Job is immutable,
+	// so only Jobs created suspended after the LightrunJavaAgent are patched
+	WorkloadTypeJob WorkloadType = "Job"
+	// WorkloadTypeRollout represents an Argo Rollout (argoproj.io/v1alpha1). Requires Argo Rollouts CRD in the cluster
+	WorkloadTypeRollout WorkloadType = "Rollout"
 )
 
+// InjectionMode defines how the agent is injected into the workload
+// +kubebuilder:validation:Enum=Patch;Webhook
+type InjectionMode string
+
+const (
+	// InjectionModePatch patches the pod template of the workload
+	InjectionModePatch InjectionMode = "Patch"
+	// InjectionModeWebhook injects the agent into the pods on creation, workload stays untouched.
+	// Requires the pod injection webhook to be enabled in the operator
+	InjectionModeWebhook InjectionMode = "Webhook"
+)
+
+// AgentInstallMode defines how the agent files are delivered to the pod
+// +kubebuilder:validation:Enum=InitContainer;ImageVolume
+type AgentInstallMode string
+
+const (
+	// AgentInstallModeInitContainer copies the agent to the shared volume with the init container
+	AgentInstallModeInitContainer AgentInstallMode = "InitContainer"
+	// AgentInstallModeImageVolume mounts the init container image as a read-only image volume.
+	// Falls back to AgentInstallModeInitContainer if image volumes are not available in the cluster
+	AgentInstallModeImageVolume AgentInstallMode = "ImageVolume"
+)
+
+// GitOpsTool is a GitOps tool syncing the patched workloads
+// +kubebuilder:validation:Enum=ArgoCD;Flux
+type GitOpsTool string
+
+const (
+	// GitOpsToolArgoCD adds argocd.argoproj.io/compare-options: ServerSideDiff=true, so Argo CD ignores the fields owned by the operator
+	GitOpsToolArgoCD GitOpsTool = "ArgoCD"
+	// GitOpsToolFlux adds kustomize.toolkit.fluxcd.io/ssa: Merge, so Flux keeps the fields owned by the operator
+	GitOpsToolFlux GitOpsTool = "Flux"
+)
+
+// RolloutPolicy defines when the pods of the patched workloads are recreated after the agent config changes
+// +kubebuilder:validation:Enum=Immediate;OnNextRestart;MaintenanceWindow
+type RolloutPolicy string
+
+const (
+	// RolloutPolicyImmediate recreates the pods as soon as the agent config changes
+	RolloutPolicyImmediate RolloutPolicy = "Immediate"
+	// RolloutPolicyOnNextRestart updates the agent config, pods pick it up when they are restarted
+	RolloutPolicyOnNextRestart RolloutPolicy = "OnNextRestart"
+	// RolloutPolicyMaintenanceWindow defers the recreation of the pods until the maintenance window
+	RolloutPolicyMaintenanceWindow RolloutPolicy = "MaintenanceWindow"
+)
+
+// MaintenanceWindow is the recurring time window when the agent config changes are rolled out
+type MaintenanceWindow struct {
+	// Start of the window in the cron format, e.g. "0 2 * * 6". Default time zone is UTC,
+	// another one may be set with the CRON_TZ prefix, e.g. "CRON_TZ=Europe/London 0 2 * * 6"
+	Schedule string `json:"schedule"`
+	// Length of the window, e.g. 2h
+	Duration metav1.Duration `json:"duration"`
+}
+
+// GitOpsCompatibility injects the agent without changing the env vars synced from Git
+type GitOpsCompatibility struct {
+	// Env var set to the agent argument and owned by the operator with server side apply. Default is JDK_JAVA_OPTIONS,
+	// read by the java launcher of Java 9+. Another name has to be referenced from the env var read by the JVM,
+	// e.g. JAVA_TOOL_OPTIONS: "-Xmx1g $(LIGHTRUN_AGENT_OPTS)", and declared without a value before the reference
+	// +optional
+	AgentEnvVarName string `json:"agentEnvVarName,omitempty"`
+	// GitOps tools syncing the workloads. Their annotations are added to the patched workloads,
+	// so the changes of the operator are not reported as out of sync or reverted
+	// +optional
+	Tools []GitOpsTool `json:"tools,omitempty"`
+}
+
+// DriftBackoff configures the delay of re-applying the agent env var that is repeatedly reverted by other tools, e.g. GitOps
+type DriftBackoff struct {
+	// Delay of re-applying the second revert in a row, doubled on every next one. The first revert is re-applied right away.
+	// Default is 10s
+	// +optional
+	Initial *metav1.Duration `json:"initial,omitempty"`
+	// Maximum delay of re-applying the revert. Reverts more than twice of it apart are not counted as repeated. Default is 10m
+	// +optional
+	Max *metav1.Duration `json:"max,omitempty"`
+}
+
+// Canary limits the agent injection to a part of the replicas of the workload
+type Canary struct {
+	// Number of replicas with the agent. Deployment gets a separate canary Deployment with this number of replicas,
+	// StatefulSet gets the agent in this number of the highest ordinals
+	// +kubebuilder:validation:Minimum=1
+	Replicas int32 `json:"replicas"`
+}
+
 type InitContainer struct {
 	// Name of the volume that will be added to pod
 	SharedVolumeName string `json:"sharedVolumeName"`
 	// Path in the app container where volume with agent will be mounted
 	SharedVolumeMountPath string `json:"sharedVolumeMountPath"`
-	// Image of the init container. Image name and tag will define platform and version of the agent
-	Image string `json:"image"`
+	// Image of the init container. Image name and tag will define platform and version of the agent.
+	// Either image or agentVersion has to be set
+	// +optional
+	Image string `json:"image,omitempty"`
+	// Version of the agent resolved to the image pinned to a digest by the agent catalog of the operator.
+	// Resolved image is recorded in the status, reconciliation fails if the version is missing from the catalog
+	// +optional
+	AgentVersion string `json:"agentVersion,omitempty"`
+	// Platform of the agent resolved by agentVersion, e.g. linux or alpine. With auto or when not set the platform is
+	// selected for every workload from the CPU architecture set by its nodeSelector or node affinity and the libc hinted
+	// by the app container images, e.g. alpine-arm64. Can't be used with image, which is used as is
+	// +optional
+	AgentPlatform string `json:"agentPlatform,omitempty"`
 	// Pull policy of the init container. Can be one of: Always, IfNotPresent, or Never.
 	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+	// Secrets used to pull the init container image from a private registry. They are added to the pod spec of the
+	// workload together with the default pull secrets of the operator and removed when the agent is removed
+	// +optional
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// Run the installer as a native sidecar (init container with restartPolicy Always) that keeps the agent config
+	// in the shared volume in sync with the ConfigMap. Changes of agentConfig and agentTags then don't restart the pods.
+	// Requires Kubernetes 1.29+ and the init container image supporting the config sync
+	// +optional
+	Sidecar bool `json:"sidecar,omitempty"`
+	// How the agent is delivered to the pod. InitContainer (default) runs the installer init container.
+	// ImageVolume mounts the image at sharedVolumeMountPath without running a container, agent config is mounted
+	// from the ConfigMap and the Secret. Requires ImageVolume feature of Kubernetes, otherwise InitContainer is used.
+	// ImageVolume can't be used with Webhook injection mode
+	// +kubebuilder:default=InitContainer
+	// +optional
+	InjectionMode AgentInstallMode `json:"injectionMode,omitempty"`
+	// Resources of the init container. Every set request and limit replaces the default one (50m CPU, 64M memory).
+	// Default request higher than the set limit is lowered to the limit, limit lower than the set request is raised to the request
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Overrides of the init container security context. All capabilities are dropped and privilege escalation is disabled regardless
+	// +optional
+	SecurityContext *InitContainerSecurityContext `json:"securityContext,omitempty"`
+	// Additional env vars of the init container. Env vars set by the operator can't be overridden
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+}
+
+// InitContainerSecurityContext holds the fields of the init container security context that can be overridden
+type InitContainerSecurityContext struct {
+	// The UID to run the init container process
+	// +optional
+	RunAsUser *int64 `json:"runAsUser,omitempty"`
+	// The GID to run the init container process
+	// +optional
+	RunAsGroup *int64 `json:"runAsGroup,omitempty"`
+	// Whether the init container has a read-only root filesystem. Agent is installed to the shared volume, so it may be enabled
+	// +optional
+	ReadOnlyRootFilesystem *bool `json:"readOnlyRootFilesystem,omitempty"`
 }
 
 // LightrunJavaAgentSpec defines the desired state of LightrunJavaAgent
@@ -52,12 +201,29 @@ type LightrunJavaAgentSpec struct {
 	ContainerSelector []string      `json:"containerSelector"`
 	InitContainer     InitContainer `json:"initContainer"`
 
-	// Name of the Workload that will be patched. workload can be either Deployment or StatefulSet e.g. my-deployment, my-statefulset
-	// +kubebuilder:validation:MinLength=1
-	WorkloadName string `json:"workloadName"`
+	// Name of the Workload that will be patched. workload can be either Deployment, StatefulSet, DaemonSet, CronJob, Job or Argo Rollout e.g. my-deployment, my-statefulset, my-cronjob
+	// Either workloadName and workloadType or workloadSelector has to be set
+	// +optional
+	WorkloadName string `json:"workloadName,omitempty"`
 
-	// Type of the workload that will be patched supported values are Deployment, StatefulSet
-	WorkloadType WorkloadType `json:"workloadType"`
+	// Type of the workload that will be patched supported values are Deployment, StatefulSet, DaemonSet, CronJob, Job, Rollout
+	// +optional
+	WorkloadType WorkloadType `json:"workloadType,omitempty"`
+
+	// Label selector of the workloads in the namespace that will be patched. Can't be used together with workloadName.
+	// Workloads created later are patched as well, workloads that stop matching the selector are unpatched
+	// +optional
+	WorkloadSelector *metav1.LabelSelector `json:"workloadSelector,omitempty"`
+
+	// Kinds of the workloads matched by workloadSelector. Job is not supported. Default is Deployment and StatefulSet
+	// +optional
+	WorkloadKinds []WorkloadType `json:"workloadKinds,omitempty"`
+
+	// How the agent is injected. Patch (default) patches the pod template of the workload.
+	// Webhook injects the agent into the pods on creation, so the agent takes effect on the next pod restart
+	// +kubebuilder:default=Patch
+	// +optional
+	InjectionMode InjectionMode `json:"injectionMode,omitempty"`
 
 	//Name of the Secret in the same namespace contains lightrun key and conmpany id
 	SecretName string `json:"secretName"`
@@ -92,6 +258,155 @@ type LightrunJavaAgentSpec struct {
 	// UseSecretsAsMountedFiles determines whether to use secret values as mounted files (true) or as environment variables (false)
 	// +kubebuilder:default=true
 	UseSecretsAsMountedFiles bool `json:"useSecretsAsMountedFiles,omitempty"`
+
+	// When the pods of the patched workloads are recreated after changes of agentConfig, agentTags, agentName or the Secret.
+	// Immediate (default) recreates them right away. OnNextRestart only updates the agent config, pods pick it up when they are restarted.
+	// MaintenanceWindow recreates them in maintenanceWindow. Pending changes are shown in status.workloads[].pendingConfigMapHash
+	// +kubebuilder:default=Immediate
+	// +optional
+	RolloutPolicy RolloutPolicy `json:"rolloutPolicy,omitempty"`
+
+	// Window of the MaintenanceWindow rollout policy
+	// +optional
+	MaintenanceWindow *MaintenanceWindow `json:"maintenanceWindow,omitempty"`
+
+	// Inject the agent argument into a separate env var owned by the operator instead of agentEnvVarName,
+	// so GitOps tools don't revert it. Can't be used with Webhook injection mode
+	// +optional
+	GitOpsCompatibility *GitOpsCompatibility `json:"gitOpsCompatibility,omitempty"`
+
+	// Backoff of re-applying the agent env var reverted in the patched workloads
+	// +optional
+	DriftBackoff *DriftBackoff `json:"driftBackoff,omitempty"`
+
+	// Inject the agent only into a part of the replicas of the Deployment or StatefulSet set by workloadName.
+	// The agent is promoted to all the replicas by removing canary and rolled back by suspend or deletion of the LightrunJavaAgent.
+	// Canary of a Deployment can't be used with ImageVolume injection mode or gitOpsCompatibility
+	// +optional
+	Canary *Canary `json:"canary,omitempty"`
+
+	// Remove the agent from the workloads without deleting the LightrunJavaAgent. Agent config and finalizer are kept,
+	// the agent is injected again when suspend is set back to false
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// Time when the agent is removed from the workloads. The LightrunJavaAgent is kept with Expired status,
+	// it is re-armed by setting a later time. Can't be used together with ttl
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// Time to live of the agent since the creation of the LightrunJavaAgent, e.g. 4h. The agent is removed from the workloads
+	// after it passes and the LightrunJavaAgent is kept with Expired status, it is re-armed by increasing ttl. Can't be used together with expiresAt
+	// +optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+
+	// Preview the changes of the workloads without applying them. Patches are validated with server side dry run
+	// and the changes are reported in status.workloads[].preview. Workloads already patched by this LightrunJavaAgent are left as is.
+	// Not supported with Webhook injection mode
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// ContainerPatchPreview is the summary of the changes of a container made by the agent injection
+type ContainerPatchPreview struct {
+	// Name of the container
+	Name string `json:"name"`
+	// Volume mounts added to the container, in the name:mountPath form
+	// +optional
+	AddedVolumeMounts []string `json:"addedVolumeMounts,omitempty"`
+	// Volume mounts removed from the container, in the name:mountPath form
+	// +optional
+	RemovedVolumeMounts []string `json:"removedVolumeMounts,omitempty"`
+	// Env var patched with the agent argument
+	// +optional
+	EnvVar string `json:"envVar,omitempty"`
+	// Value of the env var before the patch
+	// +optional
+	EnvBefore string `json:"envBefore,omitempty"`
+	// Value of the env var after the patch
+	// +optional
+	EnvAfter string `json:"envAfter,omitempty"`
+}
+
+// WorkloadDrift counts the reverts of the agent env var of the workload, e.g. by GitOps tools
+type WorkloadDrift struct {
+	// Number of the reverts found and re-applied
+	Count int32 `json:"count"`
+	// Number of the reverts in a row, each found less than twice of the maximum backoff after the previous one
+	Repeated int32 `json:"repeated"`
+	// Time of the last re-apply
+	LastDriftTime metav1.Time `json:"lastDriftTime"`
+}
+
+// WorkloadPatchPreview is the summary of the changes of the workload pod template computed in dry run mode
+type WorkloadPatchPreview struct {
+	// Pods of the workload are recreated when the changes are applied
+	RolloutRequired bool `json:"rolloutRequired"`
+	// Volumes added to the pod template
+	// +optional
+	AddedVolumes []string `json:"addedVolumes,omitempty"`
+	// Volumes removed from the pod template
+	// +optional
+	RemovedVolumes []string `json:"removedVolumes,omitempty"`
+	// Init containers added to the pod template
+	// +optional
+	AddedInitContainers []string `json:"addedInitContainers,omitempty"`
+	// Init containers removed from the pod template
+	// +optional
+	RemovedInitContainers []string `json:"removedInitContainers,omitempty"`
+	// Changes of the containers, unchanged containers are not listed
+	// +optional
+	Containers []ContainerPatchPreview `json:"containers,omitempty"`
+}
+
+// WorkloadReconcileStatus is the result of reconciling a single workload matched by workloadSelector
+type WorkloadReconcileStatus struct {
+	// Kind of the workload
+	Kind WorkloadType `json:"kind"`
+	// Name of the workload
+	Name string `json:"name"`
+	// Patched, Drifted, Failed, Skipped or DryRun. Skipped Job can't be recreated with the agent
+	Status string `json:"status"`
+	// Reason of the failure
+	// +optional
+	Message string `json:"message,omitempty"`
+	// UID of the workload
+	// +optional
+	UID types.UID `json:"uid,omitempty"`
+	// Containers of the workload patched with the agent
+	// +optional
+	Containers []string `json:"containers,omitempty"`
+	// Agent image injected into the workload
+	// +optional
+	AgentImage string `json:"agentImage,omitempty"`
+	// Hash of the agent config set in the pod template, pods are recreated when it changes.
+	// Not set for the sidecar installer that syncs the config into the running pods
+	// +optional
+	ConfigMapHash string `json:"configMapHash,omitempty"`
+	// Hash of the agent config that is not rolled out to the pod template yet because of rolloutPolicy
+	// +optional
+	PendingConfigMapHash string `json:"pendingConfigMapHash,omitempty"`
+	// Env var of the containers patched with the agent argument
+	// +optional
+	PatchedEnvVar string `json:"patchedEnvVar,omitempty"`
+	// Desired number of pods of the workload. Not set for CronJobs and Jobs
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Number of pods of the workload with the current pod template
+	// +optional
+	UpdatedReplicas *int32 `json:"updatedReplicas,omitempty"`
+	// Number of ready pods of the workload
+	// +optional
+	ReadyReplicas *int32 `json:"readyReplicas,omitempty"`
+	// Reverts of the agent env var of the workload by other tools
+	// +optional
+	Drift *WorkloadDrift `json:"drift,omitempty"`
+	// Number of replicas of the workload with the agent in canary mode
+	// +optional
+	CanaryReplicas *int32 `json:"canaryReplicas,omitempty"`
+	// Changes of the workload that will be made by the agent injection. Set only in dry run mode
+	// +optional
+	Preview *WorkloadPatchPreview `json:"preview,omitempty"`
 }
 
 // LightrunJavaAgentStatus defines the observed state of LightrunJavaAgent
@@ -99,6 +414,24 @@ type LightrunJavaAgentStatus struct {
 	LastScheduleTime *metav1.Time       `json:"lastScheduleTime,omitempty"`
 	Conditions       []metav1.Condition `json:"conditions,omitempty"`
 	WorkloadStatus   string             `json:"workloadStatus,omitempty"`
+	// Generation of the LightrunJavaAgent observed by the last reconciliation
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Per workload results of the last reconciliation
+	// +optional
+	Workloads []WorkloadReconcileStatus `json:"workloads,omitempty"`
+	// Agent image resolved from agentVersion by the agent catalog
+	// +optional
+	AgentImage string `json:"agentImage,omitempty"`
+	// Start of the next maintenance window when the pending agent config changes are rolled out
+	// +optional
+	NextRolloutTime *metav1.Time `json:"nextRolloutTime,omitempty"`
+	// Time when the agent is removed from the workloads, set by expiresAt or ttl
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// Agent images of the platforms of agentVersion in the agent catalog, used when agentPlatform is auto
+	// +optional
+	AgentPlatformImages map[string]string `json:"agentPlatformImages,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -107,6 +440,10 @@ type LightrunJavaAgentStatus struct {
 //+kubebuilder:printcolumn:priority=0,name=Workload,type=string,JSONPath=".spec.workloadName",description="Workload name",format=""
 //+kubebuilder:printcolumn:priority=0,name=Type,type=string,JSONPath=".spec.workloadType",description="Workload type",format=""
 //+kubebuilder:printcolumn:priority=0,name="Status",type=string,JSONPath=".status.workloadStatus",description="Status of Workload Reconciliation",format=""
+//+kubebuilder:printcolumn:priority=1,name="Updated",type=integer,JSONPath=".status.workloads[0].updatedReplicas",description="Pods of the workload with the current pod template"
+//+kubebuilder:printcolumn:priority=1,name="Ready",type=integer,JSONPath=".status.workloads[0].readyReplicas",description="Ready pods of the workload"
+//+kubebuilder:printcolumn:priority=1,name="Agent Image",type=string,JSONPath=".status.workloads[0].agentImage",description="Agent image injected into the workload"
+//+kubebuilder:printcolumn:priority=1,name="Expires",type=date,JSONPath=".status.expiresAt",description="Time when the agent is removed from the workloads"
 //+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // LightrunJavaAgent is the Schema for the lightrunjavaagents API
@@ -21,13 +21,228 @@ limitations under the License.
 package v1beta
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Canary) DeepCopyInto(out *Canary) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Canary.
+func (in *Canary) DeepCopy() *Canary {
+	if in == nil {
+		return nil
+	}
+	out := new(Canary)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterLightrunJavaAgent) DeepCopyInto(out *ClusterLightrunJavaAgent) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterLightrunJavaAgent.
+func (in *ClusterLightrunJavaAgent) DeepCopy() *ClusterLightrunJavaAgent {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterLightrunJavaAgent)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterLightrunJavaAgent) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterLightrunJavaAgentList) DeepCopyInto(out *ClusterLightrunJavaAgentList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClusterLightrunJavaAgent, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterLightrunJavaAgentList.
+func (in *ClusterLightrunJavaAgentList) DeepCopy() *ClusterLightrunJavaAgentList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterLightrunJavaAgentList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterLightrunJavaAgentList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterLightrunJavaAgentSpec) DeepCopyInto(out *ClusterLightrunJavaAgentSpec) {
+	*out = *in
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	in.Template.DeepCopyInto(&out.Template)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterLightrunJavaAgentSpec.
+func (in *ClusterLightrunJavaAgentSpec) DeepCopy() *ClusterLightrunJavaAgentSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterLightrunJavaAgentSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterLightrunJavaAgentStatus) DeepCopyInto(out *ClusterLightrunJavaAgentStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]NamespaceReconcileStatus, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterLightrunJavaAgentStatus.
+func (in *ClusterLightrunJavaAgentStatus) DeepCopy() *ClusterLightrunJavaAgentStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterLightrunJavaAgentStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ContainerPatchPreview) DeepCopyInto(out *ContainerPatchPreview) {
+	*out = *in
+	if in.AddedVolumeMounts != nil {
+		in, out := &in.AddedVolumeMounts, &out.AddedVolumeMounts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RemovedVolumeMounts != nil {
+		in, out := &in.RemovedVolumeMounts, &out.RemovedVolumeMounts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ContainerPatchPreview.
+func (in *ContainerPatchPreview) DeepCopy() *ContainerPatchPreview {
+	if in == nil {
+		return nil
+	}
+	out := new(ContainerPatchPreview)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DriftBackoff) DeepCopyInto(out *DriftBackoff) {
+	*out = *in
+	if in.Initial != nil {
+		in, out := &in.Initial, &out.Initial
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.Max != nil {
+		in, out := &in.Max, &out.Max
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DriftBackoff.
+func (in *DriftBackoff) DeepCopy() *DriftBackoff {
+	if in == nil {
+		return nil
+	}
+	out := new(DriftBackoff)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitOpsCompatibility) DeepCopyInto(out *GitOpsCompatibility) {
+	*out = *in
+	if in.Tools != nil {
+		in, out := &in.Tools, &out.Tools
+		*out = make([]GitOpsTool, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitOpsCompatibility.
+func (in *GitOpsCompatibility) DeepCopy() *GitOpsCompatibility {
+	if in == nil {
+		return nil
+	}
+	out := new(GitOpsCompatibility)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *InitContainer) DeepCopyInto(out *InitContainer) {
 	*out = *in
+	if in.ImagePullSecrets != nil {
+		in, out := &in.ImagePullSecrets, &out.ImagePullSecrets
+		*out = make([]corev1.LocalObjectReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = new(corev1.ResourceRequirements)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(InitContainerSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Env != nil {
+		in, out := &in.Env, &out.Env
+		*out = make([]corev1.EnvVar, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InitContainer.
@@ -40,6 +255,36 @@ func (in *InitContainer) DeepCopy() *InitContainer {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InitContainerSecurityContext) DeepCopyInto(out *InitContainerSecurityContext) {
+	*out = *in
+	if in.RunAsUser != nil {
+		in, out := &in.RunAsUser, &out.RunAsUser
+		*out = new(int64)
+		**out = **in
+	}
+	if in.RunAsGroup != nil {
+		in, out := &in.RunAsGroup, &out.RunAsGroup
+		*out = new(int64)
+		**out = **in
+	}
+	if in.ReadOnlyRootFilesystem != nil {
+		in, out := &in.ReadOnlyRootFilesystem, &out.ReadOnlyRootFilesystem
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InitContainerSecurityContext.
+func (in *InitContainerSecurityContext) DeepCopy() *InitContainerSecurityContext {
+	if in == nil {
+		return nil
+	}
+	out := new(InitContainerSecurityContext)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *LightrunJavaAgent) DeepCopyInto(out *LightrunJavaAgent) {
 	*out = *in
@@ -107,7 +352,17 @@ func (in *LightrunJavaAgentSpec) DeepCopyInto(out *LightrunJavaAgentSpec) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
-	out.InitContainer = in.InitContainer
+	in.InitContainer.DeepCopyInto(&out.InitContainer)
+	if in.WorkloadSelector != nil {
+		in, out := &in.WorkloadSelector, &out.WorkloadSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.WorkloadKinds != nil {
+		in, out := &in.WorkloadKinds, &out.WorkloadKinds
+		*out = make([]WorkloadType, len(*in))
+		copy(*out, *in)
+	}
 	if in.AgentConfig != nil {
 		in, out := &in.AgentConfig, &out.AgentConfig
 		*out = make(map[string]string, len(*in))
@@ -120,6 +375,35 @@ func (in *LightrunJavaAgentSpec) DeepCopyInto(out *LightrunJavaAgentSpec) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.MaintenanceWindow != nil {
+		in, out := &in.MaintenanceWindow, &out.MaintenanceWindow
+		*out = new(MaintenanceWindow)
+		**out = **in
+	}
+	if in.GitOpsCompatibility != nil {
+		in, out := &in.GitOpsCompatibility, &out.GitOpsCompatibility
+		*out = new(GitOpsCompatibility)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DriftBackoff != nil {
+		in, out := &in.DriftBackoff, &out.DriftBackoff
+		*out = new(DriftBackoff)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Canary != nil {
+		in, out := &in.Canary, &out.Canary
+		*out = new(Canary)
+		**out = **in
+	}
+	if in.ExpiresAt != nil {
+		in, out := &in.ExpiresAt, &out.ExpiresAt
+		*out = (*in).DeepCopy()
+	}
+	if in.TTL != nil {
+		in, out := &in.TTL, &out.TTL
+		*out = new(v1.Duration)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LightrunJavaAgentSpec.
@@ -146,6 +430,28 @@ func (in *LightrunJavaAgentStatus) DeepCopyInto(out *LightrunJavaAgentStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Workloads != nil {
+		in, out := &in.Workloads, &out.Workloads
+		*out = make([]WorkloadReconcileStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.NextRolloutTime != nil {
+		in, out := &in.NextRolloutTime, &out.NextRolloutTime
+		*out = (*in).DeepCopy()
+	}
+	if in.ExpiresAt != nil {
+		in, out := &in.ExpiresAt, &out.ExpiresAt
+		*out = (*in).DeepCopy()
+	}
+	if in.AgentPlatformImages != nil {
+		in, out := &in.AgentPlatformImages, &out.AgentPlatformImages
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LightrunJavaAgentStatus.
@@ -157,3 +463,142 @@ func (in *LightrunJavaAgentStatus) DeepCopy() *LightrunJavaAgentStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MaintenanceWindow) DeepCopyInto(out *MaintenanceWindow) {
+	*out = *in
+	out.Duration = in.Duration
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MaintenanceWindow.
+func (in *MaintenanceWindow) DeepCopy() *MaintenanceWindow {
+	if in == nil {
+		return nil
+	}
+	out := new(MaintenanceWindow)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NamespaceReconcileStatus) DeepCopyInto(out *NamespaceReconcileStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NamespaceReconcileStatus.
+func (in *NamespaceReconcileStatus) DeepCopy() *NamespaceReconcileStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NamespaceReconcileStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkloadDrift) DeepCopyInto(out *WorkloadDrift) {
+	*out = *in
+	in.LastDriftTime.DeepCopyInto(&out.LastDriftTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkloadDrift.
+func (in *WorkloadDrift) DeepCopy() *WorkloadDrift {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkloadDrift)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkloadPatchPreview) DeepCopyInto(out *WorkloadPatchPreview) {
+	*out = *in
+	if in.AddedVolumes != nil {
+		in, out := &in.AddedVolumes, &out.AddedVolumes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RemovedVolumes != nil {
+		in, out := &in.RemovedVolumes, &out.RemovedVolumes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AddedInitContainers != nil {
+		in, out := &in.AddedInitContainers, &out.AddedInitContainers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RemovedInitContainers != nil {
+		in, out := &in.RemovedInitContainers, &out.RemovedInitContainers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Containers != nil {
+		in, out := &in.Containers, &out.Containers
+		*out = make([]ContainerPatchPreview, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkloadPatchPreview.
+func (in *WorkloadPatchPreview) DeepCopy() *WorkloadPatchPreview {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkloadPatchPreview)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkloadReconcileStatus) DeepCopyInto(out *WorkloadReconcileStatus) {
+	*out = *in
+	if in.Containers != nil {
+		in, out := &in.Containers, &out.Containers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.UpdatedReplicas != nil {
+		in, out := &in.UpdatedReplicas, &out.UpdatedReplicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.ReadyReplicas != nil {
+		in, out := &in.ReadyReplicas, &out.ReadyReplicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Drift != nil {
+		in, out := &in.Drift, &out.Drift
+		*out = new(WorkloadDrift)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.CanaryReplicas != nil {
+		in, out := &in.CanaryReplicas, &out.CanaryReplicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Preview != nil {
+		in, out := &in.Preview, &out.Preview
+		*out = new(WorkloadPatchPreview)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkloadReconcileStatus.
+func (in *WorkloadReconcileStatus) DeepCopy() *WorkloadReconcileStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkloadReconcileStatus)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -24,11 +24,17 @@ Compile all warnings into a single message, and call fail.
   {{- end }}
 
   {{- /* Workload configuration validation */}}
+  {{- if .workloadSelector }}
+    {{- if .workloadName }}
+      {{- $objectErrorMsgs = append $objectErrorMsgs "Workload Configuration Checker:\n  Error: Both 'workloadName' and 'workloadSelector' are defined. Please use only one of them." -}}
+    {{- end }}
+  {{- else }}
   {{- if not .workloadName }}
-    {{- $objectErrorMsgs = append $objectErrorMsgs "Workload Configuration Checker:\n  Error: The 'workloadName' field is missing. Please provide the 'workloadName' parameter." -}}
+    {{- $objectErrorMsgs = append $objectErrorMsgs "Workload Configuration Checker:\n  Error: The 'workloadName' field is missing. Please provide the 'workloadName' or 'workloadSelector' parameter." -}}
   {{- end }}
   {{- if not .workloadType }}
-    {{- $objectErrorMsgs = append $objectErrorMsgs "Workload Configuration Checker:\n  Error: The 'workloadType' field is missing. Please provide the 'workloadType' parameter (Deployment or StatefulSet)." -}}
+    {{- $objectErrorMsgs = append $objectErrorMsgs "Workload Configuration Checker:\n  Error: The 'workloadType' field is missing. Please provide the 'workloadType' parameter (Deployment, StatefulSet, DaemonSet, CronJob, Job or Rollout)." -}}
+  {{- end }}
   {{- end }}
 
   {{- if not .containerSelector }}
@@ -33,12 +33,14 @@ import (
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	agentsv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
 	"github.com/lightrun-platform/lightrun-k8s-operator/internal/controller"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -46,6 +48,8 @@ var (
 	scheme               = runtime.NewScheme()
 	setupLog             = ctrl.Log.WithName("setup")
 	watchNamespaceEnvVar = "WATCH_NAMESPACE"
+	// operatorNamespaceEnvVar is the namespace of the operator, ClusterLightrunJavaAgent Secrets are taken from it
+	operatorNamespaceEnvVar = "OPERATOR_NAMESPACE"
 )
 
 func init() {
@@ -75,12 +79,32 @@ func main() {
 	var probeAddr string
 	var pprofAddr string
 	var enableLeaderElection bool
+	var enablePodInjectionWebhook bool
+	var enableValidationWebhook bool
+	var defaultImagePullSecrets string
+	var imageRegistryMirror string
+	var agentCatalog string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.StringVar(&pprofAddr, "pprof-bind-address", "0", "The address the pprof endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&enablePodInjectionWebhook, "enable-pod-injection-webhook", false,
+		"Enable mutating webhook that injects the agent into pods of LightrunJavaAgents with Webhook injection mode. "+
+			"Requires the webhook configuration and serving certificate to be installed.")
+	flag.BoolVar(&enableValidationWebhook, "enable-validation-webhook", false,
+		"Enable validating webhook that rejects misconfigured LightrunJavaAgents on apply. "+
+			"Requires the webhook configuration and serving certificate to be installed.")
+	flag.StringVar(&defaultImagePullSecrets, "default-image-pull-secrets", "",
+		"Comma separated names of the pull secrets added to the pods of every patched workload. "+
+			"Secrets have to exist in the namespaces of the workloads.")
+	flag.StringVar(&imageRegistryMirror, "image-registry-mirror", "",
+		"Registry that replaces the registry of the agent init container images, e.g. registry.local/dockerhub. "+
+			"Used in air-gapped clusters that can't pull images from Docker Hub.")
+	flag.StringVar(&agentCatalog, "agent-catalog-configmap", "lightrun-agent-catalog",
+		"Name of the ConfigMap in the operator namespace that maps agentVersion of LightrunJavaAgents to the agent images. "+
+			"Requires "+operatorNamespaceEnvVar+" Env Var.")
 
 	opts := zap.Options{
 		Development:     false,
@@ -133,14 +157,53 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controller.LightrunJavaAgentReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-		Log:    ctrl.Log.WithName("controllers").WithName("LightrunJavaAgent"),
-	}).SetupWithManager(mgr); err != nil {
+	operatorNamespace := os.Getenv(operatorNamespaceEnvVar)
+	lightrunJavaAgentReconciler := &controller.LightrunJavaAgentReconciler{
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Log:       ctrl.Log.WithName("controllers").WithName("LightrunJavaAgent"),
+		APIReader: mgr.GetAPIReader(),
+		Recorder:  mgr.GetEventRecorderFor("lightrun-controller"),
+
+		ImageRegistryMirror: imageRegistryMirror,
+	}
+	if operatorNamespace != "" && agentCatalog != "" {
+		lightrunJavaAgentReconciler.AgentCatalog = client.ObjectKey{Namespace: operatorNamespace, Name: agentCatalog}
+	}
+	for _, name := range strings.Split(defaultImagePullSecrets, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			lightrunJavaAgentReconciler.DefaultImagePullSecrets = append(lightrunJavaAgentReconciler.DefaultImagePullSecrets, name)
+		}
+	}
+	if err = lightrunJavaAgentReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "LightrunJavaAgent")
 		os.Exit(1)
 	}
+	if enablePodInjectionWebhook {
+		setupLog.Info("Pod injection webhook is enabled")
+		mgr.GetWebhookServer().Register(controller.PodInjectionWebhookPath, &webhook.Admission{
+			Handler: controller.NewPodInjector(lightrunJavaAgentReconciler, mgr.GetAPIReader()),
+		})
+	}
+	if enableValidationWebhook {
+		setupLog.Info("LightrunJavaAgent validation webhook is enabled")
+		if err = (&controller.LightrunJavaAgentValidator{Client: mgr.GetClient()}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "LightrunJavaAgent")
+			os.Exit(1)
+		}
+	}
+	// ClusterLightrunJavaAgent rolls out agents across namespaces, so it requires the operator to manage all of them
+	if len(watchNamespaces) > 0 || operatorNamespace == "" {
+		setupLog.Info("ClusterLightrunJavaAgent controller is disabled. It requires cluster scope and " + operatorNamespaceEnvVar + " Env Var")
+	} else if err = (&controller.ClusterLightrunJavaAgentReconciler{
+		Client:            mgr.GetClient(),
+		Scheme:            mgr.GetScheme(),
+		Log:               ctrl.Log.WithName("controllers").WithName("ClusterLightrunJavaAgent"),
+		OperatorNamespace: operatorNamespace,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterLightrunJavaAgent")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -0,0 +1,241 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+const (
+	// Key of the agent catalog ConfigMap with the images of the agent versions
+	agentCatalogKey = "catalog.yaml"
+	// Platform of the agent is selected for every workload when agentPlatform is not set
+	agentPlatformAuto = "auto"
+	// Platform of the agent for glibc based images when the libc is not hinted by the app container images
+	defaultAgentLibc = "linux"
+)
+
+// Parts of the image references hinting the libc of the app container. Images without a hint are expected to use glibc
+var (
+	muslImageHints  = []string{"alpine", "musl"}
+	glibcImageHints = []string{"debian", "ubuntu", "bullseye", "bookworm", "buster", "jammy", "focal", "noble", "ubi", "centos", "rhel", "distroless", "slim"}
+)
+
+// agentCatalog maps agent versions and platforms to the images pinned to digests. Platform is the libc of the agent
+// (linux or alpine) optionally followed by the CPU architecture. Platforms without the architecture are multi-arch images, e.g.
+//
+//	"1.7.0":
+//	  linux: lightruncom/k8s-operator-init-java-agent-linux@sha256:...
+//	  linux-arm64: lightruncom/k8s-operator-init-java-agent-linux-arm64@sha256:...
+//	  alpine: lightruncom/k8s-operator-init-java-agent-alpine@sha256:...
+type agentCatalog map[string]map[string]string
+
+// agentPlatformError is returned when the agent platform of the workload can't be selected automatically
+type agentPlatformError struct {
+	message string
+}
+
+func (e *agentPlatformError) Error() string {
+	return e.message
+}
+
+// resolveAgentImage records the images of the agentVersion from the agent catalog in the status of the LightrunJavaAgent.
+// Explicit agentPlatform is resolved to a single image, with auto platform all the platforms of the version are recorded
+// and the platform is selected for every workload by agentImage.
+// Images pinned to digests are the only accepted catalog entries, so a moved tag can't change the agent of the workload
+func (r *LightrunJavaAgentReconciler) resolveAgentImage(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent) error {
+	initContainer := lightrunJavaAgent.Spec.InitContainer
+	lightrunJavaAgent.Status.AgentImage = ""
+	lightrunJavaAgent.Status.AgentPlatformImages = nil
+	if initContainer.AgentVersion == "" {
+		return nil
+	}
+	if r.AgentCatalog.Name == "" {
+		return fmt.Errorf("agentVersion %s can't be resolved, agent catalog is not configured in the operator", initContainer.AgentVersion)
+	}
+
+	cm := &corev1.ConfigMap{}
+	err := r.APIReader.Get(ctx, r.AgentCatalog, cm)
+	if err != nil {
+		return fmt.Errorf("unable to read agent catalog %s: %w", r.AgentCatalog, err)
+	}
+	catalog := agentCatalog{}
+	err = yaml.Unmarshal([]byte(cm.Data[agentCatalogKey]), &catalog)
+	if err != nil {
+		return fmt.Errorf("unable to parse agent catalog %s: %w", r.AgentCatalog, err)
+	}
+	platformImages, ok := catalog[initContainer.AgentVersion]
+	if !ok {
+		return fmt.Errorf("agent version %s is missing from the agent catalog %s", initContainer.AgentVersion, r.AgentCatalog)
+	}
+
+	platform := initContainer.AgentPlatform
+	if platform == "" || platform == agentPlatformAuto {
+		for platform, image := range platformImages {
+			if !strings.Contains(image, "@sha256:") {
+				return fmt.Errorf("agent image %s of version %s for platform %s is not pinned to a digest in the agent catalog %s", image, initContainer.AgentVersion, platform, r.AgentCatalog)
+			}
+		}
+		lightrunJavaAgent.Status.AgentPlatformImages = platformImages
+		return nil
+	}
+	image, ok := platformImages[platform]
+	if !ok {
+		return fmt.Errorf("agent version %s for platform %s is missing from the agent catalog %s", initContainer.AgentVersion, platform, r.AgentCatalog)
+	}
+	if !strings.Contains(image, "@sha256:") {
+		return fmt.Errorf("agent image %s of version %s is not pinned to a digest in the agent catalog %s", image, initContainer.AgentVersion, r.AgentCatalog)
+	}
+	lightrunJavaAgent.Status.AgentImage = image
+	return nil
+}
+
+// agentImage returns the agent image for the pod template with the registry replaced by the mirror of the operator.
+// Image of agentVersion is taken from the status, see resolveAgentImage
+func (r *LightrunJavaAgentReconciler) agentImage(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, template *corev1.PodTemplateSpec) (string, error) {
+	initContainer := lightrunJavaAgent.Spec.InitContainer
+	image := initContainer.Image
+	if initContainer.AgentVersion != "" {
+		image = lightrunJavaAgent.Status.AgentImage
+		if image == "" {
+			var err error
+			image, err = selectPlatformImage(lightrunJavaAgent.Status.AgentPlatformImages, template, lightrunJavaAgent.Spec.ContainerSelector)
+			if err != nil {
+				return "", fmt.Errorf("agent version %s: %w", initContainer.AgentVersion, err)
+			}
+		}
+	}
+	return mirrorImage(image, r.ImageRegistryMirror), nil
+}
+
+// selectPlatformImage returns the agent image matching the libc hinted by the images of the selected containers
+// and the CPU architecture the pods are restricted to. Platform with the architecture is preferred,
+// multi-arch platform is used if the architecture is not known or the pods may run on several ones
+func selectPlatformImage(platformImages map[string]string, template *corev1.PodTemplateSpec, containerSelector []string) (string, error) {
+	if len(platformImages) == 0 {
+		return "", errors.New("agent version is not resolved yet")
+	}
+
+	libcHints := map[string][]string{}
+	for _, container := range template.Spec.Containers {
+		if !slices.Contains(containerSelector, container.Name) {
+			continue
+		}
+		if libc := imageLibc(container.Image); libc != "" {
+			libcHints[libc] = append(libcHints[libc], container.Name)
+		}
+	}
+	if len(libcHints) > 1 {
+		return "", &agentPlatformError{fmt.Sprintf("agent platform is ambiguous, selected containers use different libc: %v. Patch them with separate LightrunJavaAgents or set agentPlatform", libcHints)}
+	}
+	libc := defaultAgentLibc
+	for hinted := range libcHints {
+		libc = hinted
+	}
+
+	archs := podArchitectures(&template.Spec)
+	if archs != nil && len(archs) == 0 {
+		return "", &agentPlatformError{"agent platform is ambiguous, nodeSelector and node affinity of the pods don't allow any " + corev1.LabelArchStable}
+	}
+	var platforms []string
+	if len(archs) == 1 {
+		platforms = append(platforms, libc+"-"+archs[0])
+	}
+	platforms = append(platforms, libc)
+	for _, platform := range platforms {
+		if image, ok := platformImages[platform]; ok {
+			return image, nil
+		}
+	}
+
+	if len(archs) != 1 {
+		for platform := range platformImages {
+			if !strings.HasPrefix(platform, libc+"-") {
+				continue
+			}
+			if archs == nil {
+				return "", &agentPlatformError{fmt.Sprintf("agent platform is ambiguous, agent catalog has only architecture specific %s images, but the pods are not restricted to a single %s by nodeSelector or node affinity", libc, corev1.LabelArchStable)}
+			}
+			return "", &agentPlatformError{fmt.Sprintf("agent platform is ambiguous, pods may run on %v nodes and agent catalog has no multi-arch %s image", archs, libc)}
+		}
+	}
+	return "", fmt.Errorf("platforms %v are missing from the agent catalog", platforms)
+}
+
+// imageLibc returns the libc hinted by the image reference of the container, empty string if there is no hint
+func imageLibc(image string) string {
+	// Registry host may contain anything, only the repository and the tag are hints
+	if registry, repository, found := strings.Cut(image, "/"); found && (strings.ContainsAny(registry, ".:") || registry == "localhost") {
+		image = repository
+	}
+	image = strings.ToLower(image)
+	for _, hint := range muslImageHints {
+		if strings.Contains(image, hint) {
+			return "alpine"
+		}
+	}
+	for _, hint := range glibcImageHints {
+		if strings.Contains(image, hint) {
+			return defaultAgentLibc
+		}
+	}
+	return ""
+}
+
+// podArchitectures returns the CPU architectures allowed by the nodeSelector and the required node affinity of the pod.
+// nil is returned if the architecture is not restricted
+func podArchitectures(podSpec *corev1.PodSpec) []string {
+	var archs []string
+	if arch, ok := podSpec.NodeSelector[corev1.LabelArchStable]; ok {
+		archs = []string{arch}
+	}
+	if podSpec.Affinity == nil || podSpec.Affinity.NodeAffinity == nil || podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return archs
+	}
+
+	// Node selector terms are ORed, the architecture is restricted only if every term restricts it
+	terms := podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	affinityArchs := []string{}
+	for _, term := range terms {
+		termArchs := nodeSelectorTermArchitectures(term)
+		if termArchs == nil {
+			return archs
+		}
+		for _, arch := range termArchs {
+			if !slices.Contains(affinityArchs, arch) {
+				affinityArchs = append(affinityArchs, arch)
+			}
+		}
+	}
+	if len(terms) == 0 {
+		return archs
+	}
+	if archs == nil {
+		return affinityArchs
+	}
+	return slices.DeleteFunc(affinityArchs, func(arch string) bool { return !slices.Contains(archs, arch) })
+}
+
+// nodeSelectorTermArchitectures returns the CPU architectures allowed by the In expressions of the term, nil if there are none
+func nodeSelectorTermArchitectures(term corev1.NodeSelectorTerm) []string {
+	var archs []string
+	for _, expression := range term.MatchExpressions {
+		if expression.Key != corev1.LabelArchStable || expression.Operator != corev1.NodeSelectorOpIn {
+			continue
+		}
+		if archs == nil {
+			archs = slices.Clone(expression.Values)
+			continue
+		}
+		// Expressions of the term are ANDed
+		archs = slices.DeleteFunc(archs, func(arch string) bool { return !slices.Contains(expression.Values, arch) })
+	}
+	return archs
+}
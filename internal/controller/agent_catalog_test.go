@@ -0,0 +1,274 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func Test_resolveAgentImage(t *testing.T) {
+	catalogKey := client.ObjectKey{Namespace: "lightrun", Name: "lightrun-agent-catalog"}
+	catalog := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: catalogKey.Name, Namespace: catalogKey.Namespace},
+		Data: map[string]string{agentCatalogKey: `
+"1.7.0":
+  linux: lightruncom/agent-linux@sha256:abc
+  alpine: lightruncom/agent-alpine@sha256:def
+"1.6.0":
+  linux: lightruncom/agent-linux@sha256:123
+  alpine: lightruncom/agent-alpine:1.6.0
+`},
+	}
+
+	tests := []struct {
+		name               string
+		catalogKey         client.ObjectKey
+		agentVersion       string
+		platform           string
+		want               string
+		wantPlatformImages int
+		wantErr            string
+	}{
+		{
+			name:       "image is used without agentVersion",
+			catalogKey: catalogKey,
+		},
+		{
+			name:         "explicit platform",
+			catalogKey:   catalogKey,
+			agentVersion: "1.6.0",
+			platform:     "linux",
+			want:         "lightruncom/agent-linux@sha256:123",
+		},
+		{
+			name:               "auto platform",
+			catalogKey:         catalogKey,
+			agentVersion:       "1.7.0",
+			platform:           agentPlatformAuto,
+			wantPlatformImages: 2,
+		},
+		{
+			name:         "missing version",
+			catalogKey:   catalogKey,
+			agentVersion: "1.8.0",
+			wantErr:      "missing from the agent catalog",
+		},
+		{
+			name:         "missing platform",
+			catalogKey:   catalogKey,
+			agentVersion: "1.7.0",
+			platform:     "windows",
+			wantErr:      "missing from the agent catalog",
+		},
+		{
+			name:         "image is not pinned to digest",
+			catalogKey:   catalogKey,
+			agentVersion: "1.6.0",
+			platform:     "alpine",
+			wantErr:      "not pinned to a digest",
+		},
+		{
+			name:         "auto platform with image not pinned to digest",
+			catalogKey:   catalogKey,
+			agentVersion: "1.6.0",
+			wantErr:      "not pinned to a digest",
+		},
+		{
+			name:         "catalog is not configured",
+			agentVersion: "1.7.0",
+			wantErr:      "agent catalog is not configured",
+		},
+		{
+			name:         "catalog doesn't exist",
+			catalogKey:   client.ObjectKey{Namespace: "lightrun", Name: "missing"},
+			agentVersion: "1.7.0",
+			wantErr:      "unable to read agent catalog",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &LightrunJavaAgentReconciler{
+				AgentCatalog: tt.catalogKey,
+				APIReader:    fake.NewClientBuilder().WithObjects(catalog).Build(),
+			}
+			lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+			lightrunJavaAgent.Spec.InitContainer.AgentVersion = tt.agentVersion
+			lightrunJavaAgent.Spec.InitContainer.AgentPlatform = tt.platform
+			lightrunJavaAgent.Status.AgentImage = "previous"
+
+			err := r.resolveAgentImage(context.Background(), lightrunJavaAgent)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("resolveAgentImage() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveAgentImage() error = %v", err)
+			}
+			if lightrunJavaAgent.Status.AgentImage != tt.want {
+				t.Errorf("status.agentImage = %q, want %q", lightrunJavaAgent.Status.AgentImage, tt.want)
+			}
+			if len(lightrunJavaAgent.Status.AgentPlatformImages) != tt.wantPlatformImages {
+				t.Errorf("status.agentPlatformImages = %v", lightrunJavaAgent.Status.AgentPlatformImages)
+			}
+		})
+	}
+}
+
+func Test_selectPlatformImage(t *testing.T) {
+	multiArch := map[string]string{
+		"linux":        "agent-linux",
+		"linux-arm64":  "agent-linux-arm64",
+		"alpine":       "agent-alpine",
+		"alpine-arm64": "agent-alpine-arm64",
+	}
+	archSpecific := map[string]string{
+		"linux-amd64": "agent-linux-amd64",
+		"linux-arm64": "agent-linux-arm64",
+	}
+	archAffinity := func(values ...string) *corev1.Affinity {
+		return &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{Key: corev1.LabelArchStable, Operator: corev1.NodeSelectorOpIn, Values: values}},
+			}}},
+		}}
+	}
+
+	tests := []struct {
+		name          string
+		images        map[string]string
+		podSpec       corev1.PodSpec
+		want          string
+		wantAmbiguous bool
+		wantErr       bool
+	}{
+		{
+			name:    "no hints",
+			images:  multiArch,
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "my-app:1.0"}}},
+			want:    "agent-linux",
+		},
+		{
+			name:   "alpine image and arm64 nodeSelector",
+			images: multiArch,
+			podSpec: corev1.PodSpec{
+				NodeSelector: map[string]string{corev1.LabelArchStable: "arm64"},
+				Containers:   []corev1.Container{{Name: "app", Image: "eclipse-temurin:17-jre-alpine"}},
+			},
+			want: "agent-alpine-arm64",
+		},
+		{
+			name:   "arm64 affinity",
+			images: archSpecific,
+			podSpec: corev1.PodSpec{
+				Affinity:   archAffinity("arm64"),
+				Containers: []corev1.Container{{Name: "app", Image: "registry.alpine.local/team/app:1.0-bookworm"}},
+			},
+			want: "agent-linux-arm64",
+		},
+		{
+			name:   "amd64 without multi-arch image",
+			images: multiArch,
+			podSpec: corev1.PodSpec{
+				NodeSelector: map[string]string{corev1.LabelArchStable: "amd64"},
+				Containers:   []corev1.Container{{Name: "app", Image: "my-app:1.0"}},
+			},
+			want: "agent-linux",
+		},
+		{
+			name:   "several architectures use multi-arch image",
+			images: multiArch,
+			podSpec: corev1.PodSpec{
+				Affinity:   archAffinity("amd64", "arm64"),
+				Containers: []corev1.Container{{Name: "app", Image: "my-app:1.0"}},
+			},
+			want: "agent-linux",
+		},
+		{
+			name:          "several architectures without multi-arch image",
+			images:        archSpecific,
+			podSpec:       corev1.PodSpec{Affinity: archAffinity("amd64", "arm64"), Containers: []corev1.Container{{Name: "app", Image: "my-app:1.0"}}},
+			wantAmbiguous: true,
+		},
+		{
+			name:          "unknown architecture without multi-arch image",
+			images:        archSpecific,
+			podSpec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "my-app:1.0"}}},
+			wantAmbiguous: true,
+		},
+		{
+			name:   "conflicting nodeSelector and affinity",
+			images: multiArch,
+			podSpec: corev1.PodSpec{
+				NodeSelector: map[string]string{corev1.LabelArchStable: "amd64"},
+				Affinity:     archAffinity("arm64"),
+				Containers:   []corev1.Container{{Name: "app", Image: "my-app:1.0"}},
+			},
+			wantAmbiguous: true,
+		},
+		{
+			name:   "selected containers with different libc",
+			images: multiArch,
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "app", Image: "eclipse-temurin:17-jre-alpine"},
+				{Name: "worker", Image: "eclipse-temurin:17-jre-jammy"},
+			}},
+			wantAmbiguous: true,
+		},
+		{
+			name:   "not selected container is ignored",
+			images: multiArch,
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "app", Image: "eclipse-temurin:17-jre-alpine"},
+				{Name: "proxy", Image: "envoyproxy/envoy:distroless-v1.30"},
+			}},
+			want: "agent-alpine",
+		},
+		{
+			name:    "missing libc",
+			images:  map[string]string{"linux": "agent-linux"},
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "eclipse-temurin:17-jre-alpine"}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectPlatformImage(tt.images, &corev1.PodTemplateSpec{Spec: tt.podSpec}, []string{"app", "worker"})
+			var platformErr *agentPlatformError
+			if ambiguous := errors.As(err, &platformErr); ambiguous != tt.wantAmbiguous {
+				t.Fatalf("selectPlatformImage() error = %v, want ambiguous %v", err, tt.wantAmbiguous)
+			}
+			if (err != nil) != (tt.wantErr || tt.wantAmbiguous) {
+				t.Fatalf("selectPlatformImage() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("selectPlatformImage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_agentImage(t *testing.T) {
+	r := &LightrunJavaAgentReconciler{ImageRegistryMirror: "registry.local"}
+	template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "busybox"}}}}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Spec.InitContainer.Image = ""
+	lightrunJavaAgent.Spec.InitContainer.AgentVersion = "1.7.0"
+
+	if _, err := r.agentImage(lightrunJavaAgent, template); err == nil {
+		t.Error("agentImage() of not resolved agentVersion succeeded")
+	}
+	lightrunJavaAgent.Status.AgentPlatformImages = map[string]string{"linux": "lightruncom/agent-linux@sha256:abc"}
+	got, err := r.agentImage(lightrunJavaAgent, template)
+	if err != nil || got != "registry.local/lightruncom/agent-linux@sha256:abc" {
+		t.Errorf("agentImage() = %q, %v", got, err)
+	}
+}
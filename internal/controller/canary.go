@@ -0,0 +1,265 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+const (
+	// Label of the canary Deployment and its pods, the value is the name of the LightrunJavaAgent
+	labelCanary      = "lightrun.com/canary"
+	canaryNameSuffix = "-lightrun-canary"
+	// Partition of the StatefulSet applied by the operator, any other partition is set by the user
+	annotationCanaryPartition = "lightrun.com/canary-partition"
+)
+
+// validateCanary returns an error if canary can't be used with the target of the LightrunJavaAgent
+func validateCanary(spec *agentv1beta.LightrunJavaAgentSpec) error {
+	if spec.Canary == nil {
+		return nil
+	}
+	switch {
+	case spec.InjectionMode == agentv1beta.InjectionModeWebhook:
+		return errors.New("canary can't be used with Webhook injection mode")
+	case spec.WorkloadSelector != nil:
+		return errors.New("canary can't be used with workloadSelector")
+	case spec.WorkloadType != agentv1beta.WorkloadTypeDeployment && spec.WorkloadType != agentv1beta.WorkloadTypeStatefulSet:
+		return errors.New("canary is supported only for Deployment and StatefulSet workloads")
+	// Canary Deployment is created from the client-side patched pod template, StatefulSet is patched as any other workload
+	case spec.WorkloadType == agentv1beta.WorkloadTypeDeployment && spec.InitContainer.InjectionMode == agentv1beta.AgentInstallModeImageVolume:
+		return errors.New("canary of a Deployment can't be used with ImageVolume injection mode")
+	case spec.WorkloadType == agentv1beta.WorkloadTypeDeployment && spec.GitOpsCompatibility != nil:
+		return errors.New("canary of a Deployment can't be used with gitOpsCompatibility")
+	}
+	return nil
+}
+
+func canaryName(workloadName string) string {
+	return workloadName + canaryNameSuffix
+}
+
+// canaryDeployment returns the copy of the original Deployment with the canary replicas and the injected pod template merged in.
+// Canary pods keep the labels of the original ones, so the Services send them the traffic as well.
+// Canary label is added to the selector, so the canary Deployment doesn't select the original pods.
+// The immutable selector of the original Deployment still matches the canary pods, but Kubernetes controllers
+// adopt only the orphaned ReplicaSets and pods, and these are owned by the canary Deployment and its ReplicaSets
+func canaryDeployment(origDeployment *appsv1.Deployment, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, injected *corev1.PodTemplateSpec) *appsv1.Deployment {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        canaryName(origDeployment.Name),
+			Namespace:   origDeployment.Namespace,
+			Labels:      map[string]string{},
+			Annotations: map[string]string{annotationAgentName: lightrunJavaAgent.Name},
+		},
+		Spec: *origDeployment.Spec.DeepCopy(),
+	}
+	for k, v := range origDeployment.Labels {
+		deployment.Labels[k] = v
+	}
+	deployment.Labels[labelCanary] = lightrunJavaAgent.Name
+	deployment.Spec.Replicas = pointer.Int32(lightrunJavaAgent.Spec.Canary.Replicas)
+
+	if deployment.Spec.Selector == nil {
+		deployment.Spec.Selector = &metav1.LabelSelector{}
+	}
+	if deployment.Spec.Selector.MatchLabels == nil {
+		deployment.Spec.Selector.MatchLabels = map[string]string{}
+	}
+	deployment.Spec.Selector.MatchLabels[labelCanary] = lightrunJavaAgent.Name
+	if deployment.Spec.Template.Labels == nil {
+		deployment.Spec.Template.Labels = map[string]string{}
+	}
+	deployment.Spec.Template.Labels[labelCanary] = lightrunJavaAgent.Name
+
+	mergePodTemplate(&deployment.Spec.Template, injected)
+	return deployment
+}
+
+// reconcileCanaryDeployment injects the agent into the canary Deployment instead of the original one.
+// Original Deployment patched before the canary was enabled is returned to the original state
+func (r *LightrunJavaAgentReconciler) reconcileCanaryDeployment(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, origDeployment *appsv1.Deployment, secret *corev1.Secret, agentArg string, cmDataHash uint64) (ctrl.Result, error) {
+	log := r.Log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name, "deployment", origDeployment.Name, "canary", canaryName(origDeployment.Name))
+
+	existing := &appsv1.Deployment{}
+	err := r.Get(ctx, client.ObjectKey{Name: canaryName(origDeployment.Name), Namespace: origDeployment.Namespace}, existing)
+	found := err == nil
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Error(err, "unable to fetch canary deployment")
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	}
+	if found && existing.Labels[labelCanary] != lightrunJavaAgent.Name {
+		err = withReason(reasonWorkloadAlreadyPatched, errors.New("deployment "+existing.Name+" already exists and isn't the canary of LightrunJavaAgent "+lightrunJavaAgent.Name))
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	}
+
+	// Config changes are rolled out to the canary pods according to the rolloutPolicy as well
+	templateHash := cmDataHash
+	if found {
+		templateHash, err = rolloutConfigHash(lightrunJavaAgent, &existing.Spec.Template, cmDataHash, time.Now())
+		if err != nil {
+			return r.errorStatus(ctx, lightrunJavaAgent, err)
+		}
+	}
+	templateApplyConfig, err := r.patchPodTemplate(lightrunJavaAgent, secret, &origDeployment.Spec.Template, templateHash)
+	if err != nil {
+		log.Error(err, "failed to patch canary deployment")
+		r.recordWorkloadError(lightrunJavaAgent, origDeployment, err)
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	}
+	injected, err := podTemplateFromApplyConfig(templateApplyConfig)
+	if err != nil {
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	}
+	canary := canaryDeployment(origDeployment, lightrunJavaAgent, injected)
+	err = r.patchContainersEnv(lightrunJavaAgent, &canary.Spec.Template, canary.Annotations, agentArg)
+	if err != nil {
+		log.Error(err, "failed to patch "+agentEnvVarName(lightrunJavaAgent))
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	}
+	canary.Annotations[annotationPatchedEnvName] = agentEnvVarName(lightrunJavaAgent)
+	canary.Annotations[annotationPatchedEnvValue] = agentArg
+	// Canary is removed by the garbage collector if the LightrunJavaAgent is removed without the finalizer
+	err = controllerutil.SetControllerReference(lightrunJavaAgent, canary, r.Scheme)
+	if err != nil {
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	}
+
+	if lightrunJavaAgent.Spec.DryRun {
+		if found {
+			canary.ResourceVersion = existing.ResourceVersion
+			err = r.Update(ctx, canary, client.DryRunAll)
+		} else {
+			err = r.Create(ctx, canary, client.DryRunAll)
+		}
+		if err != nil {
+			log.Error(err, "canary deployment is not valid")
+			return r.errorStatus(ctx, lightrunJavaAgent, err)
+		}
+		preview := templatePreview(lightrunJavaAgent, &origDeployment.Spec.Template, &canary.Spec.Template)
+		lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{r.dryRunWorkloadStatus(lightrunJavaAgent, deploymentAdapter{}, canary, cmDataHash, preview)}
+		log.V(1).Info("Dry run finished successfully")
+		return r.dryRunStatus(ctx, lightrunJavaAgent)
+	}
+
+	if origDeployment.Annotations[annotationAgentName] == lightrunJavaAgent.Name {
+		log.Info("Unpatching original deployment, agent is moved to the canary")
+		err = r.unpatchWorkload(ctx, lightrunJavaAgent, deploymentAdapter{}, origDeployment)
+		if err != nil {
+			log.Error(err, "failed to unpatch deployment")
+			return r.errorStatus(ctx, lightrunJavaAgent, err)
+		}
+	}
+
+	err = r.applyCanaryDeployment(ctx, lightrunJavaAgent, canary, existing, found)
+	if err != nil {
+		log.Error(err, "failed to apply canary deployment")
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	}
+	lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{r.workloadStatus(lightrunJavaAgent, deploymentAdapter{}, canary, cmDataHash)}
+
+	log.V(1).Info("Reconciling finished successfully")
+	return r.successStatus(ctx, lightrunJavaAgent)
+}
+
+// applyCanaryDeployment creates the canary Deployment or updates the existing one.
+// Canary is updated as a whole, as it is owned by the operator
+func (r *LightrunJavaAgentReconciler) applyCanaryDeployment(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, canary, existing *appsv1.Deployment, found bool) (err error) {
+	defer func(start time.Time) {
+		observeWorkloadOperation(agentv1beta.WorkloadTypeDeployment, operationPatch, start, err)
+	}(time.Now())
+
+	if !found {
+		err = r.Create(ctx, canary, client.FieldOwner(fieldManager))
+		if err != nil {
+			return err
+		}
+		r.recordPatchEvent(lightrunJavaAgent, deploymentAdapter{}, canary, false)
+		return nil
+	}
+	oldResourceVersion := existing.ResourceVersion
+	oldHash := existing.Spec.Template.Annotations[annotationConfigMapHash]
+	existing.Labels = canary.Labels
+	existing.Annotations = canary.Annotations
+	existing.OwnerReferences = canary.OwnerReferences
+	existing.Spec = canary.Spec
+	err = r.Update(ctx, existing, client.FieldOwner(fieldManager))
+	if err != nil {
+		return err
+	}
+	// Update without changes doesn't change the resource version and isn't recorded
+	if existing.ResourceVersion != oldResourceVersion && oldHash != "" && oldHash != existing.Spec.Template.Annotations[annotationConfigMapHash] {
+		r.recordPatchEvent(lightrunJavaAgent, deploymentAdapter{}, existing, true)
+		configRolloutsTotal.WithLabelValues(string(agentv1beta.WorkloadTypeDeployment), existing.Namespace).Inc()
+	}
+	*canary = *existing
+	return nil
+}
+
+// deleteCanaryDeployment removes the canary Deployment of the workload created by the LightrunJavaAgent.
+// Deployment with the canary name created by anyone else is left as is
+func (r *LightrunJavaAgentReconciler) deleteCanaryDeployment(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, namespace string) error {
+	canary := &appsv1.Deployment{}
+	err := r.Get(ctx, client.ObjectKey{Name: canaryName(lightrunJavaAgent.Spec.WorkloadName), Namespace: namespace}, canary)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if canary.Labels[labelCanary] != lightrunJavaAgent.Name {
+		return nil
+	}
+	r.Log.Info("Removing canary deployment", "lightrunJavaAgent", lightrunJavaAgent.Name, "canary", canary.Name)
+	return r.unpatchWorkload(ctx, lightrunJavaAgent, deploymentAdapter{}, canary)
+}
+
+// deleteCanary removes the canary Deployment, which is the way to remove the agent from it
+func (r *LightrunJavaAgentReconciler) deleteCanary(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, canary client.Object) error {
+	uid := canary.GetUID()
+	err := r.Delete(ctx, canary, client.Preconditions{UID: &uid}, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	r.recordEvent(lightrunJavaAgent, nil, corev1.EventTypeNormal, eventReasonAgentRemoved, "canary Deployment "+canary.GetName()+" removed")
+	return nil
+}
+
+// setCanaryPartition limits the rollout of the patched pod template to the canary replicas of the StatefulSet.
+// Only the pods with ordinals from the partition up are updated, so the agent is injected into the highest ordinals.
+// Partition is released together with the pod template when canary is removed, so the rest of the pods get the agent.
+// Applied partition is recorded in the annotation, partition set by the user can't be restored on release and is refused
+func setCanaryPartition(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, workload client.Object, patch *unstructured.Unstructured) error {
+	statefulSet, ok := workload.(*appsv1.StatefulSet)
+	if !ok || lightrunJavaAgent.Spec.Canary == nil {
+		return nil
+	}
+	if statefulSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+		return withReason(reasonInvalidSpec, errors.New("canary requires RollingUpdate update strategy of the StatefulSet"))
+	}
+	if rollingUpdate := statefulSet.Spec.UpdateStrategy.RollingUpdate; rollingUpdate != nil && pointer.Int32Deref(rollingUpdate.Partition, 0) != 0 &&
+		statefulSet.Annotations[annotationCanaryPartition] != strconv.Itoa(int(*rollingUpdate.Partition)) {
+		return withReason(reasonInvalidSpec, errors.New("canary can't be used with updateStrategy.rollingUpdate.partition already set on StatefulSet "+statefulSet.Name))
+	}
+	partition := canaryPartition(statefulSet.Spec.Replicas, lightrunJavaAgent.Spec.Canary.Replicas)
+	err := unstructured.SetNestedField(patch.Object, strconv.Itoa(int(partition)), "metadata", "annotations", annotationCanaryPartition)
+	if err != nil {
+		return err
+	}
+	return unstructured.SetNestedField(patch.Object, int64(partition), "spec", "updateStrategy", "rollingUpdate", "partition")
+}
+
+// canaryPartition returns the first ordinal of the StatefulSet pods that get the agent
+func canaryPartition(replicas *int32, canaryReplicas int32) int32 {
+	return max(pointer.Int32Deref(replicas, 1)-canaryReplicas, 0)
+}
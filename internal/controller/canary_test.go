@@ -0,0 +1,272 @@
+package controller
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func testCanaryOriginal() *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "workload", Namespace: "default", Labels: map[string]string{"app": "web"}},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: pointer.Int32(10),
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "busybox"}},
+				},
+			},
+		},
+	}
+}
+
+func Test_canaryDeployment(t *testing.T) {
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Spec.Canary = &agentv1beta.Canary{Replicas: 2}
+	orig := testCanaryOriginal()
+	injected := &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationConfigMapHash: "1"}},
+		Spec: corev1.PodSpec{
+			Volumes:        []corev1.Volume{{Name: "lightrun-agent-init"}},
+			InitContainers: []corev1.Container{{Name: initContainerName}},
+			Containers:     []corev1.Container{{Name: "app", VolumeMounts: []corev1.VolumeMount{{Name: "lightrun-agent-init", MountPath: "/lightrun"}}}},
+		},
+	}
+
+	canary := canaryDeployment(orig, lightrunJavaAgent, injected)
+	if canary.Name != "workload-lightrun-canary" {
+		t.Errorf("name = %v", canary.Name)
+	}
+	if *canary.Spec.Replicas != 2 {
+		t.Errorf("replicas = %v, want 2", *canary.Spec.Replicas)
+	}
+	if canary.Labels[labelCanary] != "agent" || canary.Annotations[annotationAgentName] != "agent" {
+		t.Errorf("canary labels = %v, annotations = %v", canary.Labels, canary.Annotations)
+	}
+	wantSelector := map[string]string{"app": "web", labelCanary: "agent"}
+	for k, v := range wantSelector {
+		if canary.Spec.Selector.MatchLabels[k] != v || canary.Spec.Template.Labels[k] != v {
+			t.Errorf("selector = %v, template labels = %v, want %v", canary.Spec.Selector.MatchLabels, canary.Spec.Template.Labels, wantSelector)
+		}
+	}
+	// Canary selector doesn't match the original pods, original selector matches the canary pods, but they are owned by the canary ReplicaSet
+	canarySelector, err := metav1.LabelSelectorAsSelector(canary.Spec.Selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canarySelector.Matches(labels.Set(orig.Spec.Template.Labels)) {
+		t.Errorf("canary selector %v matches the original pods", canarySelector)
+	}
+	origSelector, err := metav1.LabelSelectorAsSelector(orig.Spec.Selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !origSelector.Matches(labels.Set(canary.Spec.Template.Labels)) || !origSelector.Matches(labels.Set(canary.Labels)) {
+		t.Errorf("original selector %v doesn't match the canary pods, Services don't send them the traffic", origSelector)
+	}
+	if metav1.GetControllerOf(canary) != nil {
+		t.Errorf("canary deployment is owned by %v", metav1.GetControllerOf(canary))
+	}
+	if len(canary.Spec.Template.Spec.InitContainers) != 1 || len(canary.Spec.Template.Spec.Containers[0].VolumeMounts) != 1 {
+		t.Errorf("agent is not injected into the canary template: %+v", canary.Spec.Template.Spec)
+	}
+	// Original Deployment is not changed
+	if *orig.Spec.Replicas != 10 || len(orig.Spec.Selector.MatchLabels) != 1 || len(orig.Labels) != 1 || len(orig.Spec.Template.Spec.InitContainers) != 0 {
+		t.Errorf("original deployment is changed: %+v", orig)
+	}
+}
+
+func Test_setCanaryPartition(t *testing.T) {
+	tests := []struct {
+		name          string
+		replicas      *int32
+		strategy      appsv1.StatefulSetUpdateStrategyType
+		partition     *int32
+		annotation    string
+		want          int64
+		wantErrReason string
+	}{
+		{name: "highest ordinals", replicas: pointer.Int32(5), want: 3},
+		{name: "default replicas", want: 0},
+		{name: "canary larger than the workload", replicas: pointer.Int32(1), want: 0},
+		{name: "on delete strategy", replicas: pointer.Int32(5), strategy: appsv1.OnDeleteStatefulSetStrategyType, wantErrReason: reasonInvalidSpec},
+		{name: "partition applied by the operator", replicas: pointer.Int32(6), partition: pointer.Int32(3), annotation: "3", want: 4},
+		{name: "zero partition set by the user", replicas: pointer.Int32(5), partition: pointer.Int32(0), want: 3},
+		{name: "partition set by the user", replicas: pointer.Int32(5), partition: pointer.Int32(1), wantErrReason: reasonInvalidSpec},
+		{name: "partition changed by the user", replicas: pointer.Int32(5), partition: pointer.Int32(1), annotation: "3", wantErrReason: reasonInvalidSpec},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeStatefulSet)
+			lightrunJavaAgent.Spec.Canary = &agentv1beta.Canary{Replicas: 2}
+			statefulSet := &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{
+				Replicas:       tt.replicas,
+				UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: tt.strategy},
+			}}
+			if tt.partition != nil {
+				statefulSet.Spec.UpdateStrategy.RollingUpdate = &appsv1.RollingUpdateStatefulSetStrategy{Partition: tt.partition}
+			}
+			if tt.annotation != "" {
+				statefulSet.Annotations = map[string]string{annotationCanaryPartition: tt.annotation}
+			}
+			patch := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			err := setCanaryPartition(lightrunJavaAgent, statefulSet, patch)
+			if tt.wantErrReason != "" {
+				if errorReason(err) != tt.wantErrReason {
+					t.Fatalf("setCanaryPartition() error = %v, want reason %v", err, tt.wantErrReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			partition, found, _ := unstructured.NestedInt64(patch.Object, "spec", "updateStrategy", "rollingUpdate", "partition")
+			if !found || partition != tt.want {
+				t.Errorf("partition = %v (found %v), want %v", partition, found, tt.want)
+			}
+			if annotation, _, _ := unstructured.NestedString(patch.Object, "metadata", "annotations", annotationCanaryPartition); annotation != strconv.FormatInt(tt.want, 10) {
+				t.Errorf("partition annotation = %v, want %v", annotation, tt.want)
+			}
+		})
+	}
+
+	// Partition is not set without canary, so the field is released by the next apply
+	patch := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	if err := setCanaryPartition(testLightrunJavaAgent(agentv1beta.WorkloadTypeStatefulSet), &appsv1.StatefulSet{}, patch); err != nil || len(patch.Object) != 0 {
+		t.Errorf("setCanaryPartition() without canary = %v, error = %v", patch.Object, err)
+	}
+}
+
+func Test_validateCanary(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(spec *agentv1beta.LightrunJavaAgentSpec)
+		wantErr bool
+	}{
+		{name: "deployment", mutate: func(spec *agentv1beta.LightrunJavaAgentSpec) {}},
+		{name: "statefulset", mutate: func(spec *agentv1beta.LightrunJavaAgentSpec) {
+			spec.WorkloadType = agentv1beta.WorkloadTypeStatefulSet
+		}},
+		{name: "daemonset", mutate: func(spec *agentv1beta.LightrunJavaAgentSpec) {
+			spec.WorkloadType = agentv1beta.WorkloadTypeDaemonSet
+		}, wantErr: true},
+		{name: "workload selector", mutate: func(spec *agentv1beta.LightrunJavaAgentSpec) {
+			spec.WorkloadName = ""
+			spec.WorkloadSelector = &metav1.LabelSelector{}
+		}, wantErr: true},
+		{name: "webhook mode", mutate: func(spec *agentv1beta.LightrunJavaAgentSpec) {
+			spec.InjectionMode = agentv1beta.InjectionModeWebhook
+		}, wantErr: true},
+		{name: "deployment with image volume", mutate: func(spec *agentv1beta.LightrunJavaAgentSpec) {
+			spec.InitContainer.InjectionMode = agentv1beta.AgentInstallModeImageVolume
+		}, wantErr: true},
+		{name: "deployment with gitops", mutate: func(spec *agentv1beta.LightrunJavaAgentSpec) {
+			spec.GitOpsCompatibility = &agentv1beta.GitOpsCompatibility{}
+		}, wantErr: true},
+		{name: "statefulset with image volume and gitops", mutate: func(spec *agentv1beta.LightrunJavaAgentSpec) {
+			spec.WorkloadType = agentv1beta.WorkloadTypeStatefulSet
+			spec.InitContainer.InjectionMode = agentv1beta.AgentInstallModeImageVolume
+			spec.GitOpsCompatibility = &agentv1beta.GitOpsCompatibility{}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+			lightrunJavaAgent.Spec.Canary = &agentv1beta.Canary{Replicas: 1}
+			tt.mutate(&lightrunJavaAgent.Spec)
+			if err := validateCanary(&lightrunJavaAgent.Spec); (err != nil) != tt.wantErr {
+				t.Errorf("validateCanary() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_reconcileCanaryDeployment(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Spec.Canary = &agentv1beta.Canary{Replicas: 2}
+	lightrunJavaAgent.Spec.AgentEnvVarName = "JAVA_TOOL_OPTIONS"
+	orig := testCanaryOriginal()
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "default"},
+		Data:       map[string][]byte{"lightrun_key": []byte("key"), "pinned_cert_hash": []byte("hash")},
+	}
+	// Fake client doesn't create objects with server side apply
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: cmNamePrefix + lightrunJavaAgent.Name, Namespace: "default"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(lightrunJavaAgent, orig, secret, configMap).WithStatusSubresource(lightrunJavaAgent).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &LightrunJavaAgentReconciler{Client: c, Scheme: scheme, Log: zap.New(), Recorder: recorder}
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(lightrunJavaAgent)}
+	canaryKey := client.ObjectKey{Name: "workload-lightrun-canary", Namespace: "default"}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+	}
+	canary := &appsv1.Deployment{}
+	if err := c.Get(ctx, canaryKey, canary); err != nil {
+		t.Fatalf("canary deployment is not created: %v", err)
+	}
+	if *canary.Spec.Replicas != 2 || len(canary.OwnerReferences) != 1 || canary.OwnerReferences[0].Name != "agent" {
+		t.Errorf("canary replicas = %v, owner references = %v", *canary.Spec.Replicas, canary.OwnerReferences)
+	}
+	if envVarValue("JAVA_TOOL_OPTIONS", canary.Spec.Template.Spec.Containers[0].Env) == "" {
+		t.Errorf("agent env var is not set in the canary: %+v", canary.Spec.Template.Spec.Containers[0])
+	}
+	stored := &appsv1.Deployment{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(orig), stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, patched := stored.Annotations[annotationAgentName]; patched || len(stored.Spec.Template.Spec.InitContainers) != 0 {
+		t.Errorf("original deployment is patched: %+v", stored)
+	}
+	agent := &agentv1beta.LightrunJavaAgent{}
+	if err := c.Get(ctx, req.NamespacedName, agent); err != nil {
+		t.Fatal(err)
+	}
+	if len(agent.Status.Workloads) != 1 || agent.Status.Workloads[0].Name != canaryKey.Name || pointer.Int32Deref(agent.Status.Workloads[0].CanaryReplicas, 0) != 2 {
+		t.Errorf("workloads status = %+v", agent.Status.Workloads)
+	}
+	// Repeated reconciliation without changes isn't recorded
+	expectEvents(t, recorder,
+		"Normal AgentInjected agent injected into containers app of Deployment workload-lightrun-canary",
+		"Normal AgentInjected LightrunJavaAgent agent: agent injected into containers app of Deployment workload-lightrun-canary")
+
+	// Rollback by suspending the agent removes the canary
+	agent.Spec.Suspend = true
+	if err := c.Update(ctx, agent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if err := c.Get(ctx, canaryKey, &appsv1.Deployment{}); !apierrors.IsNotFound(err) {
+		t.Errorf("canary deployment is not removed, error = %v", err)
+	}
+}
@@ -0,0 +1,375 @@
+/*
+Copyright 2022 Lightrun
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/go-logr/logr"
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+const (
+	labelClusterAgentName   = "lightrun.com/clusterlightrunjavaagent"
+	clusterSecretNamePrefix = "lightrunagent-secret-"
+	clusterCleanupRequeue   = 5 * time.Second
+)
+
+// ClusterLightrunJavaAgentReconciler reconciles a ClusterLightrunJavaAgent object.
+// For every namespace matching the namespaceSelector it creates a LightrunJavaAgent and a copy of the agent Secret,
+// workloads are patched by the LightrunJavaAgentReconciler
+type ClusterLightrunJavaAgentReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	Log    logr.Logger
+	// Namespace of the operator, Secrets referenced by ClusterLightrunJavaAgents are taken from it
+	OperatorNamespace string
+}
+
+//+kubebuilder:rbac:groups=agents.lightrun.com,resources=clusterlightrunjavaagents,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=agents.lightrun.com,resources=clusterlightrunjavaagents/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=agents.lightrun.com,resources=clusterlightrunjavaagents/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;watch;list;create;update;patch;delete
+
+func (r *ClusterLightrunJavaAgentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("clusterLightrunJavaAgent", req.Name)
+	clusterAgent := &agentv1beta.ClusterLightrunJavaAgent{}
+	if err := r.Get(ctx, req.NamespacedName, clusterAgent); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Check if this ClusterLightrunJavaAgent is being deleted
+	if !clusterAgent.ObjectMeta.DeletionTimestamp.IsZero() {
+		if !containsString(clusterAgent.ObjectMeta.Finalizers, finalizerName) {
+			// Nothing to do here
+			return ctrl.Result{}, nil
+		}
+		log.Info("ClusterLightrunJavaAgent is being deleted")
+		remaining, err := r.cleanupNamespaces(ctx, clusterAgent, nil)
+		if err != nil {
+			log.Error(err, "failed to remove LightrunJavaAgents")
+			return r.errorStatus(ctx, clusterAgent, err)
+		}
+		if remaining > 0 {
+			// LightrunJavaAgents are still returning workloads to the original state
+			log.V(1).Info("Waiting for LightrunJavaAgents to be removed", "remaining", remaining)
+			return ctrl.Result{RequeueAfter: clusterCleanupRequeue}, nil
+		}
+		log.Info("Removing finalizer")
+		err = r.removeFinalizer(ctx, clusterAgent, finalizerName)
+		if err != nil {
+			return r.errorStatus(ctx, clusterAgent, err)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if clusterAgent.Spec.NamespaceSelector == nil {
+		return r.errorStatus(ctx, clusterAgent, withReason(reasonInvalidSpec, errors.New("invalid configuration: namespaceSelector must be set")))
+	}
+	selector, err := metav1.LabelSelectorAsSelector(clusterAgent.Spec.NamespaceSelector)
+	if err != nil {
+		log.Error(err, "invalid namespaceSelector")
+		return r.errorStatus(ctx, clusterAgent, withReason(reasonInvalidSpec, err))
+	}
+
+	// Get the secret from the operator namespace
+	secret := &corev1.Secret{}
+	err = r.Get(ctx, client.ObjectKey{Name: clusterAgent.Spec.Template.SecretName, Namespace: r.OperatorNamespace}, secret)
+	if err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			log.Error(err, "Secret not found", "Secret", clusterAgent.Spec.Template.SecretName, "Namespace", r.OperatorNamespace)
+			setCondition(&clusterAgent.Status.Conditions, clusterAgent.Generation, conditionSecretResolved, metav1.ConditionFalse, reasonSecretNotFound, err.Error())
+			err = withReason(reasonSecretNotFound, err)
+		}
+		return r.errorStatus(ctx, clusterAgent, err)
+	}
+	setCondition(&clusterAgent.Status.Conditions, clusterAgent.Generation, conditionSecretResolved, metav1.ConditionTrue, reasonSecretFound, "")
+
+	// Ensure that finalizer is in place
+	if !containsString(clusterAgent.ObjectMeta.Finalizers, finalizerName) {
+		log.Info("Adding finalizer")
+		err = r.addFinalizer(ctx, clusterAgent, finalizerName)
+		if err != nil {
+			return r.errorStatus(ctx, clusterAgent, err)
+		}
+	}
+
+	namespaces := &corev1.NamespaceList{}
+	err = r.List(ctx, namespaces, client.MatchingLabelsSelector{Selector: selector})
+	if err != nil {
+		log.Error(err, "unable to list namespaces")
+		return r.errorStatus(ctx, clusterAgent, err)
+	}
+
+	matched := map[string]bool{}
+	statuses := []agentv1beta.NamespaceReconcileStatus{}
+	var errs []error
+	for _, namespace := range namespaces.Items {
+		if !namespace.DeletionTimestamp.IsZero() {
+			continue
+		}
+		matched[namespace.Name] = true
+		status := agentv1beta.NamespaceReconcileStatus{Namespace: namespace.Name, Status: reconcileTypeProgressing}
+		agent, err := r.rolloutNamespace(ctx, clusterAgent, secret, namespace.Name)
+		if err != nil {
+			log.Error(err, "failed to roll out agent", "Namespace", namespace.Name)
+			status.Status = workloadStatusFailed
+			status.Message = err.Error()
+			errs = append(errs, errors.New(namespace.Name+": "+err.Error()))
+		} else if agent.Status.WorkloadStatus != "" {
+			status.Status = agent.Status.WorkloadStatus
+		}
+		statuses = append(statuses, status)
+	}
+	clusterAgent.Status.Namespaces = statuses
+
+	// Remove the agent from namespaces that don't match anymore
+	_, err = r.cleanupNamespaces(ctx, clusterAgent, matched)
+	if err != nil {
+		log.Error(err, "failed to remove LightrunJavaAgents from namespaces that don't match")
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return r.errorStatus(ctx, clusterAgent, errors.Join(errs...))
+	}
+	log.V(1).Info("Reconciling finished successfully", "namespaces", len(statuses))
+	return r.successStatus(ctx, clusterAgent)
+}
+
+// rolloutNamespace applies the copy of the agent Secret and the LightrunJavaAgent to the namespace.
+// Objects with the same name that are not managed by the ClusterLightrunJavaAgent are left as is
+func (r *ClusterLightrunJavaAgentReconciler) rolloutNamespace(ctx context.Context, clusterAgent *agentv1beta.ClusterLightrunJavaAgent, secret *corev1.Secret, namespace string) (*agentv1beta.LightrunJavaAgent, error) {
+	secretCopy := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      clusterSecretNamePrefix + clusterAgent.Name,
+			Namespace: namespace,
+			Labels:    map[string]string{labelClusterAgentName: clusterAgent.Name},
+		},
+		Type: secret.Type,
+		Data: secret.Data,
+	}
+	agent := &agentv1beta.LightrunJavaAgent{
+		TypeMeta: metav1.TypeMeta{APIVersion: agentv1beta.GroupVersion.String(), Kind: "LightrunJavaAgent"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      clusterAgent.Name,
+			Namespace: namespace,
+			Labels:    map[string]string{labelClusterAgentName: clusterAgent.Name},
+		},
+		Spec: *clusterAgent.Spec.Template.DeepCopy(),
+	}
+	agent.Spec.SecretName = secretCopy.Name
+
+	for _, obj := range []client.Object{secretCopy, agent} {
+		existing := obj.DeepCopyObject().(client.Object)
+		err := r.Get(ctx, client.ObjectKeyFromObject(obj), existing)
+		if err == nil && existing.GetLabels()[labelClusterAgentName] != clusterAgent.Name {
+			return nil, errors.New(obj.GetObjectKind().GroupVersionKind().Kind + " " + obj.GetName() + " already exists and is not managed by the ClusterLightrunJavaAgent")
+		}
+		if client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+		if err := ctrl.SetControllerReference(clusterAgent, obj, r.Scheme); err != nil {
+			return nil, err
+		}
+		err = r.Patch(ctx, obj, client.Apply, client.ForceOwnership, client.FieldOwner(fieldManager))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return agent, nil
+}
+
+// cleanupNamespaces deletes LightrunJavaAgents and Secrets of the ClusterLightrunJavaAgent in namespaces that are not kept.
+// It returns the number of LightrunJavaAgents that are still being deleted
+func (r *ClusterLightrunJavaAgentReconciler) cleanupNamespaces(ctx context.Context, clusterAgent *agentv1beta.ClusterLightrunJavaAgent, keep map[string]bool) (int, error) {
+	log := r.Log.WithValues("clusterLightrunJavaAgent", clusterAgent.Name)
+	managed := client.MatchingLabels{labelClusterAgentName: clusterAgent.Name}
+
+	agents := &agentv1beta.LightrunJavaAgentList{}
+	err := r.List(ctx, agents, managed)
+	if err != nil {
+		return 0, err
+	}
+	remaining := 0
+	for i := range agents.Items {
+		agent := &agents.Items[i]
+		if keep[agent.Namespace] {
+			continue
+		}
+		remaining++
+		if !agent.DeletionTimestamp.IsZero() {
+			continue
+		}
+		log.Info("Removing LightrunJavaAgent", "Namespace", agent.Namespace)
+		err = r.Delete(ctx, agent)
+		if client.IgnoreNotFound(err) != nil {
+			return remaining, err
+		}
+	}
+
+	secrets := &corev1.SecretList{}
+	err = r.List(ctx, secrets, managed)
+	if err != nil {
+		return remaining, err
+	}
+	for i := range secrets.Items {
+		if keep[secrets.Items[i].Namespace] {
+			continue
+		}
+		err = r.Delete(ctx, &secrets.Items[i])
+		if client.IgnoreNotFound(err) != nil {
+			return remaining, err
+		}
+	}
+	return remaining, nil
+}
+
+func (r *ClusterLightrunJavaAgentReconciler) addFinalizer(ctx context.Context, clusterAgent *agentv1beta.ClusterLightrunJavaAgent, finalizerName string) error {
+	patch := client.MergeFrom(clusterAgent.DeepCopy())
+	clusterAgent.ObjectMeta.Finalizers = append(clusterAgent.ObjectMeta.Finalizers, finalizerName)
+	// Patch response has the stored status, status set during the reconciliation is kept for the status update
+	status := clusterAgent.Status.DeepCopy()
+	err := r.Patch(ctx, clusterAgent, patch)
+	clusterAgent.Status = *status
+	return err
+}
+
+func (r *ClusterLightrunJavaAgentReconciler) removeFinalizer(ctx context.Context, clusterAgent *agentv1beta.ClusterLightrunJavaAgent, finalizerName string) error {
+	patch := client.MergeFrom(clusterAgent.DeepCopy())
+	clusterAgent.ObjectMeta.Finalizers = removeString(clusterAgent.ObjectMeta.Finalizers, finalizerName)
+	return r.Patch(ctx, clusterAgent, patch)
+}
+
+// successStatus records the successful reconciliation. Progressing stays true until the LightrunJavaAgents of all
+// the namespaces are ready
+func (r *ClusterLightrunJavaAgentReconciler) successStatus(ctx context.Context, instance *agentv1beta.ClusterLightrunJavaAgent) (reconcile.Result, error) {
+	progressing, progressingReason := metav1.ConditionFalse, reasonRolloutComplete
+	for _, namespace := range instance.Status.Namespaces {
+		if namespace.Status != reconcileTypeReady {
+			progressing, progressingReason = metav1.ConditionTrue, reasonRolloutInProgress
+			break
+		}
+	}
+	setReconcileConditions(&instance.Status.Conditions, instance.GetGeneration(), metav1.ConditionTrue, progressing, metav1.ConditionFalse, reasonReconcileSucceeded, progressingReason, "")
+	return r.updateStatus(ctx, instance, nil)
+}
+
+// errorStatus records the failed reconciliation with the reason of the error, see withReason
+func (r *ClusterLightrunJavaAgentReconciler) errorStatus(ctx context.Context, instance *agentv1beta.ClusterLightrunJavaAgent, origError error) (reconcile.Result, error) {
+	reason := errorReason(origError)
+	setReconcileConditions(&instance.Status.Conditions, instance.GetGeneration(), metav1.ConditionFalse, metav1.ConditionFalse, metav1.ConditionTrue, reason, reason, origError.Error())
+	return r.updateStatus(ctx, instance, origError)
+}
+
+func (r *ClusterLightrunJavaAgentReconciler) updateStatus(ctx context.Context, instance *agentv1beta.ClusterLightrunJavaAgent, origError error) (reconcile.Result, error) {
+	instance.Status.WorkloadStatus = workloadStatusFromConditions(instance.Status.Conditions)
+	err := r.Status().Update(ctx, instance)
+	if err != nil {
+		if apierrors.IsConflict(err) {
+			r.Log.V(2).Info("unable to update status for", "object version", instance.GetResourceVersion(), "resource version expired, will trigger another reconcile cycle", "")
+			return reconcile.Result{Requeue: true}, nil
+		}
+		r.Log.Error(err, "unable to update status for", "object", instance)
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{}, origError
+}
+
+// mapToAllClusterAgents enqueues every ClusterLightrunJavaAgent, used when namespace labels change
+func (r *ClusterLightrunJavaAgentReconciler) mapToAllClusterAgents(ctx context.Context, obj client.Object) []reconcile.Request {
+	var clusterAgents agentv1beta.ClusterLightrunJavaAgentList
+	if err := r.List(ctx, &clusterAgents); err != nil {
+		r.Log.Error(err, "could not list ClusterLightrunJavaAgentList. "+
+			"change to namespace will not be reconciled.",
+			obj.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, len(clusterAgents.Items))
+	for i, clusterAgent := range clusterAgents.Items {
+		requests[i] = reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&clusterAgent)}
+	}
+	return requests
+}
+
+// mapSecretToClusterAgent enqueues ClusterLightrunJavaAgents referencing the Secret in the operator namespace
+// and the owner of the changed Secret copy
+func (r *ClusterLightrunJavaAgentReconciler) mapSecretToClusterAgent(ctx context.Context, obj client.Object) []reconcile.Request {
+	if name, ok := obj.GetLabels()[labelClusterAgentName]; ok {
+		return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: name}}}
+	}
+	if obj.GetNamespace() != r.OperatorNamespace {
+		return nil
+	}
+	var clusterAgents agentv1beta.ClusterLightrunJavaAgentList
+	if err := r.List(ctx, &clusterAgents); err != nil {
+		r.Log.Error(err, "could not list ClusterLightrunJavaAgentList. "+
+			"change to secret will not be reconciled.",
+			obj.GetName(), obj.GetNamespace())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, clusterAgent := range clusterAgents.Items {
+		if clusterAgent.Spec.Template.SecretName == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&clusterAgent)})
+		}
+	}
+	return requests
+}
+
+// mapAgentToClusterAgent enqueues the ClusterLightrunJavaAgent that created the LightrunJavaAgent
+func (r *ClusterLightrunJavaAgentReconciler) mapAgentToClusterAgent(ctx context.Context, obj client.Object) []reconcile.Request {
+	name, ok := obj.GetLabels()[labelClusterAgentName]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: name}}}
+}
+
+// SetupWithManager configures the controller with the Manager.
+// It watches Namespaces to pick up namespaces that start or stop matching the namespaceSelector,
+// Secrets to keep the copies up to date and LightrunJavaAgents to report their status
+func (r *ClusterLightrunJavaAgentReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&agentv1beta.ClusterLightrunJavaAgent{}).
+		Watches(
+			&corev1.Namespace{},
+			handler.EnqueueRequestsFromMapFunc(r.mapToAllClusterAgents),
+		).
+		Watches(
+			&corev1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(r.mapSecretToClusterAgent),
+		).
+		Watches(
+			&agentv1beta.LightrunJavaAgent{},
+			handler.EnqueueRequestsFromMapFunc(r.mapAgentToClusterAgent),
+		).
+		Complete(r)
+}
@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func testClusterReconciler(t *testing.T, objs ...client.Object) *ClusterLightrunJavaAgentReconciler {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return &ClusterLightrunJavaAgentReconciler{
+		Client:            fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		Scheme:            scheme,
+		Log:               zap.New(),
+		OperatorNamespace: "lightrun-operator",
+	}
+}
+
+func Test_cleanupNamespaces(t *testing.T) {
+	clusterAgent := &agentv1beta.ClusterLightrunJavaAgent{ObjectMeta: metav1.ObjectMeta{Name: "cluster-agent"}}
+	managed := map[string]string{labelClusterAgentName: clusterAgent.Name}
+	objs := []client.Object{}
+	for _, namespace := range []string{"kept", "removed"} {
+		objs = append(objs,
+			&agentv1beta.LightrunJavaAgent{ObjectMeta: metav1.ObjectMeta{Name: clusterAgent.Name, Namespace: namespace, Labels: managed}},
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: clusterSecretNamePrefix + clusterAgent.Name, Namespace: namespace, Labels: managed}},
+		)
+	}
+	notManaged := &agentv1beta.LightrunJavaAgent{ObjectMeta: metav1.ObjectMeta{Name: clusterAgent.Name, Namespace: "other"}}
+	objs = append(objs, notManaged)
+	r := testClusterReconciler(t, objs...)
+
+	remaining, err := r.cleanupNamespaces(context.Background(), clusterAgent, map[string]bool{"kept": true})
+	if err != nil {
+		t.Fatalf("cleanupNamespaces() error = %v", err)
+	}
+	if remaining != 1 {
+		t.Errorf("cleanupNamespaces() remaining = %d, want 1", remaining)
+	}
+	agents := &agentv1beta.LightrunJavaAgentList{}
+	if err = r.List(context.Background(), agents); err != nil {
+		t.Fatal(err)
+	}
+	namespaces := []string{}
+	for _, agent := range agents.Items {
+		namespaces = append(namespaces, agent.Namespace)
+	}
+	if len(namespaces) != 2 || !containsString(namespaces, "kept") || !containsString(namespaces, "other") {
+		t.Errorf("LightrunJavaAgents left in namespaces %v, want [kept other]", namespaces)
+	}
+	secrets := &corev1.SecretList{}
+	if err = r.List(context.Background(), secrets); err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets.Items) != 1 || secrets.Items[0].Namespace != "kept" {
+		t.Errorf("Secrets left = %v, want only the one in kept namespace", secrets.Items)
+	}
+}
+
+func Test_mapSecretToClusterAgent(t *testing.T) {
+	clusterAgent := &agentv1beta.ClusterLightrunJavaAgent{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-agent"},
+		Spec:       agentv1beta.ClusterLightrunJavaAgentSpec{Template: agentv1beta.LightrunJavaAgentSpec{SecretName: "lightrun-secrets"}},
+	}
+	r := testClusterReconciler(t, clusterAgent)
+
+	tests := []struct {
+		name   string
+		secret *corev1.Secret
+		want   int
+	}{
+		{
+			name:   "referenced secret in operator namespace",
+			secret: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "lightrun-secrets", Namespace: "lightrun-operator"}},
+			want:   1,
+		},
+		{
+			name:   "secret with the same name in other namespace",
+			secret: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "lightrun-secrets", Namespace: "default"}},
+			want:   0,
+		},
+		{
+			name: "secret copy",
+			secret: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: clusterSecretNamePrefix + clusterAgent.Name, Namespace: "default",
+				Labels: map[string]string{labelClusterAgentName: clusterAgent.Name}}},
+			want: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if requests := r.mapSecretToClusterAgent(context.Background(), tt.secret); len(requests) != tt.want {
+				t.Errorf("mapSecretToClusterAgent() = %v, want %d requests", requests, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"errors"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Condition types of LightrunJavaAgent and ClusterLightrunJavaAgent
+const (
+	// Agent is injected into all the target workloads
+	conditionReady = "Ready"
+	// Operator or workloads are moving to the desired state: CR is being deleted, workload is not created yet or pods are rolled out
+	conditionProgressing = "Progressing"
+	// Last reconciliation failed, reason and message describe the error
+	conditionDegraded = "Degraded"
+	// Secret with the agent key is found
+	conditionSecretResolved = "SecretResolved"
+	// Target workloads are found
+	conditionWorkloadFound = "WorkloadFound"
+	// Agent is removed from the workloads by spec.suspend
+	conditionSuspended = "Suspended"
+	// Agent env var is repeatedly reverted in the patched workloads by other tools
+	conditionDriftDetected = "DriftDetected"
+)
+
+// Reasons of the conditions. They are part of the API, so existing values must not be changed
+const (
+	reasonReconcileSucceeded       = "ReconcileSucceeded"
+	reasonReconcileFailed          = "ReconcileFailed"
+	reasonDeleting                 = "Deleting"
+	reasonWaitingForWorkload       = "WaitingForWorkload"
+	reasonRolloutInProgress        = "RolloutInProgress"
+	reasonRolloutComplete          = "RolloutComplete"
+	reasonInvalidSpec              = "InvalidSpec"
+	reasonSecretFound              = "SecretFound"
+	reasonSecretNotFound           = "SecretNotFound"
+	reasonSecretInvalid            = "SecretInvalid"
+	reasonWorkloadFound            = "WorkloadFound"
+	reasonWorkloadNotFound         = "WorkloadNotFound"
+	reasonWorkloadKindNotInstalled = "WorkloadKindNotInstalled"
+	reasonNoMatchingWorkloads      = "NoMatchingWorkloads"
+	reasonWorkloadAlreadyPatched   = "WorkloadAlreadyPatched"
+	reasonJobImmutable             = "JobImmutable"
+	reasonContainerNotFound        = "ContainerNotFound"
+	reasonEnvTooLong               = "EnvTooLong"
+	reasonAgentVersionUnresolved   = "AgentVersionUnresolved"
+	reasonAgentPlatformAmbiguous   = "AgentPlatformAmbiguous"
+	reasonDryRun                   = "DryRun"
+	reasonExpired                  = "Expired"
+	reasonSuspended                = "Suspended"
+	reasonResumed                  = "Resumed"
+	reasonDriftBackoff             = "DriftBackoff"
+	reasonRepeatedDrift            = "RepeatedDrift"
+	reasonDriftResolved            = "DriftResolved"
+)
+
+// Condition types set by the operator before the standard condition set, removed from the existing CRs
+var legacyConditionTypes = []string{"ReconcileProgressing", "ReconcileFailed"}
+
+// reasonError is an error with the reason of the Degraded condition
+type reasonError struct {
+	reason string
+	err    error
+}
+
+func (e *reasonError) Error() string {
+	return e.err.Error()
+}
+
+func (e *reasonError) Unwrap() error {
+	return e.err
+}
+
+// withReason attaches the reason of the Degraded condition to the error
+func withReason(reason string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &reasonError{reason: reason, err: err}
+}
+
+// errorReason returns the reason of the Degraded condition for the error, the first one for joined errors
+func errorReason(err error) string {
+	var reasonErr *reasonError
+	if errors.As(err, &reasonErr) {
+		return reasonErr.reason
+	}
+	var platformErr *agentPlatformError
+	if errors.As(err, &platformErr) {
+		return reasonAgentPlatformAmbiguous
+	}
+	return reasonReconcileFailed
+}
+
+// setCondition sets the condition of the object generation.
+// LastTransitionTime is changed only when the status of the condition changes
+func setCondition(conditions *[]metav1.Condition, generation int64, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// setReconcileConditions sets Ready, Progressing and Degraded conditions of the reconciliation result
+// and drops the legacy ones
+func setReconcileConditions(conditions *[]metav1.Condition, generation int64, ready, progressing, degraded metav1.ConditionStatus, reason, progressingReason, message string) {
+	for _, conditionType := range legacyConditionTypes {
+		meta.RemoveStatusCondition(conditions, conditionType)
+	}
+	setCondition(conditions, generation, conditionReady, ready, reason, message)
+	setCondition(conditions, generation, conditionProgressing, progressing, progressingReason, "")
+	setCondition(conditions, generation, conditionDegraded, degraded, reason, message)
+}
+
+// workloadStatusFromConditions returns the summary of the conditions shown in the workloadStatus field.
+// Values are kept from the time the field showed the type of the last changed condition
+func workloadStatusFromConditions(conditions []metav1.Condition) string {
+	ready := meta.FindStatusCondition(conditions, conditionReady)
+	switch {
+	case meta.IsStatusConditionTrue(conditions, conditionDegraded):
+		return reconcileTypeNotProgressing
+	case ready != nil && ready.Status == metav1.ConditionTrue:
+		return reconcileTypeReady
+	case ready != nil && ready.Reason == reasonDryRun:
+		return reconcileTypeDryRun
+	case ready != nil && ready.Reason == reasonExpired:
+		return reconcileTypeExpired
+	case ready != nil && ready.Reason == reasonSuspended:
+		return reconcileTypeSuspended
+	default:
+		return reconcileTypeProgressing
+	}
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func Test_errorReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"plain error", errors.New("failed"), reasonReconcileFailed},
+		{"reason error", withReason(reasonSecretNotFound, errors.New("secret not found")), reasonSecretNotFound},
+		{"wrapped reason error", fmt.Errorf("Deployment app: %w", withReason(reasonContainerNotFound, errors.New("no container"))), reasonContainerNotFound},
+		{"joined errors", errors.Join(errors.New("failed"), withReason(reasonEnvTooLong, errors.New("too long"))), reasonEnvTooLong},
+		{"agent platform error", fmt.Errorf("agent version 1.0: %w", &agentPlatformError{"ambiguous"}), reasonAgentPlatformAmbiguous},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorReason(tt.err); got != tt.want {
+				t.Errorf("errorReason() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if withReason(reasonEnvTooLong, nil) != nil {
+		t.Errorf("withReason() of nil error is not nil")
+	}
+}
+
+func Test_reconcileStatus(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Generation = 2
+	past := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	lightrunJavaAgent.Status.Conditions = []metav1.Condition{
+		{Type: conditionReady, Status: metav1.ConditionTrue, Reason: "reconcileSucceeded", LastTransitionTime: past},
+		{Type: "ReconcileFailed", Status: metav1.ConditionTrue, Reason: "reconcileFailed", LastTransitionTime: past},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(lightrunJavaAgent).WithStatusSubresource(lightrunJavaAgent).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &LightrunJavaAgentReconciler{Client: c, Scheme: scheme, Log: zap.New(), Recorder: recorder}
+	ctx := context.Background()
+
+	stored := func() *agentv1beta.LightrunJavaAgent {
+		agent := &agentv1beta.LightrunJavaAgent{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(lightrunJavaAgent), agent); err != nil {
+			t.Fatal(err)
+		}
+		return agent
+	}
+	expectCondition := func(agent *agentv1beta.LightrunJavaAgent, conditionType string, status metav1.ConditionStatus, reason string) *metav1.Condition {
+		t.Helper()
+		condition := meta.FindStatusCondition(agent.Status.Conditions, conditionType)
+		if condition == nil {
+			t.Fatalf("condition %s is missing: %v", conditionType, agent.Status.Conditions)
+		}
+		if condition.Status != status || condition.Reason != reason || condition.ObservedGeneration != 2 {
+			t.Errorf("condition %s = %+v, want %s with reason %s", conditionType, condition, status, reason)
+		}
+		return condition
+	}
+
+	agent := stored()
+	_, err := r.errorStatus(ctx, agent, withReason(reasonWorkloadAlreadyPatched, errors.New("deployment already patched")))
+	if err == nil {
+		t.Fatalf("errorStatus() returned no error")
+	}
+	agent = stored()
+	if meta.FindStatusCondition(agent.Status.Conditions, "ReconcileFailed") != nil {
+		t.Errorf("legacy condition is not removed: %v", agent.Status.Conditions)
+	}
+	expectCondition(agent, conditionReady, metav1.ConditionFalse, reasonWorkloadAlreadyPatched)
+	expectCondition(agent, conditionProgressing, metav1.ConditionFalse, reasonWorkloadAlreadyPatched)
+	degraded := expectCondition(agent, conditionDegraded, metav1.ConditionTrue, reasonWorkloadAlreadyPatched)
+	if degraded.Message != "deployment already patched" {
+		t.Errorf("Degraded message = %q", degraded.Message)
+	}
+	if agent.Status.WorkloadStatus != reconcileTypeNotProgressing || agent.Status.ObservedGeneration != 2 {
+		t.Errorf("status = %+v", agent.Status)
+	}
+	if event := <-recorder.Events; event != "Warning WorkloadAlreadyPatched deployment already patched" {
+		t.Errorf("errorStatus() event = %q", event)
+	}
+
+	agent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{
+		{Kind: agentv1beta.WorkloadTypeDeployment, Name: "workload", Replicas: pointer.Int32(2), UpdatedReplicas: pointer.Int32(1), ReadyReplicas: pointer.Int32(2)},
+	}
+	if _, err = r.successStatus(ctx, agent); err != nil {
+		t.Fatalf("successStatus() error = %v", err)
+	}
+	agent = stored()
+	ready := expectCondition(agent, conditionReady, metav1.ConditionTrue, reasonReconcileSucceeded)
+	expectCondition(agent, conditionProgressing, metav1.ConditionTrue, reasonRolloutInProgress)
+	expectCondition(agent, conditionDegraded, metav1.ConditionFalse, reasonReconcileSucceeded)
+	if agent.Status.WorkloadStatus != reconcileTypeReady {
+		t.Errorf("workloadStatus = %v, want %v", agent.Status.WorkloadStatus, reconcileTypeReady)
+	}
+	readySince := ready.LastTransitionTime
+
+	// Repeated result doesn't change the transition time
+	time.Sleep(time.Second)
+	agent.Status.Workloads[0].UpdatedReplicas = pointer.Int32(2)
+	if _, err = r.successStatus(ctx, agent); err != nil {
+		t.Fatalf("successStatus() error = %v", err)
+	}
+	agent = stored()
+	ready = expectCondition(agent, conditionReady, metav1.ConditionTrue, reasonReconcileSucceeded)
+	expectCondition(agent, conditionProgressing, metav1.ConditionFalse, reasonRolloutComplete)
+	if !ready.LastTransitionTime.Equal(&readySince) {
+		t.Errorf("Ready LastTransitionTime changed without status change: %v -> %v", readySince, ready.LastTransitionTime)
+	}
+
+	if _, err = r.progressingStatus(ctx, agent, reasonDeleting); err != nil {
+		t.Fatalf("progressingStatus() error = %v", err)
+	}
+	agent = stored()
+	expectCondition(agent, conditionReady, metav1.ConditionFalse, reasonDeleting)
+	expectCondition(agent, conditionProgressing, metav1.ConditionTrue, reasonDeleting)
+	expectCondition(agent, conditionDegraded, metav1.ConditionFalse, reasonDeleting)
+	if agent.Status.WorkloadStatus != reconcileTypeProgressing {
+		t.Errorf("workloadStatus = %v, want %v", agent.Status.WorkloadStatus, reconcileTypeProgressing)
+	}
+}
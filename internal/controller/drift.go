@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+const (
+	defaultDriftBackoff    = 10 * time.Second
+	defaultDriftMaxBackoff = 10 * time.Minute
+	// Number of the reverts in a row that sets DriftDetected condition
+	driftConditionThreshold = 3
+)
+
+// driftBackoffs returns the initial and the maximum backoff of re-applying the reverted agent env var
+func driftBackoffs(lightrunJavaAgent *agentv1beta.LightrunJavaAgent) (time.Duration, time.Duration) {
+	initial, maxBackoff := defaultDriftBackoff, defaultDriftMaxBackoff
+	if backoff := lightrunJavaAgent.Spec.DriftBackoff; backoff != nil {
+		if backoff.Initial != nil {
+			initial = backoff.Initial.Duration
+		}
+		if backoff.Max != nil {
+			maxBackoff = backoff.Max.Duration
+		}
+	}
+	return initial, maxBackoff
+}
+
+// driftBackoff returns the delay of re-applying the revert with the given number in a row since the previous re-apply
+func driftBackoff(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, repeated int32) time.Duration {
+	if repeated <= 1 {
+		return 0
+	}
+	backoff, maxBackoff := driftBackoffs(lightrunJavaAgent)
+	for i := int32(2); i < repeated && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+// driftStreakWindow returns the time after the re-apply when the next revert is still counted as repeated
+func driftStreakWindow(lightrunJavaAgent *agentv1beta.LightrunJavaAgent) time.Duration {
+	_, maxBackoff := driftBackoffs(lightrunJavaAgent)
+	return 2 * maxBackoff
+}
+
+// envDrifted reports whether the agent env var recorded in the annotations of the workload patched by the LightrunJavaAgent
+// was removed from any of the selected containers
+func envDrifted(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, template *corev1.PodTemplateSpec, annotations map[string]string) bool {
+	if annotations[annotationAgentName] != lightrunJavaAgent.Name {
+		return false
+	}
+	envName, envValue := annotations[annotationPatchedEnvName], annotations[annotationPatchedEnvValue]
+	if envName == "" || envValue == "" {
+		return false
+	}
+	for _, container := range template.Spec.Containers {
+		if containsString(lightrunJavaAgent.Spec.ContainerSelector, container.Name) && !strings.Contains(envVarValue(envName, container.Env), envValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// previousDrift returns the copy of the drift counters of the workload from the last reconciliation
+func previousDrift(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, uid types.UID) *agentv1beta.WorkloadDrift {
+	for _, status := range lightrunJavaAgent.Status.Workloads {
+		if status.UID == uid && status.Drift != nil {
+			return status.Drift.DeepCopy()
+		}
+	}
+	return nil
+}
+
+// reconcileDrift detects the revert of the agent env var of the workload patched before, e.g. by GitOps tools.
+// It returns the drift counters of the workload status and whether the patch may re-apply the env var now.
+// Repeated reverts are re-applied with the backoff, the patch waits for it and the workload gets Drifted status
+func (r *LightrunJavaAgentReconciler) reconcileDrift(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, adapter workloadAdapter, workload client.Object, now time.Time) (*agentv1beta.WorkloadDrift, bool) {
+	drift := previousDrift(lightrunJavaAgent, workload.GetUID())
+	streak := drift != nil && now.Sub(drift.LastDriftTime.Time) < driftStreakWindow(lightrunJavaAgent)
+	if drift != nil && !streak {
+		drift.Repeated = 0
+	}
+	template, err := adapter.podTemplate(workload)
+	if err != nil || !envDrifted(lightrunJavaAgent, template, workload.GetAnnotations()) {
+		return drift, true
+	}
+
+	repeated := int32(1)
+	if streak {
+		repeated = drift.Repeated + 1
+		if now.Before(drift.LastDriftTime.Add(driftBackoff(lightrunJavaAgent, repeated))) {
+			return drift, false
+		}
+	}
+	count := int32(1)
+	if drift != nil {
+		count = drift.Count + 1
+	}
+	name := string(adapter.kind()) + " " + workload.GetName()
+	r.Log.Info("Agent env var was reverted, re-applying it", "lightrunJavaAgent", lightrunJavaAgent.Name, "workload", name, "repeated", repeated)
+	r.recordEvent(lightrunJavaAgent, workload, corev1.EventTypeWarning, eventReasonAgentEnvDrifted,
+		agentEnvVarName(lightrunJavaAgent)+" of "+name+" was reverted by another tool, agent is injected again")
+	workloadDriftsTotal.WithLabelValues(string(adapter.kind()), workload.GetNamespace()).Inc()
+	return &agentv1beta.WorkloadDrift{Count: count, Repeated: repeated, LastDriftTime: metav1.NewTime(now)}, true
+}
+
+// driftedWorkloadStatus returns the status of the workload that waits for the drift backoff
+func (r *LightrunJavaAgentReconciler) driftedWorkloadStatus(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, adapter workloadAdapter, workload client.Object, cmDataHash uint64, drift *agentv1beta.WorkloadDrift) agentv1beta.WorkloadReconcileStatus {
+	status := r.workloadStatus(lightrunJavaAgent, adapter, workload, cmDataHash)
+	status.Status = workloadStatusDrifted
+	status.Drift = drift
+	return status
+}
+
+// nextDriftRequeue returns the time until the next re-apply of the drifted workloads or the end of the repeated reverts,
+// so the reconciliation re-applies the env var and clears DriftDetected condition. Zero if nothing is pending
+func nextDriftRequeue(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, now time.Time) time.Duration {
+	var requeue time.Duration
+	for _, status := range lightrunJavaAgent.Status.Workloads {
+		if status.Drift == nil || status.Drift.Repeated == 0 {
+			continue
+		}
+		next := status.Drift.LastDriftTime.Add(driftStreakWindow(lightrunJavaAgent))
+		if status.Status == workloadStatusDrifted {
+			next = status.Drift.LastDriftTime.Add(driftBackoff(lightrunJavaAgent, status.Drift.Repeated+1))
+		}
+		until := max(next.Sub(now), time.Second)
+		if requeue == 0 || until < requeue {
+			requeue = until
+		}
+	}
+	return requeue
+}
+
+// setDriftCondition sets DriftDetected condition when the agent env var of any workload is reverted repeatedly,
+// a sign of a GitOps tool fighting with the operator. The condition is set to False once the reverts stop
+func setDriftCondition(lightrunJavaAgent *agentv1beta.LightrunJavaAgent) {
+	var drifted []string
+	for _, status := range lightrunJavaAgent.Status.Workloads {
+		if status.Drift != nil && status.Drift.Repeated >= driftConditionThreshold {
+			drifted = append(drifted, string(status.Kind)+" "+status.Name)
+		}
+	}
+	switch {
+	case len(drifted) > 0:
+		setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionDriftDetected, metav1.ConditionTrue, reasonRepeatedDrift,
+			agentEnvVarName(lightrunJavaAgent)+" is repeatedly reverted in "+strings.Join(drifted, ", ")+". Exclude it from the sync of the GitOps tool or enable gitOpsCompatibility")
+	case meta.FindStatusCondition(lightrunJavaAgent.Status.Conditions, conditionDriftDetected) != nil:
+		setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionDriftDetected, metav1.ConditionFalse, reasonDriftResolved, "")
+	}
+}
+
+// requeueWithin shortens the requeue of the reconciliation result to the given duration, zero duration is ignored
+func requeueWithin(result ctrl.Result, after time.Duration) ctrl.Result {
+	if after > 0 && !result.Requeue && (result.RequeueAfter == 0 || after < result.RequeueAfter) {
+		result.RequeueAfter = after
+	}
+	return result
+}
@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func testDriftDeployment(env []corev1.EnvVar) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "workload", Namespace: "default", UID: "uid", Annotations: map[string]string{
+			annotationAgentName:       "agent",
+			annotationPatchedEnvName:  "JAVA_TOOL_OPTIONS",
+			annotationPatchedEnvValue: "-agentpath:/lightrun/agent/lightrun_agent.so",
+		}},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Env: env}, {Name: "sidecar"}},
+		}}},
+	}
+}
+
+func Test_envDrifted(t *testing.T) {
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	tests := []struct {
+		name     string
+		workload *appsv1.Deployment
+		want     bool
+	}{
+		{
+			name:     "env var is patched",
+			workload: testDriftDeployment([]corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g -agentpath:/lightrun/agent/lightrun_agent.so"}}),
+		},
+		{
+			name:     "agent is reverted",
+			workload: testDriftDeployment([]corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g"}}),
+			want:     true,
+		},
+		{
+			name:     "env var is removed",
+			workload: testDriftDeployment(nil),
+			want:     true,
+		},
+		{
+			name: "patched by another agent",
+			workload: func() *appsv1.Deployment {
+				workload := testDriftDeployment(nil)
+				workload.Annotations[annotationAgentName] = "other"
+				return workload
+			}(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := envDrifted(lightrunJavaAgent, &tt.workload.Spec.Template, tt.workload.Annotations); got != tt.want {
+				t.Errorf("envDrifted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_driftBackoff(t *testing.T) {
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Spec.DriftBackoff = &agentv1beta.DriftBackoff{
+		Initial: &metav1.Duration{Duration: time.Second},
+		Max:     &metav1.Duration{Duration: 5 * time.Second},
+	}
+	want := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for repeated, backoff := range want {
+		if got := driftBackoff(lightrunJavaAgent, int32(repeated)); got != backoff {
+			t.Errorf("driftBackoff(%d) = %v, want %v", repeated, got, backoff)
+		}
+	}
+}
+
+func Test_reconcileDrift(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	r := &LightrunJavaAgentReconciler{Log: zap.New(), Recorder: recorder}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Spec.AgentEnvVarName = "JAVA_TOOL_OPTIONS"
+	reverted := testDriftDeployment([]corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g"}})
+	start := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	setStatus := func(drift *agentv1beta.WorkloadDrift, status string) {
+		lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{{UID: reverted.UID, Name: reverted.Name, Kind: agentv1beta.WorkloadTypeDeployment, Status: status, Drift: drift}}
+	}
+
+	// The first revert is re-applied right away
+	drift, reapply := r.reconcileDrift(lightrunJavaAgent, deploymentAdapter{}, reverted, start)
+	if !reapply || drift.Count != 1 || drift.Repeated != 1 || !drift.LastDriftTime.Time.Equal(start) {
+		t.Fatalf("first revert = %+v, reapply %v", drift, reapply)
+	}
+	expectEvents(t, recorder,
+		"Warning AgentEnvDrifted JAVA_TOOL_OPTIONS of Deployment workload was reverted by another tool, agent is injected again",
+		"Warning AgentEnvDrifted LightrunJavaAgent agent: JAVA_TOOL_OPTIONS of Deployment workload was reverted by another tool, agent is injected again")
+	setStatus(drift, workloadStatusPatched)
+
+	// The second one waits for the initial backoff
+	drift, reapply = r.reconcileDrift(lightrunJavaAgent, deploymentAdapter{}, reverted, start.Add(5*time.Second))
+	if reapply || drift.Count != 1 {
+		t.Fatalf("revert during backoff = %+v, reapply %v", drift, reapply)
+	}
+	setStatus(drift, workloadStatusDrifted)
+	if requeue := nextDriftRequeue(lightrunJavaAgent, start.Add(5*time.Second)); requeue != 5*time.Second {
+		t.Errorf("nextDriftRequeue() = %v, want 5s", requeue)
+	}
+	drift, reapply = r.reconcileDrift(lightrunJavaAgent, deploymentAdapter{}, reverted, start.Add(defaultDriftBackoff))
+	if !reapply || drift.Count != 2 || drift.Repeated != 2 {
+		t.Fatalf("revert after backoff = %+v, reapply %v", drift, reapply)
+	}
+	setStatus(drift, workloadStatusPatched)
+	recordedEvents(recorder)
+
+	// The revert long after the previous one starts the counting of the repeated reverts again
+	later := start.Add(time.Hour)
+	drift, reapply = r.reconcileDrift(lightrunJavaAgent, deploymentAdapter{}, reverted, later)
+	if !reapply || drift.Count != 3 || drift.Repeated != 1 {
+		t.Fatalf("revert after the streak = %+v, reapply %v", drift, reapply)
+	}
+	setStatus(drift, workloadStatusPatched)
+
+	// Repeated counter is reset without reverts
+	patched := testDriftDeployment([]corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-agentpath:/lightrun/agent/lightrun_agent.so"}})
+	drift, reapply = r.reconcileDrift(lightrunJavaAgent, deploymentAdapter{}, patched, later.Add(time.Hour))
+	if !reapply || drift.Count != 3 || drift.Repeated != 0 {
+		t.Errorf("drift without revert = %+v, reapply %v", drift, reapply)
+	}
+}
+
+func Test_setDriftCondition(t *testing.T) {
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	setDriftCondition(lightrunJavaAgent)
+	if len(lightrunJavaAgent.Status.Conditions) != 0 {
+		t.Fatalf("condition is set without drift: %+v", lightrunJavaAgent.Status.Conditions)
+	}
+
+	lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{
+		{Kind: agentv1beta.WorkloadTypeDeployment, Name: "web", Drift: &agentv1beta.WorkloadDrift{Count: 5, Repeated: driftConditionThreshold}},
+		{Kind: agentv1beta.WorkloadTypeStatefulSet, Name: "db", Drift: &agentv1beta.WorkloadDrift{Count: 1, Repeated: 1}},
+	}
+	setDriftCondition(lightrunJavaAgent)
+	condition := meta.FindStatusCondition(lightrunJavaAgent.Status.Conditions, conditionDriftDetected)
+	if condition == nil || condition.Status != metav1.ConditionTrue || condition.Reason != reasonRepeatedDrift {
+		t.Fatalf("DriftDetected condition = %+v", condition)
+	}
+
+	lightrunJavaAgent.Status.Workloads[0].Drift.Repeated = 0
+	setDriftCondition(lightrunJavaAgent)
+	condition = meta.FindStatusCondition(lightrunJavaAgent.Status.Conditions, conditionDriftDetected)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != reasonDriftResolved {
+		t.Errorf("DriftDetected condition after the reverts stopped = %+v", condition)
+	}
+}
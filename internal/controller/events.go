@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+// Reasons of the Normal events. Warning events use the reasons of the Degraded condition
+const (
+	eventReasonAgentInjected      = "AgentInjected"
+	eventReasonAgentConfigChanged = "AgentConfigChanged"
+	eventReasonAgentRemoved       = "AgentRemoved"
+	eventReasonSecretChanged      = "SecretChanged"
+	eventReasonAgentExpired       = "AgentExpired"
+	eventReasonAgentSuspended     = "AgentSuspended"
+	eventReasonAgentEnvDrifted    = "AgentEnvDrifted"
+)
+
+// recordEvent records the event on the LightrunJavaAgent and on the workload, if it is set.
+// Messages don't contain values that change between reconciliations, so repeated events are aggregated by the recorder
+func (r *LightrunJavaAgentReconciler) recordEvent(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, workload client.Object, eventType, reason, message string) {
+	r.Recorder.Event(lightrunJavaAgent, eventType, reason, message)
+	if workload != nil {
+		r.Recorder.Event(workload, eventType, reason, "LightrunJavaAgent "+lightrunJavaAgent.Name+": "+message)
+	}
+}
+
+// recordPatchEvent records the injection of the agent into the workload or the rollout of the changed agent config
+func (r *LightrunJavaAgentReconciler) recordPatchEvent(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, adapter workloadAdapter, workload client.Object, wasPatched bool) {
+	name := string(adapter.kind()) + " " + workload.GetName()
+	if wasPatched {
+		r.recordEvent(lightrunJavaAgent, workload, corev1.EventTypeNormal, eventReasonAgentConfigChanged, "agent config of "+name+" changed, pods are rolled out")
+		return
+	}
+	containers := []string{}
+	if template, err := adapter.podTemplate(workload); err == nil {
+		for _, container := range template.Spec.Containers {
+			if containsString(lightrunJavaAgent.Spec.ContainerSelector, container.Name) {
+				containers = append(containers, container.Name)
+			}
+		}
+	}
+	sort.Strings(containers)
+	r.recordEvent(lightrunJavaAgent, workload, corev1.EventTypeNormal, eventReasonAgentInjected, "agent injected into containers "+strings.Join(containers, ",")+" of "+name)
+}
+
+// recordWorkloadError records the failures caused by the workload on the workload as well.
+// Other failures are recorded only on the LightrunJavaAgent by errorStatus
+func (r *LightrunJavaAgentReconciler) recordWorkloadError(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, workload client.Object, err error) {
+	reason := errorReason(err)
+	if reason != reasonWorkloadAlreadyPatched && reason != reasonContainerNotFound && reason != reasonJobImmutable {
+		return
+	}
+	r.Recorder.Event(workload, corev1.EventTypeWarning, reason, "LightrunJavaAgent "+lightrunJavaAgent.Name+": "+err.Error())
+}
+
+// secretEventHandler enqueues the LightrunJavaAgents using the Secret, see mapSecretToAgent.
+// SecretChanged event is recorded on them when the data of the Secret changes
+func (r *LightrunJavaAgentReconciler) secretEventHandler() handler.EventHandler {
+	enqueue := handler.EnqueueRequestsFromMapFunc(r.mapSecretToAgent)
+	return handler.Funcs{
+		CreateFunc:  enqueue.Create,
+		DeleteFunc:  enqueue.Delete,
+		GenericFunc: enqueue.Generic,
+		UpdateFunc: func(ctx context.Context, e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+			enqueue.Update(ctx, e, q)
+			oldSecret, ok := e.ObjectOld.(*corev1.Secret)
+			if !ok {
+				return
+			}
+			newSecret, ok := e.ObjectNew.(*corev1.Secret)
+			if !ok || apiequality.Semantic.DeepEqual(oldSecret.Data, newSecret.Data) {
+				return
+			}
+			agents, err := r.secretAgents(ctx, newSecret)
+			if err != nil {
+				return
+			}
+			for i := range agents {
+				r.Recorder.Event(&agents[i], corev1.EventTypeNormal, eventReasonSecretChanged, "secret "+newSecret.Name+" changed, agent config is updated")
+			}
+		},
+	}
+}
@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// recordedEvents returns the events recorded so far
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func expectEvents(t *testing.T, recorder *record.FakeRecorder, want ...string) {
+	t.Helper()
+	got := recordedEvents(recorder)
+	if len(got) != len(want) {
+		t.Fatalf("events = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func Test_recordPatchEvent(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	r := &LightrunJavaAgentReconciler{Recorder: recorder}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Spec.ContainerSelector = []string{"web", "app"}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "workload", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "web"}, {Name: "proxy"}, {Name: "app"}},
+		}}},
+	}
+
+	r.recordPatchEvent(lightrunJavaAgent, deploymentAdapter{}, deployment, false)
+	expectEvents(t, recorder,
+		"Normal AgentInjected agent injected into containers app,web of Deployment workload",
+		"Normal AgentInjected LightrunJavaAgent agent: agent injected into containers app,web of Deployment workload",
+	)
+
+	r.recordPatchEvent(lightrunJavaAgent, deploymentAdapter{}, deployment, true)
+	expectEvents(t, recorder,
+		"Normal AgentConfigChanged agent config of Deployment workload changed, pods are rolled out",
+		"Normal AgentConfigChanged LightrunJavaAgent agent: agent config of Deployment workload changed, pods are rolled out",
+	)
+
+	// Only the failures caused by the workload are recorded on it
+	r.recordWorkloadError(lightrunJavaAgent, deployment, withReason(reasonContainerNotFound, errors.New("unable to find matching container to patch")))
+	r.recordWorkloadError(lightrunJavaAgent, deployment, withReason(reasonSecretNotFound, errors.New("secret not found")))
+	expectEvents(t, recorder, "Warning ContainerNotFound LightrunJavaAgent agent: unable to find matching container to patch")
+}
+
+func Test_secretEventHandler(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	otherAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	otherAgent.Name = "other"
+	otherAgent.Spec.SecretName = "other-secret"
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(lightrunJavaAgent, otherAgent).
+		WithIndex(&agentv1beta.LightrunJavaAgent{}, secretNameIndexField, func(obj client.Object) []string {
+			return []string{obj.(*agentv1beta.LightrunJavaAgent).Spec.SecretName}
+		}).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &LightrunJavaAgentReconciler{Client: c, Scheme: scheme, Log: zap.New(), Recorder: recorder}
+	h := r.secretEventHandler()
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer q.ShutDown()
+
+	oldSecret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "default"}, Data: map[string][]byte{"lightrun_key": []byte("key")}}
+	relabeled := oldSecret.DeepCopy()
+	relabeled.Labels = map[string]string{"team": "a"}
+	h.Update(context.Background(), event.UpdateEvent{ObjectOld: oldSecret, ObjectNew: relabeled}, q)
+	if q.Len() != 1 {
+		t.Errorf("queue length = %d, want 1", q.Len())
+	}
+	expectEvents(t, recorder)
+
+	changed := oldSecret.DeepCopy()
+	changed.Data["lightrun_key"] = []byte("new")
+	h.Update(context.Background(), event.UpdateEvent{ObjectOld: oldSecret, ObjectNew: changed}, q)
+	expectEvents(t, recorder, "Normal SecretChanged secret secret changed, agent config is updated")
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+// validateExpiry returns an error if the expiration of the agent is set ambiguously
+func validateExpiry(spec *agentv1beta.LightrunJavaAgentSpec) error {
+	switch {
+	case spec.ExpiresAt != nil && spec.TTL != nil:
+		return errors.New("expiresAt and ttl can't be used together")
+	case spec.TTL != nil && spec.TTL.Duration <= 0:
+		return errors.New("ttl must be positive")
+	}
+	return nil
+}
+
+// agentExpiresAt returns the time when the agent is removed from the workloads, nil if the agent doesn't expire.
+// ttl is counted from the creation of the LightrunJavaAgent. Invalid expiration is reported by the reconciliation and ignored here
+func agentExpiresAt(lightrunJavaAgent *agentv1beta.LightrunJavaAgent) *metav1.Time {
+	if validateExpiry(&lightrunJavaAgent.Spec) != nil {
+		return nil
+	}
+	if lightrunJavaAgent.Spec.ExpiresAt != nil {
+		return lightrunJavaAgent.Spec.ExpiresAt.DeepCopy()
+	}
+	if lightrunJavaAgent.Spec.TTL != nil {
+		expiresAt := metav1.NewTime(lightrunJavaAgent.CreationTimestamp.Add(lightrunJavaAgent.Spec.TTL.Duration))
+		return &expiresAt
+	}
+	return nil
+}
+
+// agentExpired reports whether the agent expired at the given time
+func agentExpired(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, now time.Time) bool {
+	expiresAt := agentExpiresAt(lightrunJavaAgent)
+	return expiresAt != nil && !now.Before(expiresAt.Time)
+}
+
+// requeueBeforeExpiry shortens the requeue of the reconciliation result to the expiration of the agent
+func requeueBeforeExpiry(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, result ctrl.Result) ctrl.Result {
+	expiresAt := agentExpiresAt(lightrunJavaAgent)
+	if expiresAt == nil || !lightrunJavaAgent.DeletionTimestamp.IsZero() {
+		return result
+	}
+	return requeueWithin(result, time.Until(expiresAt.Time))
+}
+
+// reconcileExpired returns the workloads patched by the expired LightrunJavaAgent to the original state,
+// the same way as on deletion. The LightrunJavaAgent is kept with Expired status until it is re-armed or deleted
+func (r *LightrunJavaAgentReconciler) reconcileExpired(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, namespace string) (ctrl.Result, error) {
+	log := r.Log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name)
+	// Finalizer is removed once the workloads are unpatched
+	if containsString(lightrunJavaAgent.ObjectMeta.Finalizers, finalizerName) {
+		log.Info("LightrunJavaAgent expired, removing agent from the workloads")
+		err := r.unpatchAgentWorkloads(ctx, lightrunJavaAgent, namespace)
+		if err != nil {
+			log.Error(err, "failed to unpatch workloads")
+			return r.errorStatus(ctx, lightrunJavaAgent, err)
+		}
+		err = r.removeFinalizer(ctx, lightrunJavaAgent, finalizerName)
+		if err != nil {
+			return r.errorStatus(ctx, lightrunJavaAgent, err)
+		}
+		r.recordEvent(lightrunJavaAgent, nil, corev1.EventTypeNormal, eventReasonAgentExpired, "agent expired and is removed from the workloads")
+	}
+	return r.expiredStatus(ctx, lightrunJavaAgent)
+}
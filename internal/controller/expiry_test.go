@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func Test_agentExpiresAt(t *testing.T) {
+	created := metav1.NewTime(time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC))
+	expiresAt := metav1.NewTime(created.Add(time.Hour))
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.CreationTimestamp = created
+
+	if agentExpiresAt(lightrunJavaAgent) != nil || agentExpired(lightrunJavaAgent, created.AddDate(1, 0, 0)) {
+		t.Errorf("agent without expiresAt and ttl expires")
+	}
+
+	lightrunJavaAgent.Spec.ExpiresAt = &expiresAt
+	if got := agentExpiresAt(lightrunJavaAgent); !got.Equal(&expiresAt) {
+		t.Errorf("agentExpiresAt() = %v, want %v", got, expiresAt)
+	}
+	if agentExpired(lightrunJavaAgent, created.Add(59*time.Minute)) || !agentExpired(lightrunJavaAgent, created.Add(time.Hour)) {
+		t.Errorf("agentExpired() doesn't expire the agent at expiresAt")
+	}
+
+	// ttl is counted from the creation
+	lightrunJavaAgent.Spec.ExpiresAt = nil
+	lightrunJavaAgent.Spec.TTL = &metav1.Duration{Duration: 4 * time.Hour}
+	if got := agentExpiresAt(lightrunJavaAgent); !got.Time.Equal(created.Add(4 * time.Hour)) {
+		t.Errorf("agentExpiresAt() = %v, want %v", got, created.Add(4*time.Hour))
+	}
+}
+
+func Test_validateExpiry(t *testing.T) {
+	expiresAt := metav1.Now()
+	tests := []struct {
+		name    string
+		spec    agentv1beta.LightrunJavaAgentSpec
+		wantErr bool
+	}{
+		{name: "no expiration"},
+		{name: "expiresAt", spec: agentv1beta.LightrunJavaAgentSpec{ExpiresAt: &expiresAt}},
+		{name: "ttl", spec: agentv1beta.LightrunJavaAgentSpec{TTL: &metav1.Duration{Duration: time.Hour}}},
+		{name: "expiresAt and ttl", spec: agentv1beta.LightrunJavaAgentSpec{ExpiresAt: &expiresAt, TTL: &metav1.Duration{Duration: time.Hour}}, wantErr: true},
+		{name: "non positive ttl", spec: agentv1beta.LightrunJavaAgentSpec{TTL: &metav1.Duration{}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateExpiry(&tt.spec); (err != nil) != tt.wantErr {
+				t.Errorf("validateExpiry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_Reconcile_invalidExpiry(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	// Without the validating webhook the CR with both expiresAt and ttl reaches the reconciler
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	expiresAt := metav1.NewTime(time.Now().Add(-time.Minute))
+	lightrunJavaAgent.Spec.ExpiresAt = &expiresAt
+	lightrunJavaAgent.Spec.TTL = &metav1.Duration{Duration: time.Hour}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(lightrunJavaAgent).WithStatusSubresource(lightrunJavaAgent).Build()
+	r := &LightrunJavaAgentReconciler{Client: c, Scheme: scheme, Log: zap.New(), Recorder: record.NewFakeRecorder(10)}
+	ctx := context.Background()
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(lightrunJavaAgent)}); err == nil {
+		t.Fatal("Reconcile() expected error for expiresAt and ttl")
+	}
+	agent := &agentv1beta.LightrunJavaAgent{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(lightrunJavaAgent), agent); err != nil {
+		t.Fatal(err)
+	}
+	ready := meta.FindStatusCondition(agent.Status.Conditions, conditionReady)
+	if ready == nil || ready.Status != metav1.ConditionFalse || ready.Reason != reasonInvalidSpec {
+		t.Errorf("Ready condition = %+v, want False with reason %s", ready, reasonInvalidSpec)
+	}
+	if agent.Status.ExpiresAt != nil {
+		t.Errorf("status expiresAt = %v, want nil for invalid expiration", agent.Status.ExpiresAt)
+	}
+}
+
+func Test_requeueBeforeExpiry(t *testing.T) {
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.CreationTimestamp = metav1.Now()
+	lightrunJavaAgent.Spec.TTL = &metav1.Duration{Duration: time.Hour}
+
+	if result := requeueBeforeExpiry(lightrunJavaAgent, ctrl.Result{}); result.RequeueAfter <= 59*time.Minute || result.RequeueAfter > time.Hour {
+		t.Errorf("requeueBeforeExpiry() = %v, want requeue in an hour", result)
+	}
+	if result := requeueBeforeExpiry(lightrunJavaAgent, ctrl.Result{RequeueAfter: time.Minute}); result.RequeueAfter != time.Minute {
+		t.Errorf("requeueBeforeExpiry() = %v, want earlier requeue to be kept", result)
+	}
+	if result := requeueBeforeExpiry(lightrunJavaAgent, ctrl.Result{Requeue: true}); result.RequeueAfter != 0 {
+		t.Errorf("requeueBeforeExpiry() = %v, want immediate requeue to be kept", result)
+	}
+	lightrunJavaAgent.Spec.TTL = &metav1.Duration{Duration: -time.Hour}
+	if result := requeueBeforeExpiry(lightrunJavaAgent, ctrl.Result{}); result.RequeueAfter != 0 {
+		t.Errorf("requeueBeforeExpiry() = %v, want no requeue after the expiration", result)
+	}
+}
+
+func Test_reconcileExpired(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Finalizers = []string{finalizerName}
+	expiresAt := metav1.NewTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	lightrunJavaAgent.Spec.ExpiresAt = &expiresAt
+	lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{{Kind: agentv1beta.WorkloadTypeDeployment, Name: "workload", Status: workloadStatusPatched}}
+	// Deployment patched by another LightrunJavaAgent is left as is
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default", Annotations: map[string]string{annotationAgentName: "other"}}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(lightrunJavaAgent, deployment).WithStatusSubresource(lightrunJavaAgent).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &LightrunJavaAgentReconciler{Client: c, Scheme: scheme, Log: zap.New(), Recorder: recorder}
+	ctx := context.Background()
+
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(lightrunJavaAgent)})
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if result.RequeueAfter != 0 {
+		t.Errorf("Reconcile() = %v, want no requeue after the expiration", result)
+	}
+	agent := &agentv1beta.LightrunJavaAgent{}
+	if err = c.Get(ctx, client.ObjectKeyFromObject(lightrunJavaAgent), agent); err != nil {
+		t.Fatal(err)
+	}
+	if containsString(agent.Finalizers, finalizerName) {
+		t.Errorf("finalizer is not removed: %v", agent.Finalizers)
+	}
+	ready := meta.FindStatusCondition(agent.Status.Conditions, conditionReady)
+	if ready == nil || ready.Status != metav1.ConditionFalse || ready.Reason != reasonExpired {
+		t.Errorf("Ready condition = %+v, want False with reason %s", ready, reasonExpired)
+	}
+	if agent.Status.WorkloadStatus != reconcileTypeExpired || agent.Status.Workloads != nil || !agent.Status.ExpiresAt.Equal(&expiresAt) {
+		t.Errorf("status = %+v", agent.Status)
+	}
+	expectEvents(t, recorder, "Normal AgentExpired agent expired and is removed from the workloads")
+}
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+const (
+	// Read by the JVM itself, used when agentEnvVarName is empty
+	defaultAgentEnvVarName = "JAVA_TOOL_OPTIONS"
+	// Read by the java launcher of Java 9+ in addition to JAVA_TOOL_OPTIONS
+	defaultGitOpsEnvVarName = "JDK_JAVA_OPTIONS"
+	// Argo CD compares the desired state with the dry run apply result, so the fields owned by the operator are not a diff
+	annotationArgoCDCompareOptions = "argocd.argoproj.io/compare-options"
+	argoCDServerSideDiff           = "ServerSideDiff=true"
+	// Flux keeps the fields of the other field managers on apply
+	annotationFluxSSA = "kustomize.toolkit.fluxcd.io/ssa"
+	fluxSSAMerge      = "Merge"
+)
+
+// gitOpsEnvVarName returns the env var owned by the operator in GitOps compatibility mode, empty if the mode is off
+func gitOpsEnvVarName(lightrunJavaAgent *agentv1beta.LightrunJavaAgent) string {
+	gitOps := lightrunJavaAgent.Spec.GitOpsCompatibility
+	if gitOps == nil {
+		return ""
+	}
+	if gitOps.AgentEnvVarName != "" {
+		return gitOps.AgentEnvVarName
+	}
+	return defaultGitOpsEnvVarName
+}
+
+// agentEnvVarName returns the env var that gets the agent argument
+func agentEnvVarName(lightrunJavaAgent *agentv1beta.LightrunJavaAgent) string {
+	if name := gitOpsEnvVarName(lightrunJavaAgent); name != "" {
+		return name
+	}
+	if lightrunJavaAgent.Spec.AgentEnvVarName == "" {
+		return defaultAgentEnvVarName
+	}
+	return lightrunJavaAgent.Spec.AgentEnvVarName
+}
+
+// referencesEnvVar reports whether the value of the env var expands the env var with the given name
+func referencesEnvVar(envVar corev1.EnvVar, name string) bool {
+	return strings.Contains(envVar.Value, "$("+name+")")
+}
+
+// gitOpsEnvApplied reports whether the agent env var is applied with the pod template in GitOps compatibility mode.
+// Rollouts are patched with a merge of the pod template that keeps the env of the containers as is,
+// so their env var is patched on the client side as without the mode
+func gitOpsEnvApplied(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, kind agentv1beta.WorkloadType) bool {
+	return gitOpsEnvVarName(lightrunJavaAgent) != "" && kind != agentv1beta.WorkloadTypeRollout
+}
+
+// gitOpsEnvApplyConfigs returns the env vars of the container applied in GitOps compatibility mode.
+// Only the agent env var is applied, so the operator doesn't own the env vars synced from Git, including the ones referencing it
+func gitOpsEnvApplyConfigs(lightrunJavaAgent *agentv1beta.LightrunJavaAgent) ([]*corev1ac.EnvVarApplyConfiguration, error) {
+	name := gitOpsEnvVarName(lightrunJavaAgent)
+	if name == "" {
+		return nil, nil
+	}
+	agentArg, err := agentEnvVarArgument(lightrunJavaAgent.Spec.InitContainer.SharedVolumeMountPath, lightrunJavaAgent.Spec.AgentCliFlags)
+	if err != nil {
+		return nil, withReason(reasonEnvTooLong, err)
+	}
+	return []*corev1ac.EnvVarApplyConfiguration{corev1ac.EnvVar().WithName(name).WithValue(agentArg)}, nil
+}
+
+// checkGitOpsEnvVar returns an error if the env var of GitOps compatibility mode is already set by the workload.
+// The operator would take it over and the value from Git would be lost. The env var declared without a value is filled in.
+// Server side apply appends the new env var after the existing ones, while Kubernetes expands $(NAME) only
+// from the env vars defined before, so the env var referenced by the workload has to be declared before the reference
+func checkGitOpsEnvVar(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, template *corev1.PodTemplateSpec) error {
+	name := gitOpsEnvVarName(lightrunJavaAgent)
+	if name == "" {
+		return nil
+	}
+	agentPath := "-agentpath:" + lightrunJavaAgent.Spec.InitContainer.SharedVolumeMountPath + "/agent/lightrun_agent.so"
+	for _, container := range template.Spec.Containers {
+		if !containsString(lightrunJavaAgent.Spec.ContainerSelector, container.Name) {
+			continue
+		}
+		index := findEnvVarIndex(name, container.Env)
+		if index != -1 && (container.Env[index].ValueFrom != nil || (container.Env[index].Value != "" && !strings.HasPrefix(container.Env[index].Value, agentPath))) {
+			return withReason(reasonInvalidSpec, errors.New(name+" is already set in container "+container.Name+
+				", choose another gitOpsCompatibility.agentEnvVarName and reference it from the JVM options"))
+		}
+		ref := slices.IndexFunc(container.Env, func(envVar corev1.EnvVar) bool { return envVar.Name != name && referencesEnvVar(envVar, name) })
+		if ref != -1 && (index == -1 || index > ref) {
+			return withReason(reasonInvalidSpec, errors.New(container.Env[ref].Name+" of container "+container.Name+" references "+name+
+				", declare "+name+" without a value before it"))
+		}
+	}
+	return nil
+}
+
+// addGitOpsAnnotations adds the annotations of the GitOps tools to the applied annotations of the workload.
+// Annotation with a different value is set in Git and is left as is
+func addGitOpsAnnotations(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, workloadAnnotations map[string]string, annotations map[string]string) {
+	gitOps := lightrunJavaAgent.Spec.GitOpsCompatibility
+	if gitOps == nil {
+		return
+	}
+	add := func(key, value string) {
+		if current, ok := workloadAnnotations[key]; !ok || current == value {
+			annotations[key] = value
+		}
+	}
+	if slices.Contains(gitOps.Tools, agentv1beta.GitOpsToolArgoCD) {
+		add(annotationArgoCDCompareOptions, argoCDServerSideDiff)
+	}
+	if slices.Contains(gitOps.Tools, agentv1beta.GitOpsToolFlux) {
+		add(annotationFluxSSA, fluxSSAMerge)
+	}
+}
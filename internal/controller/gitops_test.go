@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+const testAgentArg = "-agentpath:/lightrun/agent/lightrun_agent.so"
+
+func Test_agentEnvVarName(t *testing.T) {
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Spec.AgentEnvVarName = "JAVA_TOOL_OPTIONS"
+	if got := agentEnvVarName(lightrunJavaAgent); got != "JAVA_TOOL_OPTIONS" {
+		t.Errorf("agentEnvVarName() without gitOpsCompatibility = %v", got)
+	}
+	lightrunJavaAgent.Spec.GitOpsCompatibility = &agentv1beta.GitOpsCompatibility{}
+	if got := agentEnvVarName(lightrunJavaAgent); got != defaultGitOpsEnvVarName {
+		t.Errorf("agentEnvVarName() with default gitOpsCompatibility = %v", got)
+	}
+	lightrunJavaAgent.Spec.GitOpsCompatibility.AgentEnvVarName = "LIGHTRUN_AGENT_OPTS"
+	if got := agentEnvVarName(lightrunJavaAgent); got != "LIGHTRUN_AGENT_OPTS" {
+		t.Errorf("agentEnvVarName() = %v, want LIGHTRUN_AGENT_OPTS", got)
+	}
+}
+
+func Test_patchPodTemplate_gitOpsEnv(t *testing.T) {
+	r := &LightrunJavaAgentReconciler{}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret"}}
+	origTemplate := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "busybox", Env: []corev1.EnvVar{
+		{Name: "LIGHTRUN_AGENT_OPTS"},
+		{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g $(LIGHTRUN_AGENT_OPTS)"},
+		{Name: "PORT", Value: "8080"},
+	}}}}}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+
+	templateApplyConfig, err := r.patchPodTemplate(lightrunJavaAgent, secret, origTemplate, 42)
+	if err != nil {
+		t.Fatalf("patchPodTemplate() error = %v", err)
+	}
+	if env := templateApplyConfig.Spec.Containers[0].Env; len(env) != 0 {
+		t.Errorf("env applied without gitOpsCompatibility: %d env vars", len(env))
+	}
+
+	// Env vars from Git, including the one referencing the agent env var, are not applied by the operator
+	lightrunJavaAgent.Spec.GitOpsCompatibility = &agentv1beta.GitOpsCompatibility{AgentEnvVarName: "LIGHTRUN_AGENT_OPTS"}
+	templateApplyConfig, err = r.patchPodTemplate(lightrunJavaAgent, secret, origTemplate, 42)
+	if err != nil {
+		t.Fatalf("patchPodTemplate() error = %v", err)
+	}
+	template, err := podTemplateFromApplyConfig(templateApplyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []corev1.EnvVar{{Name: "LIGHTRUN_AGENT_OPTS", Value: testAgentArg}}
+	if got := template.Spec.Containers[0].Env; !reflect.DeepEqual(got, want) {
+		t.Errorf("applied env = %+v, want %+v", got, want)
+	}
+}
+
+func Test_checkGitOpsEnvVar(t *testing.T) {
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	template := func(env ...corev1.EnvVar) *corev1.PodTemplateSpec {
+		return &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Env: env},
+			{Name: "sidecar", Env: []corev1.EnvVar{{Name: defaultGitOpsEnvVarName, Value: "-Xss1m"}}},
+		}}}
+	}
+	if err := checkGitOpsEnvVar(lightrunJavaAgent, template(corev1.EnvVar{Name: defaultGitOpsEnvVarName, Value: "-Xss1m"})); err != nil {
+		t.Errorf("checkGitOpsEnvVar() without gitOpsCompatibility error = %v", err)
+	}
+
+	lightrunJavaAgent.Spec.GitOpsCompatibility = &agentv1beta.GitOpsCompatibility{}
+	tests := []struct {
+		name    string
+		env     []corev1.EnvVar
+		wantErr bool
+	}{
+		{name: "env var is not set"},
+		{name: "env var is applied by the operator", env: []corev1.EnvVar{{Name: defaultGitOpsEnvVarName, Value: testAgentArg + "=flags"}}},
+		{name: "env var is set by the workload", env: []corev1.EnvVar{{Name: defaultGitOpsEnvVarName, Value: "-Xss1m"}}, wantErr: true},
+		{name: "env var is set from a secret", env: []corev1.EnvVar{{Name: defaultGitOpsEnvVarName, ValueFrom: &corev1.EnvVarSource{}}}, wantErr: true},
+		{name: "env var is declared without a value", env: []corev1.EnvVar{{Name: defaultGitOpsEnvVarName}}},
+		{name: "env var is declared before the reference", env: []corev1.EnvVar{
+			{Name: defaultGitOpsEnvVarName},
+			{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g $(" + defaultGitOpsEnvVarName + ")"},
+		}},
+		{name: "env var is referenced without the declaration", env: []corev1.EnvVar{
+			{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g $(" + defaultGitOpsEnvVarName + ")"},
+		}, wantErr: true},
+		{name: "env var is declared after the reference", env: []corev1.EnvVar{
+			{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g $(" + defaultGitOpsEnvVarName + ")"},
+			{Name: defaultGitOpsEnvVarName},
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkGitOpsEnvVar(lightrunJavaAgent, template(tt.env...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkGitOpsEnvVar() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && errorReason(err) != reasonInvalidSpec {
+				t.Errorf("checkGitOpsEnvVar() reason = %v", errorReason(err))
+			}
+		})
+	}
+}
+
+func Test_addGitOpsAnnotations(t *testing.T) {
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	annotations := map[string]string{}
+	addGitOpsAnnotations(lightrunJavaAgent, nil, annotations)
+	if len(annotations) != 0 {
+		t.Errorf("annotations added without gitOpsCompatibility: %v", annotations)
+	}
+
+	lightrunJavaAgent.Spec.GitOpsCompatibility = &agentv1beta.GitOpsCompatibility{Tools: []agentv1beta.GitOpsTool{agentv1beta.GitOpsToolArgoCD, agentv1beta.GitOpsToolFlux}}
+	workloadAnnotations := map[string]string{annotationArgoCDCompareOptions: "IgnoreExtraneous"}
+	addGitOpsAnnotations(lightrunJavaAgent, workloadAnnotations, annotations)
+	want := map[string]string{annotationFluxSSA: fluxSSAMerge}
+	if !reflect.DeepEqual(annotations, want) {
+		t.Errorf("annotations = %v, want %v", annotations, want)
+	}
+}
+
+func Test_patchJavaToolEnv_referenced(t *testing.T) {
+	r := &LightrunJavaAgentReconciler{}
+	container := &corev1.Container{Name: "app", Env: []corev1.EnvVar{
+		{Name: "PORT", Value: "8080"},
+		{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g $(LIGHTRUN_AGENT_OPTS)"},
+	}}
+	if err := r.patchJavaToolEnv(map[string]string{}, container, "LIGHTRUN_AGENT_OPTS", testAgentArg); err != nil {
+		t.Fatalf("patchJavaToolEnv() error = %v", err)
+	}
+	want := []corev1.EnvVar{
+		{Name: "PORT", Value: "8080"},
+		{Name: "LIGHTRUN_AGENT_OPTS", Value: testAgentArg},
+		{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g $(LIGHTRUN_AGENT_OPTS)"},
+	}
+	if !reflect.DeepEqual(container.Env, want) {
+		t.Errorf("env = %+v, want %+v", container.Env, want)
+	}
+
+	// Value applied with the new flags is kept as is
+	annotations := map[string]string{annotationPatchedEnvName: "LIGHTRUN_AGENT_OPTS", annotationPatchedEnvValue: testAgentArg}
+	container.Env[1].Value = testAgentArg + "=flags"
+	if err := r.patchJavaToolEnv(annotations, container, "LIGHTRUN_AGENT_OPTS", testAgentArg+"=flags"); err != nil {
+		t.Fatalf("patchJavaToolEnv() error = %v", err)
+	}
+	if got := container.Env[1].Value; got != testAgentArg+"=flags" {
+		t.Errorf("env value after flags change = %v", got)
+	}
+
+	// Env var declared without a value gets only the agent argument
+	container.Env[1].Value = ""
+	if err := r.patchJavaToolEnv(annotations, container, "LIGHTRUN_AGENT_OPTS", testAgentArg); err != nil {
+		t.Fatalf("patchJavaToolEnv() error = %v", err)
+	}
+	if got := container.Env[1].Value; got != testAgentArg {
+		t.Errorf("env value of the declared env var = %q", got)
+	}
+}
@@ -3,74 +3,145 @@ package controller
 import (
 	"context"
 	"errors"
+	"fmt"
 	"hash/fnv"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
 	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
-	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/pointer"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 const (
+	// Values of the workloadStatus field, see workloadStatusFromConditions
 	reconcileTypeReady          = "Ready"
 	reconcileTypeProgressing    = "ReconcileProgressing"
 	reconcileTypeNotProgressing = "ReconcileFailed"
+	reconcileTypeDryRun         = "DryRun"
+	reconcileTypeExpired        = "Expired"
+	reconcileTypeSuspended      = "Suspended"
+	// Values of the per workload status
+	workloadStatusPatched = "Patched"
+	workloadStatusFailed  = "Failed"
+	workloadStatusDryRun  = "DryRun"
+	workloadStatusDrifted = "Drifted"
+	workloadStatusSkipped = "Skipped"
 )
 
-func (r *LightrunJavaAgentReconciler) mapDeploymentToAgent(ctx context.Context, obj client.Object) []reconcile.Request {
-	deployment := obj.(*appsv1.Deployment)
-	var agents agentv1beta.LightrunJavaAgentList
-	if err := r.List(ctx, &agents,
-		client.InNamespace(deployment.Namespace),
-		client.MatchingFields{
-			workloadNameIndexField: deployment.Name,
-		},
-	); err != nil {
-		r.Log.Error(err, "failed to list by workloadNameIndexField")
-		return nil
+// mapWorkloadToAgent returns a map function that finds LightrunJavaAgents targeting the changed workload of the given kind.
+// Agents using workloadSelector are enqueued if the workload matches the selector or was patched by them, so they can unpatch it
+func (r *LightrunJavaAgentReconciler) mapWorkloadToAgent(kind agentv1beta.WorkloadType) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		var agents, selectorAgents agentv1beta.LightrunJavaAgentList
+
+		if err := r.List(ctx, &agents,
+			client.InNamespace(obj.GetNamespace()),
+			client.MatchingFields{workloadIndexField: workloadIndexValue(kind, obj.GetName())},
+		); err != nil {
+			r.Log.Error(err, "could not list LightrunJavaAgentList. "+
+				"change to "+string(kind)+" will not be reconciled.",
+				obj.GetName(), obj.GetNamespace())
+			return nil
+		}
+		if err := r.List(ctx, &selectorAgents,
+			client.InNamespace(obj.GetNamespace()),
+			client.MatchingFields{selectorIndexField: "true"},
+		); err != nil {
+			r.Log.Error(err, "could not list LightrunJavaAgentList. "+
+				"change to "+string(kind)+" will not be reconciled.",
+				obj.GetName(), obj.GetNamespace())
+			return nil
+		}
+		agents.Items = append(agents.Items, selectorAgents.Items...)
+
+		requests := []reconcile.Request{}
+		for _, agent := range agents.Items {
+			if !agentTargetsWorkload(&agent, kind, obj) {
+				continue
+			}
+			requests = append(requests, reconcile.Request{
+				NamespacedName: client.ObjectKeyFromObject(&agent),
+			})
+		}
+		// Canary Deployment is reconciled by the LightrunJavaAgent that created it
+		if agentName := obj.GetLabels()[labelCanary]; agentName != "" && kind == agentv1beta.WorkloadTypeDeployment {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: client.ObjectKey{Namespace: obj.GetNamespace(), Name: agentName},
+			})
+		}
+		return requests
 	}
+}
+
+// workloadIndexValue returns the value of the workload index of the LightrunJavaAgents targeting the workload
+func workloadIndexValue(kind agentv1beta.WorkloadType, name string) string {
+	return string(kind) + "/" + name
+}
 
-	requests := make([]reconcile.Request, len(agents.Items))
-	for i, a := range agents.Items {
-		requests[i] = reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&a)}
+// indexAgentWorkload indexes the LightrunJavaAgent by the type and name of its workload
+func indexAgentWorkload(object client.Object) []string {
+	agent := object.(*agentv1beta.LightrunJavaAgent)
+	if agent.Spec.WorkloadName == "" || agent.Spec.WorkloadSelector != nil {
+		return nil
 	}
-	return requests
+	return []string{workloadIndexValue(agent.Spec.WorkloadType, agent.Spec.WorkloadName)}
 }
 
-func (r *LightrunJavaAgentReconciler) mapStatefulSetToAgent(ctx context.Context, obj client.Object) []reconcile.Request {
-	statefulSet := obj.(*appsv1.StatefulSet)
+// indexAgentSelector indexes the LightrunJavaAgents using workloadSelector
+func indexAgentSelector(object client.Object) []string {
+	if object.(*agentv1beta.LightrunJavaAgent).Spec.WorkloadSelector == nil {
+		return nil
+	}
+	return []string{"true"}
+}
 
-	var agents agentv1beta.LightrunJavaAgentList
+// agentTargetsWorkload reports whether the change of the workload has to be reconciled by the LightrunJavaAgent
+func agentTargetsWorkload(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, kind agentv1beta.WorkloadType, workload client.Object) bool {
+	if lightrunJavaAgent.Spec.WorkloadSelector == nil {
+		return lightrunJavaAgent.Spec.WorkloadType == kind && lightrunJavaAgent.Spec.WorkloadName == workload.GetName()
+	}
+	if !slices.Contains(selectorWorkloadKinds(lightrunJavaAgent), kind) {
+		return false
+	}
+	if workload.GetAnnotations()[annotationAgentName] == lightrunJavaAgent.Name {
+		return true
+	}
+	selector, err := metav1.LabelSelectorAsSelector(lightrunJavaAgent.Spec.WorkloadSelector)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(workload.GetLabels()))
+}
 
-	if err := r.List(ctx, &agents,
-		client.InNamespace(statefulSet.Namespace),
-		client.MatchingFields{workloadNameIndexField: statefulSet.Name},
-	); err != nil {
-		r.Log.Error(err, "could not list LightrunJavaAgentList. "+
-			"change to statefulset will not be reconciled.",
-			statefulSet.Name, statefulSet.Namespace)
+func (r *LightrunJavaAgentReconciler) mapSecretToAgent(ctx context.Context, obj client.Object) []reconcile.Request {
+	secret := obj.(*corev1.Secret)
+	lightrunJavaAgents, err := r.secretAgents(ctx, secret)
+	if err != nil {
 		return nil
 	}
 
-	requests := make([]reconcile.Request, len(agents.Items))
+	requests := make([]reconcile.Request, len(lightrunJavaAgents))
 
-	for i, agent := range agents.Items {
+	for i, lightrunJavaAgent := range lightrunJavaAgents {
 		requests[i] = reconcile.Request{
-			NamespacedName: client.ObjectKeyFromObject(&agent),
+			NamespacedName: client.ObjectKeyFromObject(&lightrunJavaAgent),
 		}
 	}
 	return requests
 }
 
-func (r *LightrunJavaAgentReconciler) mapSecretToAgent(ctx context.Context, obj client.Object) []reconcile.Request {
-	secret := obj.(*corev1.Secret)
-
+// secretAgents returns the LightrunJavaAgents using the Secret
+func (r *LightrunJavaAgentReconciler) secretAgents(ctx context.Context, secret *corev1.Secret) ([]agentv1beta.LightrunJavaAgent, error) {
 	var lightrunJavaAgentList agentv1beta.LightrunJavaAgentList
 
 	if err := r.List(ctx, &lightrunJavaAgentList,
@@ -80,73 +151,115 @@ func (r *LightrunJavaAgentReconciler) mapSecretToAgent(ctx context.Context, obj
 		r.Log.Error(err, "could not list LightrunJavaAgentList. "+
 			"change to secret will not be reconciled.",
 			secret.Name, secret.Namespace)
-		return nil
+		return nil, err
 	}
-
-	requests := make([]reconcile.Request, len(lightrunJavaAgentList.Items))
-
-	for i, lightrunJavaAgent := range lightrunJavaAgentList.Items {
-		requests[i] = reconcile.Request{
-			NamespacedName: client.ObjectKeyFromObject(&lightrunJavaAgent),
-		}
-	}
-	return requests
+	return lightrunJavaAgentList.Items, nil
 }
 
 func (r *LightrunJavaAgentReconciler) addFinalizer(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, finalizerName string) error {
 	patch := client.MergeFrom(lightrunJavaAgent.DeepCopy())
 	lightrunJavaAgent.ObjectMeta.Finalizers = append(lightrunJavaAgent.ObjectMeta.Finalizers, finalizerName)
+	// Patch response has the stored status, status set during the reconciliation is kept for the status update
+	status := lightrunJavaAgent.Status.DeepCopy()
 	err := r.Patch(ctx, lightrunJavaAgent, patch)
+	lightrunJavaAgent.Status = *status
 	return err
 }
 
 func (r *LightrunJavaAgentReconciler) removeFinalizer(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, finalizerName string) error {
 	patch := client.MergeFrom(lightrunJavaAgent.DeepCopy())
 	lightrunJavaAgent.ObjectMeta.Finalizers = removeString(lightrunJavaAgent.ObjectMeta.Finalizers, finalizerName)
+	// Patch response has the stored status, status set during the reconciliation is kept for the status update
+	status := lightrunJavaAgent.Status.DeepCopy()
 	err := r.Patch(ctx, lightrunJavaAgent, patch)
+	lightrunJavaAgent.Status = *status
 	return err
 }
 
-func (r *LightrunJavaAgentReconciler) successStatus(ctx context.Context, instance *agentv1beta.LightrunJavaAgent, reconcileType string) (reconcile.Result, error) {
-	condition := metav1.Condition{
-		Type:               reconcileType,
-		LastTransitionTime: metav1.Now(),
-		ObservedGeneration: instance.GetGeneration(),
-		Reason:             "reconcileSucceeded",
-		Status:             metav1.ConditionTrue,
+// successStatus records the successful reconciliation. Progressing stays true until the pods of all the
+// patched workloads are updated and ready
+func (r *LightrunJavaAgentReconciler) successStatus(ctx context.Context, instance *agentv1beta.LightrunJavaAgent) (reconcile.Result, error) {
+	progressing, progressingReason := metav1.ConditionFalse, reasonRolloutComplete
+	for _, workload := range instance.Status.Workloads {
+		if workload.Status == workloadStatusDrifted {
+			progressing, progressingReason = metav1.ConditionTrue, reasonDriftBackoff
+			break
+		}
+		if workload.Replicas != nil && (*workload.UpdatedReplicas < *workload.Replicas || *workload.ReadyReplicas < *workload.Replicas) {
+			progressing, progressingReason = metav1.ConditionTrue, reasonRolloutInProgress
+			break
+		}
 	}
-	SetStatusCondition(&instance.Status.Conditions, condition)
-	instance.Status.WorkloadStatus = r.findLastConditionType(&instance.Status.Conditions)
-	err := r.Status().Update(ctx, instance)
-	if err != nil {
-		if apierrors.IsConflict(err) {
-			r.Log.V(2).Info("unable to update status for", "object version", instance.GetResourceVersion(), "resource version expired, will trigger another reconcile cycle", "")
-			return reconcile.Result{Requeue: true}, nil
-		} else {
-			r.Log.Error(err, "unable to update status for", "object", instance)
+	setReconcileConditions(&instance.Status.Conditions, instance.GetGeneration(), metav1.ConditionTrue, progressing, metav1.ConditionFalse, reasonReconcileSucceeded, progressingReason, "")
+
+	// Pending config changes are rolled out by the reconciliation in the next maintenance window
+	instance.Status.NextRolloutTime = nil
+	pending := slices.ContainsFunc(instance.Status.Workloads, func(w agentv1beta.WorkloadReconcileStatus) bool { return w.PendingConfigMapHash != "" })
+	if pending && instance.Spec.RolloutPolicy == agentv1beta.RolloutPolicyMaintenanceWindow {
+		if _, next, err := maintenanceWindowActive(instance.Spec.MaintenanceWindow, time.Now()); err == nil && !next.IsZero() {
+			instance.Status.NextRolloutTime = &metav1.Time{Time: next}
 		}
-		return reconcile.Result{}, err
 	}
+	result, err := r.updateStatus(ctx, instance, nil)
+	if err == nil && !result.Requeue && instance.Status.NextRolloutTime != nil {
+		result.RequeueAfter = time.Until(instance.Status.NextRolloutTime.Time)
+	}
+	if err == nil {
+		result = requeueWithin(result, nextDriftRequeue(instance, time.Now()))
+	}
+	return result, err
+}
 
-	return reconcile.Result{}, nil
+// progressingStatus records the reconciliation that is waiting for the CR deletion or the workload creation
+func (r *LightrunJavaAgentReconciler) progressingStatus(ctx context.Context, instance *agentv1beta.LightrunJavaAgent, reason string) (reconcile.Result, error) {
+	instance.Status.NextRolloutTime = nil
+	setReconcileConditions(&instance.Status.Conditions, instance.GetGeneration(), metav1.ConditionFalse, metav1.ConditionTrue, metav1.ConditionFalse, reason, reason, "")
+	return r.updateStatus(ctx, instance, nil)
 }
 
+// dryRunStatus records the successful dry run. Workloads are not patched, so the agent is not ready
+func (r *LightrunJavaAgentReconciler) dryRunStatus(ctx context.Context, instance *agentv1beta.LightrunJavaAgent) (reconcile.Result, error) {
+	setReconcileConditions(&instance.Status.Conditions, instance.GetGeneration(), metav1.ConditionFalse, metav1.ConditionFalse, metav1.ConditionFalse, reasonDryRun, reasonDryRun,
+		"dry run, workloads are not patched. Changes are reported in status.workloads")
+	instance.Status.NextRolloutTime = nil
+	return r.updateStatus(ctx, instance, nil)
+}
+
+// expiredStatus records the removal of the agent from the workloads after the expiration
+func (r *LightrunJavaAgentReconciler) expiredStatus(ctx context.Context, instance *agentv1beta.LightrunJavaAgent) (reconcile.Result, error) {
+	setReconcileConditions(&instance.Status.Conditions, instance.GetGeneration(), metav1.ConditionFalse, metav1.ConditionFalse, metav1.ConditionFalse, reasonExpired, reasonExpired,
+		"agent expired, workloads are returned to the original state. Set later expiresAt or longer ttl to inject it again")
+	instance.Status.Workloads = nil
+	instance.Status.NextRolloutTime = nil
+	return r.updateStatus(ctx, instance, nil)
+}
+
+// suspendedStatus records the removal of the agent from the workloads by spec.suspend
+func (r *LightrunJavaAgentReconciler) suspendedStatus(ctx context.Context, instance *agentv1beta.LightrunJavaAgent) (reconcile.Result, error) {
+	setReconcileConditions(&instance.Status.Conditions, instance.GetGeneration(), metav1.ConditionFalse, metav1.ConditionFalse, metav1.ConditionFalse, reasonSuspended, reasonSuspended,
+		"agent is suspended, workloads are returned to the original state")
+	instance.Status.Workloads = nil
+	instance.Status.NextRolloutTime = nil
+	return r.updateStatus(ctx, instance, nil)
+}
+
+// errorStatus records the failed reconciliation with the reason of the error, see withReason
 func (r *LightrunJavaAgentReconciler) errorStatus(ctx context.Context, instance *agentv1beta.LightrunJavaAgent, origError error) (reconcile.Result, error) {
+	reason := errorReason(origError)
+	setReconcileConditions(&instance.Status.Conditions, instance.GetGeneration(), metav1.ConditionFalse, metav1.ConditionFalse, metav1.ConditionTrue, reason, reason, origError.Error())
+	r.Recorder.Event(instance, corev1.EventTypeWarning, reason, origError.Error())
+	return r.updateStatus(ctx, instance, origError)
+}
 
-	condition := metav1.Condition{
-		Type:               reconcileTypeNotProgressing,
-		LastTransitionTime: metav1.Now(),
-		Message:            origError.Error(),
-		ObservedGeneration: instance.GetGeneration(),
-		Reason:             "reconcileFailed",
-		Status:             metav1.ConditionTrue,
-	}
-	SetStatusCondition(&instance.Status.Conditions, condition)
-	instance.Status.WorkloadStatus = r.findLastConditionType(&instance.Status.Conditions)
+func (r *LightrunJavaAgentReconciler) updateStatus(ctx context.Context, instance *agentv1beta.LightrunJavaAgent, origError error) (reconcile.Result, error) {
+	instance.Status.WorkloadStatus = workloadStatusFromConditions(instance.Status.Conditions)
+	instance.Status.ObservedGeneration = instance.GetGeneration()
+	instance.Status.ExpiresAt = agentExpiresAt(instance)
+	setDriftCondition(instance)
 	err := r.Status().Update(ctx, instance)
 	if err != nil {
 		if apierrors.IsConflict(err) {
-			r.Log.Info("unable to update status for", "object version", instance.GetResourceVersion(), "resource version expired, will trigger another reconcile cycle", "")
+			r.Log.V(2).Info("unable to update status for", "object version", instance.GetResourceVersion(), "resource version expired, will trigger another reconcile cycle", "")
 			return reconcile.Result{Requeue: true}, nil
 		} else {
 			r.Log.Error(err, "unable to update status for", "object", instance)
@@ -157,21 +270,69 @@ func (r *LightrunJavaAgentReconciler) errorStatus(ctx context.Context, instance
 	return reconcile.Result{}, origError
 }
 
-func (r *LightrunJavaAgentReconciler) findLastConditionType(conditions *[]metav1.Condition) string {
-	index := -1
-	var ts metav1.Time
-	for i, cond := range *conditions {
-		if index == -1 {
-			index = i
-			ts = cond.LastTransitionTime
-			continue
+// workloadStatus returns the status of the workload patched by the LightrunJavaAgent
+func (r *LightrunJavaAgentReconciler) workloadStatus(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, adapter workloadAdapter, workload client.Object, cmDataHash uint64) agentv1beta.WorkloadReconcileStatus {
+	status := agentv1beta.WorkloadReconcileStatus{
+		Kind:          adapter.kind(),
+		Name:          workload.GetName(),
+		UID:           workload.GetUID(),
+		Status:        workloadStatusPatched,
+		PatchedEnvVar: agentEnvVarName(lightrunJavaAgent),
+	}
+	template, err := adapter.podTemplate(workload)
+	// Sidecar syncs the config into the running pods, so the hash is not set in the pod template
+	if !lightrunJavaAgent.Spec.InitContainer.Sidecar {
+		status.ConfigMapHash = fmt.Sprint(cmDataHash)
+		if err == nil {
+			// Hash is resolved the same way by the patch, errors are reported there
+			if templateHash, err := rolloutConfigHash(lightrunJavaAgent, template, cmDataHash, time.Now()); err == nil && templateHash != cmDataHash {
+				status.ConfigMapHash = fmt.Sprint(templateHash)
+				status.PendingConfigMapHash = fmt.Sprint(cmDataHash)
+			}
 		}
-		if ts.Before(&cond.LastTransitionTime) {
-			ts = cond.LastTransitionTime
-			index = i
+	}
+	if err == nil {
+		for _, container := range template.Spec.Containers {
+			if containsString(lightrunJavaAgent.Spec.ContainerSelector, container.Name) {
+				status.Containers = append(status.Containers, container.Name)
+			}
 		}
+		// Image is resolved the same way by the patch, errors are reported there
+		status.AgentImage, _ = r.agentImage(lightrunJavaAgent, template)
+	}
+	adapter.setRolloutProgress(workload, &status)
+	if lightrunJavaAgent.Spec.Canary != nil {
+		status.CanaryReplicas = pointer.Int32(min(lightrunJavaAgent.Spec.Canary.Replicas, pointer.Int32Deref(status.Replicas, 0)))
 	}
-	return (*conditions)[index].Type
+	return status
+}
+
+// dryRunWorkloadStatus returns the status of the workload that would be patched by the LightrunJavaAgent with the preview of the changes
+func (r *LightrunJavaAgentReconciler) dryRunWorkloadStatus(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, adapter workloadAdapter, workload client.Object, cmDataHash uint64, preview *agentv1beta.WorkloadPatchPreview) agentv1beta.WorkloadReconcileStatus {
+	status := r.workloadStatus(lightrunJavaAgent, adapter, workload, cmDataHash)
+	status.Status = workloadStatusDryRun
+	status.Preview = preview
+	return status
+}
+
+// isJobRecreatable reports whether the Job was created suspended after the LightrunJavaAgent
+// and didn't start any pods yet, so it can be safely recreated with the agent injected
+func isJobRecreatable(job *batchv1.Job, lightrunJavaAgent *agentv1beta.LightrunJavaAgent) bool {
+	if job.CreationTimestamp.Before(&lightrunJavaAgent.CreationTimestamp) {
+		return false
+	}
+	if job.Spec.Suspend == nil || !*job.Spec.Suspend {
+		return false
+	}
+	return job.Status.StartTime == nil && job.Status.Active == 0 && job.Status.Succeeded == 0 && job.Status.Failed == 0
+}
+
+// selectorWorkloadKinds returns the workload kinds matched by workloadSelector
+func selectorWorkloadKinds(lightrunJavaAgent *agentv1beta.LightrunJavaAgent) []agentv1beta.WorkloadType {
+	if len(lightrunJavaAgent.Spec.WorkloadKinds) == 0 {
+		return []agentv1beta.WorkloadType{agentv1beta.WorkloadTypeDeployment, agentv1beta.WorkloadTypeStatefulSet}
+	}
+	return lightrunJavaAgent.Spec.WorkloadKinds
 }
 
 func containsString(slice []string, s string) bool {
@@ -223,37 +384,12 @@ func hash(s string) uint64 {
 	return h.Sum64()
 }
 
-func SetStatusCondition(conditions *[]metav1.Condition, newCondition metav1.Condition) {
-	if conditions == nil {
-		return
-	}
-	existingCondition := meta.FindStatusCondition(*conditions, newCondition.Type)
-	if existingCondition == nil {
-		if newCondition.LastTransitionTime.IsZero() {
-			newCondition.LastTransitionTime = metav1.NewTime(time.Now())
-		}
-		*conditions = append(*conditions, newCondition)
-		return
-	}
-
-	existingCondition.Status = newCondition.Status
-	if !newCondition.LastTransitionTime.IsZero() {
-		existingCondition.LastTransitionTime = newCondition.LastTransitionTime
-	} else {
-		existingCondition.LastTransitionTime = metav1.NewTime(time.Now())
-	}
-
-	existingCondition.Reason = newCondition.Reason
-	existingCondition.Message = newCondition.Message
-	existingCondition.ObservedGeneration = newCondition.ObservedGeneration
-}
-
 func agentEnvVarArgument(mountPath string, agentCliFlags string) (string, error) {
 	agentArg := "-agentpath:" + mountPath + "/agent/lightrun_agent.so"
 	if agentCliFlags != "" {
 		agentArg += "=" + agentCliFlags
 		if len(agentArg) > 1024 {
-			return "", errors.New("agentpath with agentCliFlags has more than 1024 chars. This is a limitation of Java")
+			return "", withReason(reasonEnvTooLong, errors.New("agentpath with agentCliFlags has more than 1024 chars. This is a limitation of Java"))
 		}
 	}
 	return agentArg, nil
@@ -268,3 +404,20 @@ func findEnvVarIndex(envVarName string, envVarList []corev1.EnvVar) int {
 	}
 	return -1
 }
+
+// mirrorImage replaces the registry of the image reference with the mirror.
+// Mirror may contain a path, e.g. "registry.local/dockerhub" for "registry.local/dockerhub/lightruncom/image:tag".
+// Docker Hub official images get the "library/" path, as registries proxying Docker Hub expect it
+func mirrorImage(image string, mirror string) string {
+	mirror = strings.TrimSuffix(mirror, "/")
+	if mirror == "" || image == "" {
+		return image
+	}
+	repository := image
+	if registry, rest, found := strings.Cut(image, "/"); found && (strings.ContainsAny(registry, ".:") || registry == "localhost") {
+		repository = rest
+	} else if !found {
+		repository = "library/" + image
+	}
+	return mirror + "/" + repository
+}
@@ -1,10 +1,23 @@
 package controller
 
 import (
+	"context"
 	"strings"
 	"testing"
+	"time"
 
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 )
 
 func Test_findEnvVarIndex(t *testing.T) {
@@ -105,3 +118,121 @@ func Test_agentEnvVarArgument(t *testing.T) {
 		})
 	}
 }
+
+func Test_mirrorImage(t *testing.T) {
+	tests := []struct {
+		image  string
+		mirror string
+		want   string
+	}{
+		{image: "lightruncom/agent:1.7.0", mirror: "", want: "lightruncom/agent:1.7.0"},
+		{image: "lightruncom/agent:1.7.0", mirror: "registry.local", want: "registry.local/lightruncom/agent:1.7.0"},
+		{image: "lightruncom/agent:1.7.0", mirror: "registry.local/dockerhub/", want: "registry.local/dockerhub/lightruncom/agent:1.7.0"},
+		{image: "busybox", mirror: "registry.local", want: "registry.local/library/busybox"},
+		{image: "docker.io/lightruncom/agent:1.7.0", mirror: "registry.local", want: "registry.local/lightruncom/agent:1.7.0"},
+		{image: "localhost:5000/agent@sha256:abc", mirror: "registry.local", want: "registry.local/agent@sha256:abc"},
+		{image: "localhost/agent", mirror: "registry.local", want: "registry.local/agent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image+" "+tt.mirror, func(t *testing.T) {
+			if got := mirrorImage(tt.image, tt.mirror); got != tt.want {
+				t.Errorf("mirrorImage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_reconcileJob_notRecreatable(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeJob)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "workload", Namespace: "default", UID: "job-uid"},
+		Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "busybox"}},
+		}}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(lightrunJavaAgent, job).WithStatusSubresource(lightrunJavaAgent).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &LightrunJavaAgentReconciler{Client: c, Scheme: scheme, Log: zap.New(), Recorder: recorder}
+	ctx := context.Background()
+
+	// Job that isn't suspended can't be recreated, it is reported instead of being left alone silently
+	if _, err := r.reconcileJob(ctx, lightrunJavaAgent, "default"); errorReason(err) != reasonJobImmutable {
+		t.Fatalf("reconcileJob() error = %v, want reason %s", err, reasonJobImmutable)
+	}
+	agent := &agentv1beta.LightrunJavaAgent{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(lightrunJavaAgent), agent); err != nil {
+		t.Fatal(err)
+	}
+	if ready := meta.FindStatusCondition(agent.Status.Conditions, conditionReady); ready == nil || ready.Reason != reasonJobImmutable {
+		t.Errorf("Ready condition = %+v, want reason %s", ready, reasonJobImmutable)
+	}
+	if len(agent.Status.Workloads) != 1 || agent.Status.Workloads[0].Status != workloadStatusSkipped || agent.Status.Workloads[0].UID != "job-uid" {
+		t.Errorf("status workloads = %+v, want the skipped Job", agent.Status.Workloads)
+	}
+	if len(recorder.Events) != 2 {
+		t.Errorf("recorded %d events, want JobImmutable on the CR and the Job", len(recorder.Events))
+	}
+}
+
+func Test_isJobRecreatable(t *testing.T) {
+	agentCreated := metav1.NewTime(time.Now())
+	lightrunJavaAgent := &agentv1beta.LightrunJavaAgent{
+		ObjectMeta: metav1.ObjectMeta{CreationTimestamp: agentCreated},
+	}
+	later := metav1.NewTime(agentCreated.Add(time.Minute))
+	earlier := metav1.NewTime(agentCreated.Add(-time.Minute))
+	startTime := metav1.NewTime(later.Add(time.Second))
+
+	tests := []struct {
+		name string
+		job  batchv1.Job
+		want bool
+	}{
+		{
+			name: "suspended job created after the agent",
+			job: batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{CreationTimestamp: later},
+				Spec:       batchv1.JobSpec{Suspend: pointer.Bool(true)},
+			},
+			want: true,
+		},
+		{
+			name: "job created before the agent",
+			job: batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{CreationTimestamp: earlier},
+				Spec:       batchv1.JobSpec{Suspend: pointer.Bool(true)},
+			},
+			want: false,
+		},
+		{
+			name: "job that is not suspended",
+			job: batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{CreationTimestamp: later},
+			},
+			want: false,
+		},
+		{
+			name: "suspended job that already started",
+			job: batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{CreationTimestamp: later},
+				Spec:       batchv1.JobSpec{Suspend: pointer.Bool(true)},
+				Status:     batchv1.JobStatus{StartTime: &startTime, Succeeded: 1},
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isJobRecreatable(&tt.job, lightrunJavaAgent); got != tt.want {
+				t.Errorf("isJobRecreatable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -20,16 +20,27 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
-	appsv1ac "k8s.io/client-go/applyconfigurations/apps/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
 
 	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 
 	"github.com/go-logr/logr"
@@ -37,186 +48,543 @@ import (
 )
 
 const (
-	workloadNameIndexField = "spec.workloadName"
-	secretNameIndexField   = "spec.secret"
-	finalizerName          = "agent.finalizers.lightrun.com"
+	workloadIndexField   = "spec.workload"
+	selectorIndexField   = "spec.workloadSelector"
+	secretNameIndexField = "spec.secret"
+	finalizerName        = "agent.finalizers.lightrun.com"
+	jobRecreateTimeout   = 30 * time.Second
+	fieldManager         = "lightrun-controller"
+	// legacyFieldManager was used for Deployments by older versions of the operator
+	legacyFieldManager = "lightrun-conrtoller"
 )
 
-var err error
-var secret *corev1.Secret
+// Availability of image volumes in the cluster, detected on the first workload patched in ImageVolume mode
+const (
+	imageVolumesUnknown int32 = iota
+	imageVolumesSupported
+	imageVolumesUnsupported
+)
+
+// imageVolumesCheckInterval is the time after which the availability of image volumes is detected again,
+// so the upgrade of the cluster or its feature gates is noticed without restarting the operator
+const imageVolumesCheckInterval = time.Hour
+
+// rolloutGVK is the Argo Rollout kind. Rollouts are handled as unstructured objects, so Argo types are not vendored
+var rolloutGVK = schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"}
 
 // LightrunJavaAgentReconciler reconciles a LightrunJavaAgent object
 type LightrunJavaAgentReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
 	Log    logr.Logger
+	// Pull secrets added to the pods of every patched workload in addition to the ones of the LightrunJavaAgent
+	DefaultImagePullSecrets []string
+	// Registry that replaces the registry of the agent image, e.g. the internal mirror of the air-gapped cluster
+	ImageRegistryMirror string
+	// ConfigMap with the images of the agent versions, agentVersion can't be used if it is not set
+	AgentCatalog client.ObjectKey
+	// Uncached reader of the objects outside of the watched namespaces, e.g. the agent catalog
+	APIReader client.Reader
+	// Recorder of the events on the LightrunJavaAgents and the patched workloads. Recorder of the manager is used if it is not set
+	Recorder record.EventRecorder
+
+	imageVolumes atomic.Int32
+	// Unix time in nanoseconds when imageVolumes was detected
+	imageVolumesCheckedAt atomic.Int64
 }
 
 //+kubebuilder:rbac:groups=agents.lightrun.com,resources=lightrunjavaagents,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=agents.lightrun.com,resources=lightrunjavaagents/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=agents.lightrun.com,resources=lightrunjavaagents/finalizers,verbs=update
 //+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;watch;list;patch
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;watch;list;patch;create;update;delete
 //+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;watch;list;patch
+//+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;watch;list;patch
+//+kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;watch;list;patch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;watch;list;create;delete;patch
+//+kubebuilder:rbac:groups=argoproj.io,resources=rollouts,verbs=get;watch;list;patch
 //+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;watch;list
 
 func (r *LightrunJavaAgentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	log := r.Log.WithValues("lightrunJavaAgent", req.NamespacedName)
 	lightrunJavaAgent := &agentv1beta.LightrunJavaAgent{}
-	if err = r.Get(ctx, req.NamespacedName, lightrunJavaAgent); err != nil {
+	if err := r.Get(ctx, req.NamespacedName, lightrunJavaAgent); err != nil {
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
+	result, err := r.reconcileAgent(ctx, lightrunJavaAgent, req.Namespace)
+	return requeueBeforeExpiry(lightrunJavaAgent, result), err
+}
+
+// reconcileAgent dispatches the reconciliation by the injection mode and the target of the LightrunJavaAgent
+func (r *LightrunJavaAgentReconciler) reconcileAgent(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, namespace string) (ctrl.Result, error) {
+	log := r.Log.WithValues("lightrunJavaAgent", client.ObjectKeyFromObject(lightrunJavaAgent))
 
 	// Determine which workload type to reconcile
 	workloadType, err := r.determineWorkloadType(lightrunJavaAgent)
 	if err != nil {
 		log.Error(err, "failed to determine workload type")
-		return r.errorStatus(ctx, lightrunJavaAgent, err)
+		return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonInvalidSpec, err))
+	}
+	if lightrunJavaAgent.ObjectMeta.DeletionTimestamp.IsZero() {
+		if err = validateCanary(&lightrunJavaAgent.Spec); err != nil {
+			return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonInvalidSpec, errors.New("invalid configuration: "+err.Error())))
+		}
+		if err = validateExpiry(&lightrunJavaAgent.Spec); err != nil {
+			return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonInvalidSpec, errors.New("invalid configuration: "+err.Error())))
+		}
+		if lightrunJavaAgent.Spec.Suspend {
+			return r.reconcileSuspended(ctx, lightrunJavaAgent, namespace)
+		}
+		if meta.IsStatusConditionTrue(lightrunJavaAgent.Status.Conditions, conditionSuspended) {
+			setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionSuspended, metav1.ConditionFalse, reasonResumed, "")
+		}
+		if agentExpired(lightrunJavaAgent, time.Now()) {
+			return r.reconcileExpired(ctx, lightrunJavaAgent, namespace)
+		}
+	}
+	if lightrunJavaAgent.Spec.InjectionMode == agentv1beta.InjectionModeWebhook {
+		if lightrunJavaAgent.Spec.DryRun {
+			return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonInvalidSpec, errors.New("invalid configuration: dryRun can't be used with Webhook injection mode")))
+		}
+		if lightrunJavaAgent.Spec.GitOpsCompatibility != nil {
+			return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonInvalidSpec, errors.New("invalid configuration: gitOpsCompatibility can't be used with Webhook injection mode")))
+		}
+		if lightrunJavaAgent.Spec.InitContainer.InjectionMode == agentv1beta.AgentInstallModeImageVolume {
+			return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonInvalidSpec, errors.New("invalid configuration: ImageVolume can't be used with Webhook injection mode")))
+		}
+		return r.reconcileWebhookMode(ctx, lightrunJavaAgent, namespace)
+	}
+	if lightrunJavaAgent.Spec.WorkloadSelector != nil {
+		return r.reconcileSelector(ctx, lightrunJavaAgent, namespace)
 	}
-	switch workloadType {
-	case agentv1beta.WorkloadTypeDeployment:
-		return r.reconcileDeployment(ctx, lightrunJavaAgent, req.Namespace)
-	case agentv1beta.WorkloadTypeStatefulSet:
-		return r.reconcileStatefulSet(ctx, lightrunJavaAgent, req.Namespace)
-	default:
-		return r.errorStatus(ctx, lightrunJavaAgent, fmt.Errorf("unsupported workload type: %s", workloadType))
+	if workloadType == agentv1beta.WorkloadTypeJob {
+		return r.reconcileJob(ctx, lightrunJavaAgent, namespace)
 	}
+	adapter, err := newWorkloadAdapter(workloadType, lightrunJavaAgent)
+	if err != nil {
+		return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonInvalidSpec, err))
+	}
+	return r.reconcileWorkload(ctx, lightrunJavaAgent, namespace, adapter)
 }
 
 func (r *LightrunJavaAgentReconciler) determineWorkloadType(lightrunJavaAgent *agentv1beta.LightrunJavaAgent) (agentv1beta.WorkloadType, error) {
 	// Get the spec from the LightrunJavaAgent resource
 	spec := lightrunJavaAgent.Spec
+	if spec.WorkloadSelector != nil {
+		if spec.WorkloadName != "" {
+			return "", errors.New("invalid configuration: workloadName and workloadSelector can't be used together")
+		}
+		return "", nil
+	}
 	if spec.WorkloadName == "" || spec.WorkloadType == "" {
-		return "", errors.New("invalid configuration: workloadName and workloadType must be set")
+		return "", errors.New("invalid configuration: workloadName and workloadType or workloadSelector must be set")
 	}
 	return spec.WorkloadType, nil
 }
 
-// reconcileDeployment handles the reconciliation logic for Deployment workloads
-func (r *LightrunJavaAgentReconciler) reconcileDeployment(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, namespace string) (ctrl.Result, error) {
-	deploymentName := lightrunJavaAgent.Spec.WorkloadName
-	if deploymentName == "" {
-		return r.errorStatus(ctx, lightrunJavaAgent, errors.New("unable to reconcile deployment: missing workloadName"))
-	}
-	log := r.Log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name, "deployment", deploymentName)
-	fieldManager := "lightrun-conrtoller"
+// reconcileWorkload handles the reconciliation logic for all the workload kinds that can be patched in place.
+// Kind specific logic is provided by the workloadAdapter
+func (r *LightrunJavaAgentReconciler) reconcileWorkload(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, namespace string, adapter workloadAdapter) (ctrl.Result, error) {
+	kind := string(adapter.kind())
+	workloadName := lightrunJavaAgent.Spec.WorkloadName
+	log := r.Log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name, "kind", kind, "workload", workloadName)
 
-	deplNamespacedObj := client.ObjectKey{
-		Name:      deploymentName,
+	workloadNamespacedObj := client.ObjectKey{
+		Name:      workloadName,
 		Namespace: namespace,
 	}
-	originalDeployment := &appsv1.Deployment{}
-	err = r.Get(ctx, deplNamespacedObj, originalDeployment)
+	originalWorkload := adapter.newObject()
+	err := r.Get(ctx, workloadNamespacedObj, originalWorkload)
 	if err != nil {
-		// Deployment not found
+		if meta.IsNoMatchError(err) {
+			log.Error(err, "workload kind is not installed in the cluster")
+			err = errors.New(kind + " kind is not available in the cluster")
+			setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionWorkloadFound, metav1.ConditionFalse, reasonWorkloadKindNotInstalled, err.Error())
+			return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonWorkloadKindNotInstalled, err))
+		}
+		// Workload not found
 		if client.IgnoreNotFound(err) == nil {
-			log.Info("Deployment not found. Verify name/namespace", "Deployment", deploymentName)
+			log.Info("Workload not found. Verify name/namespace")
+			// Canary of the removed Deployment is removed as well
+			if adapter.kind() == agentv1beta.WorkloadTypeDeployment {
+				err = r.deleteCanaryDeployment(ctx, lightrunJavaAgent, namespace)
+				if err != nil {
+					return r.errorStatus(ctx, lightrunJavaAgent, err)
+				}
+			}
 			// remove our finalizer from the list and update it.
 			err = r.removeFinalizer(ctx, lightrunJavaAgent, finalizerName)
 			if err != nil {
 				return r.errorStatus(ctx, lightrunJavaAgent, err)
 			}
-			return r.errorStatus(ctx, lightrunJavaAgent, errors.New("deployment not found: "+deploymentName))
+			err = errors.New(strings.ToLower(kind) + " not found: " + workloadName)
+			setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionWorkloadFound, metav1.ConditionFalse, reasonWorkloadNotFound, err.Error())
+			return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonWorkloadNotFound, err))
 		} else {
-			log.Error(err, "unable to fetch deployment")
+			log.Error(err, "unable to fetch workload")
+			return r.errorStatus(ctx, lightrunJavaAgent, err)
+		}
+	}
+	setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionWorkloadFound, metav1.ConditionTrue, reasonWorkloadFound, "")
+	oldLrjaName, alreadyPatched := originalWorkload.GetAnnotations()[annotationAgentName]
+
+	// Check if this LightrunJavaAgent is being deleted
+	if !lightrunJavaAgent.ObjectMeta.DeletionTimestamp.IsZero() {
+		log.Info("LightrunJavaAgent is being deleted")
+		if !containsString(lightrunJavaAgent.ObjectMeta.Finalizers, finalizerName) {
+			// Nothing to do here
+			return r.progressingStatus(ctx, lightrunJavaAgent, reasonDeleting)
+		}
+		// Workload patched by another LightrunJavaAgent is left as is, dry run doesn't patch the workload
+		if (!alreadyPatched && !lightrunJavaAgent.Spec.DryRun) || oldLrjaName == lightrunJavaAgent.Name {
+			log.Info("Unpatching workload")
+			err = r.unpatchWorkload(ctx, lightrunJavaAgent, adapter, originalWorkload)
+			if err != nil {
+				log.Error(err, "failed to unpatch workload")
+				return r.errorStatus(ctx, lightrunJavaAgent, err)
+			}
+		}
+		if adapter.kind() == agentv1beta.WorkloadTypeDeployment {
+			err = r.deleteCanaryDeployment(ctx, lightrunJavaAgent, namespace)
+			if err != nil {
+				log.Error(err, "failed to remove canary deployment")
+				return r.errorStatus(ctx, lightrunJavaAgent, err)
+			}
+		}
+
+		// remove our finalizer from the list and update it.
+		log.Info("Removing finalizer")
+		err = r.removeFinalizer(ctx, lightrunJavaAgent, finalizerName)
+		if err != nil {
 			return r.errorStatus(ctx, lightrunJavaAgent, err)
 		}
+
+		log.Info("Workload returned to original state")
+		return r.progressingStatus(ctx, lightrunJavaAgent, reasonDeleting)
 	}
 
-	if oldLrjaName, ok := originalDeployment.Annotations[annotationAgentName]; ok && oldLrjaName != lightrunJavaAgent.Name {
-		log.Error(err, "Deployment already patched by LightrunJavaAgent", "Existing LightrunJavaAgent", oldLrjaName)
-		return r.errorStatus(ctx, lightrunJavaAgent, errors.New("deployment already patched: "+deploymentName))
+	// Check if already patched by another LightrunJavaAgent
+	if alreadyPatched && oldLrjaName != lightrunJavaAgent.Name {
+		log.Error(err, "Workload already patched by LightrunJavaAgent", "Existing LightrunJavaAgent", oldLrjaName)
+		err = withReason(reasonWorkloadAlreadyPatched, errors.New(strings.ToLower(kind)+" already patched: "+workloadName+" by LightrunJavaAgent "+oldLrjaName))
+		r.recordWorkloadError(lightrunJavaAgent, originalWorkload, err)
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
 
-	deploymentApplyConfig, err := appsv1ac.ExtractDeployment(originalDeployment, fieldManager)
+	secret, agentArg, cmDataHash, err := r.prepareAgent(ctx, lightrunJavaAgent, namespace)
 	if err != nil {
-		log.Error(err, "failed to extract Deployment")
 		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
 
-	// Finalization
-	if lightrunJavaAgent.ObjectMeta.DeletionTimestamp.IsZero() {
-		// The object is not being deleted
+	if lightrunJavaAgent.Spec.Canary != nil && adapter.kind() == agentv1beta.WorkloadTypeDeployment {
+		return r.reconcileCanaryDeployment(ctx, lightrunJavaAgent, originalWorkload.(*appsv1.Deployment), secret, agentArg, cmDataHash)
+	}
 
-		log.V(2).Info("Searching for secret", "Name", lightrunJavaAgent.Spec.SecretName)
-		secretNamespacedObj := client.ObjectKey{
-			Name:      lightrunJavaAgent.Spec.SecretName,
-			Namespace: namespace,
-		}
-		secret = &corev1.Secret{}
-		err = r.Get(ctx, secretNamespacedObj, secret)
+	if lightrunJavaAgent.Spec.DryRun {
+		preview, err := r.previewWorkload(ctx, lightrunJavaAgent, adapter, originalWorkload, secret, agentArg, cmDataHash)
 		if err != nil {
-			if client.IgnoreNotFound(err) == nil {
-				log.Error(err, "Secret not found", "Secret", lightrunJavaAgent.Spec.SecretName)
-			}
+			log.Error(err, "failed to preview workload patch")
 			return r.errorStatus(ctx, lightrunJavaAgent, err)
 		}
+		lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{r.dryRunWorkloadStatus(lightrunJavaAgent, adapter, originalWorkload, cmDataHash, preview)}
+		log.V(1).Info("Dry run finished successfully")
+		return r.dryRunStatus(ctx, lightrunJavaAgent)
+	}
 
-		// Ensure that finalizer is in place
-		if !containsString(lightrunJavaAgent.ObjectMeta.Finalizers, finalizerName) {
-			log.Info("Start working on deployment", "Deployment", deploymentName)
-			log.Info("Adding finalizer")
-			err = r.addFinalizer(ctx, lightrunJavaAgent, finalizerName)
+	drift, reapply := r.reconcileDrift(lightrunJavaAgent, adapter, originalWorkload, time.Now())
+	if !reapply {
+		log.Info("Agent env var is reverted repeatedly, waiting for the backoff to re-apply it")
+		lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{r.driftedWorkloadStatus(lightrunJavaAgent, adapter, originalWorkload, cmDataHash, drift)}
+		return r.successStatus(ctx, lightrunJavaAgent)
+	}
+
+	err = r.patchWorkload(ctx, lightrunJavaAgent, adapter, originalWorkload, secret, agentArg, cmDataHash)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			log.Info("Workload not found")
+			err = r.removeFinalizer(ctx, lightrunJavaAgent, finalizerName)
 			if err != nil {
 				return r.errorStatus(ctx, lightrunJavaAgent, err)
 			}
+			err = errors.New(strings.ToLower(kind) + " not found")
+			setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionWorkloadFound, metav1.ConditionFalse, reasonWorkloadNotFound, err.Error())
+			return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonWorkloadNotFound, err))
 		}
-	} else {
-		// The object is being deleted
-		log.Info("LightrunJavaAgent is being deleted", "lightrunJavaAgent", lightrunJavaAgent.Name)
-		// Unpatch deployment
-		if containsString(lightrunJavaAgent.ObjectMeta.Finalizers, finalizerName) {
-			log.Info("Unpatching deployment", "Deployment", originalDeployment.Name)
-
-			// Remove agent from JAVA_TOOL_OPTIONS. Client side patch
-			clientSidePatch := client.MergeFrom(originalDeployment.DeepCopy())
-			for i, container := range originalDeployment.Spec.Template.Spec.Containers {
-				for _, targetContainer := range lightrunJavaAgent.Spec.ContainerSelector {
-					if targetContainer == container.Name {
-						r.unpatchJavaToolEnv(originalDeployment.Annotations, &originalDeployment.Spec.Template.Spec.Containers[i])
-					}
-				}
+		log.Error(err, "failed to patch workload")
+		r.recordWorkloadError(lightrunJavaAgent, originalWorkload, err)
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	}
+	// Canary is removed once the agent is promoted to the original Deployment
+	if adapter.kind() == agentv1beta.WorkloadTypeDeployment {
+		err = r.deleteCanaryDeployment(ctx, lightrunJavaAgent, namespace)
+		if err != nil {
+			log.Error(err, "failed to remove canary deployment")
+			return r.errorStatus(ctx, lightrunJavaAgent, err)
+		}
+	}
+	status := r.workloadStatus(lightrunJavaAgent, adapter, originalWorkload, cmDataHash)
+	status.Drift = drift
+	lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{status}
 
+	// Update status to Healthy
+	log.V(1).Info("Reconciling finished successfully")
+	return r.successStatus(ctx, lightrunJavaAgent)
+}
+
+// reconcileSelector handles the reconciliation logic for LightrunJavaAgents targeting workloads with workloadSelector.
+// Every matching workload is patched, workloads patched by this LightrunJavaAgent that don't match anymore are unpatched
+func (r *LightrunJavaAgentReconciler) reconcileSelector(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, namespace string) (ctrl.Result, error) {
+	log := r.Log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name)
+	selector, err := metav1.LabelSelectorAsSelector(lightrunJavaAgent.Spec.WorkloadSelector)
+	if err != nil {
+		log.Error(err, "invalid workloadSelector")
+		return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonInvalidSpec, err))
+	}
+	adapters := []workloadAdapter{}
+	for _, kind := range selectorWorkloadKinds(lightrunJavaAgent) {
+		if kind == agentv1beta.WorkloadTypeJob {
+			return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonInvalidSpec, errors.New("job workload kind is not supported with workloadSelector")))
+		}
+		adapter, err := newWorkloadAdapter(kind, lightrunJavaAgent)
+		if err != nil {
+			return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonInvalidSpec, err))
+		}
+		adapters = append(adapters, adapter)
+	}
+
+	deleting := !lightrunJavaAgent.ObjectMeta.DeletionTimestamp.IsZero()
+	if deleting && !containsString(lightrunJavaAgent.ObjectMeta.Finalizers, finalizerName) {
+		// Nothing to do here
+		return r.progressingStatus(ctx, lightrunJavaAgent, reasonDeleting)
+	}
+
+	var secret *corev1.Secret
+	var agentArg string
+	var cmDataHash uint64
+	if !deleting {
+		secret, agentArg, cmDataHash, err = r.prepareAgent(ctx, lightrunJavaAgent, namespace)
+		if err != nil {
+			return r.errorStatus(ctx, lightrunJavaAgent, err)
+		}
+	}
+
+	statuses := []agentv1beta.WorkloadReconcileStatus{}
+	var errs []error
+	for _, adapter := range adapters {
+		workloads := adapter.newObjectList()
+		err = r.List(ctx, workloads, client.InNamespace(namespace))
+		if err != nil {
+			log.Error(err, "unable to list workloads", "kind", adapter.kind())
+			errs = append(errs, err)
+			continue
+		}
+		items, err := meta.ExtractList(workloads)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, item := range items {
+			workload := item.(client.Object)
+			// Canary Deployments are managed by the LightrunJavaAgents that created them
+			if _, isCanary := workload.GetLabels()[labelCanary]; isCanary {
+				continue
+			}
+			oldLrjaName, alreadyPatched := workload.GetAnnotations()[annotationAgentName]
+			matches := !deleting && selector.Matches(labels.Set(workload.GetLabels()))
+			var drift *agentv1beta.WorkloadDrift
+			switch {
+			case matches && alreadyPatched && oldLrjaName != lightrunJavaAgent.Name:
+				err = withReason(reasonWorkloadAlreadyPatched, errors.New("already patched by LightrunJavaAgent "+oldLrjaName))
+			case matches && lightrunJavaAgent.Spec.DryRun:
+				var preview *agentv1beta.WorkloadPatchPreview
+				preview, err = r.previewWorkload(ctx, lightrunJavaAgent, adapter, workload, secret, agentArg, cmDataHash)
+				if err == nil {
+					statuses = append(statuses, r.dryRunWorkloadStatus(lightrunJavaAgent, adapter, workload, cmDataHash, preview))
+					continue
+				}
+			case matches:
+				var reapply bool
+				drift, reapply = r.reconcileDrift(lightrunJavaAgent, adapter, workload, time.Now())
+				if !reapply {
+					statuses = append(statuses, r.driftedWorkloadStatus(lightrunJavaAgent, adapter, workload, cmDataHash, drift))
+					continue
+				}
+				err = r.patchWorkload(ctx, lightrunJavaAgent, adapter, workload, secret, agentArg, cmDataHash)
+			case alreadyPatched && oldLrjaName == lightrunJavaAgent.Name && !lightrunJavaAgent.Spec.DryRun:
+				log.Info("Unpatching workload", "kind", adapter.kind(), "workload", workload.GetName())
+				err = r.unpatchWorkload(ctx, lightrunJavaAgent, adapter, workload)
+				if err == nil {
+					continue
+				}
+			default:
+				continue
 			}
-			delete(originalDeployment.Annotations, annotationPatchedEnvName)
-			delete(originalDeployment.Annotations, annotationPatchedEnvValue)
-			err = r.Patch(ctx, originalDeployment, clientSidePatch)
 			if err != nil {
-				log.Error(err, "unable to unpatch "+lightrunJavaAgent.Spec.AgentEnvVarName)
-				return r.errorStatus(ctx, lightrunJavaAgent, err)
+				log.Error(err, "failed to reconcile workload", "kind", adapter.kind(), "workload", workload.GetName())
+				r.recordWorkloadError(lightrunJavaAgent, workload, err)
+				statuses = append(statuses, agentv1beta.WorkloadReconcileStatus{
+					Kind:    adapter.kind(),
+					Name:    workload.GetName(),
+					UID:     workload.GetUID(),
+					Status:  workloadStatusFailed,
+					Message: err.Error(),
+				})
+				errs = append(errs, fmt.Errorf("%s %s: %w", adapter.kind(), workload.GetName(), err))
+				continue
 			}
+			status := r.workloadStatus(lightrunJavaAgent, adapter, workload, cmDataHash)
+			status.Drift = drift
+			statuses = append(statuses, status)
+		}
+	}
+	lightrunJavaAgent.Status.Workloads = statuses
 
-			// Remove Volumes and init container
-			emptyApplyConfig := appsv1ac.Deployment(deplNamespacedObj.Name, deplNamespacedObj.Namespace)
-			obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(emptyApplyConfig)
-			if err != nil {
-				log.Error(err, "failed to convert Deployment to unstructured")
-				return r.errorStatus(ctx, lightrunJavaAgent, err)
+	if deleting {
+		if len(errs) > 0 {
+			return r.errorStatus(ctx, lightrunJavaAgent, errors.Join(errs...))
+		}
+		log.Info("Removing finalizer")
+		err = r.removeFinalizer(ctx, lightrunJavaAgent, finalizerName)
+		if err != nil {
+			return r.errorStatus(ctx, lightrunJavaAgent, err)
+		}
+		return r.progressingStatus(ctx, lightrunJavaAgent, reasonDeleting)
+	}
+	if len(statuses) > 0 {
+		setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionWorkloadFound, metav1.ConditionTrue, reasonWorkloadFound, "")
+	} else {
+		setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionWorkloadFound, metav1.ConditionFalse, reasonNoMatchingWorkloads, "no workloads match workloadSelector")
+	}
+	if len(errs) > 0 {
+		return r.errorStatus(ctx, lightrunJavaAgent, errors.Join(errs...))
+	}
+	if lightrunJavaAgent.Spec.DryRun {
+		log.V(1).Info("Dry run finished successfully", "workloads", len(statuses))
+		return r.dryRunStatus(ctx, lightrunJavaAgent)
+	}
+	log.V(1).Info("Reconciling finished successfully", "workloads", len(statuses))
+	return r.successStatus(ctx, lightrunJavaAgent)
+}
+
+// reconcileWebhookMode handles LightrunJavaAgents with Webhook injection mode.
+// Workloads are not patched, the agent is injected into pods by the PodInjector webhook using the prepared ConfigMap.
+// Workloads patched by this LightrunJavaAgent before the mode was switched are returned to the original state
+func (r *LightrunJavaAgentReconciler) reconcileWebhookMode(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, namespace string) (ctrl.Result, error) {
+	log := r.Log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name)
+
+	if !lightrunJavaAgent.ObjectMeta.DeletionTimestamp.IsZero() {
+		if !containsString(lightrunJavaAgent.ObjectMeta.Finalizers, finalizerName) {
+			// Nothing to do here
+			return r.progressingStatus(ctx, lightrunJavaAgent, reasonDeleting)
+		}
+		err := r.unpatchAgentWorkloads(ctx, lightrunJavaAgent, namespace)
+		if err != nil {
+			log.Error(err, "failed to unpatch workloads")
+			return r.errorStatus(ctx, lightrunJavaAgent, err)
+		}
+		log.Info("Removing finalizer")
+		err = r.removeFinalizer(ctx, lightrunJavaAgent, finalizerName)
+		if err != nil {
+			return r.errorStatus(ctx, lightrunJavaAgent, err)
+		}
+		return r.progressingStatus(ctx, lightrunJavaAgent, reasonDeleting)
+	}
+
+	_, _, _, err := r.prepareAgent(ctx, lightrunJavaAgent, namespace)
+	if err != nil {
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	}
+	err = r.unpatchAgentWorkloads(ctx, lightrunJavaAgent, namespace)
+	if err != nil {
+		log.Error(err, "failed to unpatch workloads")
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	}
+	lightrunJavaAgent.Status.Workloads = nil
+	// Pods are matched on creation, there is no target workload to find
+	meta.RemoveStatusCondition(&lightrunJavaAgent.Status.Conditions, conditionWorkloadFound)
+
+	log.V(1).Info("Reconciling finished successfully, agent will be injected on pod creation")
+	return r.successStatus(ctx, lightrunJavaAgent)
+}
+
+// unpatchAgentWorkloads returns the workloads patched by the LightrunJavaAgent to the original state.
+// Job pod template is immutable, so Jobs are skipped
+func (r *LightrunJavaAgentReconciler) unpatchAgentWorkloads(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, namespace string) error {
+	kinds := []agentv1beta.WorkloadType{lightrunJavaAgent.Spec.WorkloadType}
+	if lightrunJavaAgent.Spec.WorkloadSelector != nil {
+		kinds = selectorWorkloadKinds(lightrunJavaAgent)
+	}
+	for _, kind := range kinds {
+		if kind == agentv1beta.WorkloadTypeJob {
+			continue
+		}
+		adapter, err := newWorkloadAdapter(kind, lightrunJavaAgent)
+		if err != nil {
+			return err
+		}
+		workloads := adapter.newObjectList()
+		err = r.List(ctx, workloads, client.InNamespace(namespace))
+		if err != nil {
+			if meta.IsNoMatchError(err) {
+				continue
 			}
-			patch := &unstructured.Unstructured{
-				Object: obj,
+			return err
+		}
+		items, err := meta.ExtractList(workloads)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			workload := item.(client.Object)
+			if workload.GetAnnotations()[annotationAgentName] != lightrunJavaAgent.Name {
+				continue
 			}
-			err = r.Patch(ctx, patch, client.Apply, &client.PatchOptions{
-				FieldManager: fieldManager,
-				Force:        pointer.Bool(true),
-			})
+			r.Log.Info("Unpatching workload", "kind", kind, "workload", workload.GetName())
+			err = r.unpatchWorkload(ctx, lightrunJavaAgent, adapter, workload)
 			if err != nil {
-				log.Error(err, "failed to unpatch deployment")
-				return r.errorStatus(ctx, lightrunJavaAgent, err)
+				return err
 			}
+		}
+	}
+	return nil
+}
 
-			// remove our finalizer from the list and update it.
-			log.Info("Removing finalizer")
-			err = r.removeFinalizer(ctx, lightrunJavaAgent, finalizerName)
-			if err != nil {
-				return r.errorStatus(ctx, lightrunJavaAgent, err)
-			}
+// prepareAgent fetches the secret, ensures the finalizer and the agent ConfigMap.
+// It returns the secret, the agent env var argument and the hash of the stored ConfigMap data
+func (r *LightrunJavaAgentReconciler) prepareAgent(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, namespace string) (*corev1.Secret, string, uint64, error) {
+	log := r.Log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name)
 
-			log.Info("Deployment returned to original state", "Deployment", deploymentName)
-			return r.successStatus(ctx, lightrunJavaAgent, reconcileTypeProgressing)
-		} else {
-			// Nothing to do here
-			return r.successStatus(ctx, lightrunJavaAgent, reconcileTypeProgressing)
+	// Get the secret
+	log.V(2).Info("Searching for secret", "Name", lightrunJavaAgent.Spec.SecretName)
+	secretNamespacedObj := client.ObjectKey{
+		Name:      lightrunJavaAgent.Spec.SecretName,
+		Namespace: namespace,
+	}
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, secretNamespacedObj, secret)
+	if err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			log.Error(err, "Secret not found", "Secret", lightrunJavaAgent.Spec.SecretName)
+			setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionSecretResolved, metav1.ConditionFalse, reasonSecretNotFound, err.Error())
+			secretResolutionFailuresTotal.WithLabelValues(namespace, reasonSecretNotFound).Inc()
+			err = withReason(reasonSecretNotFound, err)
+		}
+		return nil, "", 0, err
+	}
+	setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionSecretResolved, metav1.ConditionTrue, reasonSecretFound, "")
+
+	err = r.resolveAgentImage(ctx, lightrunJavaAgent)
+	if err != nil {
+		log.Error(err, "unable to resolve agent version")
+		return nil, "", 0, withReason(reasonAgentVersionUnresolved, err)
+	}
+
+	// Ensure that finalizer is in place
+	if !containsString(lightrunJavaAgent.ObjectMeta.Finalizers, finalizerName) {
+		log.Info("Adding finalizer")
+		err = r.addFinalizer(ctx, lightrunJavaAgent, finalizerName)
+		if err != nil {
+			return nil, "", 0, err
 		}
 	}
 
@@ -224,361 +592,567 @@ func (r *LightrunJavaAgentReconciler) reconcileDeployment(ctx context.Context, l
 	agentArg, err := agentEnvVarArgument(lightrunJavaAgent.Spec.InitContainer.SharedVolumeMountPath, lightrunJavaAgent.Spec.AgentCliFlags)
 	if err != nil {
 		log.Error(err, "agentEnvVarArgument exceeds 1024 chars")
-		return r.errorStatus(ctx, lightrunJavaAgent, err)
+		return nil, "", 0, err
 	}
 
-	// Create config map
-	log.V(2).Info("Reconciling config map with agent configuration")
-	configMap, err := r.createAgentConfig(lightrunJavaAgent)
+	cmDataHash, err := r.reconcileAgentConfig(ctx, lightrunJavaAgent)
 	if err != nil {
-		log.Error(err, "unable to create configMap")
-		return r.errorStatus(ctx, lightrunJavaAgent, err)
+		log.Error(err, "unable to reconcile configMap")
+		return nil, "", 0, err
 	}
-	applyOpts := []client.PatchOption{client.ForceOwnership, client.FieldOwner("lightrun-controller")}
+	if lightrunJavaAgent.Spec.InitContainer.InjectionMode == agentv1beta.AgentInstallModeImageVolume {
+		secretDataHash, err := r.reconcileAgentConfigSecret(ctx, lightrunJavaAgent, secret)
+		if err != nil {
+			log.Error(err, "unable to reconcile agent config secret")
+			if errorReason(err) == reasonSecretInvalid {
+				setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionSecretResolved, metav1.ConditionFalse, reasonSecretInvalid, err.Error())
+				secretResolutionFailuresTotal.WithLabelValues(namespace, reasonSecretInvalid).Inc()
+			}
+			return nil, "", 0, err
+		}
+		// Secret values are part of the mounted agent config, their change has to recreate the pods as well
+		cmDataHash = cmDataHash*31 + secretDataHash
+	}
+	return secret, agentArg, cmDataHash, nil
+}
 
-	err = r.Patch(ctx, &configMap, client.Apply, applyOpts...)
+// patchWorkload injects the agent into the workload.
+// Volumes and init container are added with server side apply, agent env var with client side patch
+func (r *LightrunJavaAgentReconciler) patchWorkload(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, adapter workloadAdapter, workload client.Object, secret *corev1.Secret, agentArg string, cmDataHash uint64) (err error) {
+	log := r.Log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name, "kind", adapter.kind(), "workload", workload.GetName())
+	defer func(start time.Time) {
+		observeWorkloadOperation(adapter.kind(), operationPatch, start, err)
+	}(time.Now())
+
+	// Server side apply
+	log.V(2).Info("Patching workload, SSA")
+	patch, err := r.workloadApplyPatch(ctx, lightrunJavaAgent, adapter, workload, secret, cmDataHash)
 	if err != nil {
-		log.Error(err, "unable to create configMap")
-		return r.errorStatus(ctx, lightrunJavaAgent, err)
+		return err
+	}
+	err = setCanaryPartition(lightrunJavaAgent, workload, patch)
+	if err != nil {
+		return err
+	}
+	err = r.applyWorkload(ctx, workload, patch, false)
+	if err != nil {
+		return err
+	}
+	err = r.releaseLegacyFieldManager(ctx, workload)
+	if err != nil {
+		return err
 	}
 
-	// Calculate ConfigMap Data hash for deployment rollout trigger
-	cmNamespacedObj := client.ObjectKey{
-		Name:      configMap.Name,
-		Namespace: configMap.Namespace,
+	// Client side patch (we can't rollback JAVA_TOOL_OPTIONS env with server side apply)
+	log.V(2).Info("Patching Java Env")
+	patchedWorkload := adapter.newObject()
+	err = r.Get(ctx, client.ObjectKeyFromObject(workload), patchedWorkload)
+	if err != nil {
+		return err
 	}
-	cm := &corev1.ConfigMap{}
-	err = r.Get(ctx, cmNamespacedObj, cm)
+	clientSidePatch := client.MergeFrom(patchedWorkload.DeepCopyObject().(client.Object))
+	template, err := adapter.podTemplate(patchedWorkload)
 	if err != nil {
-		if client.IgnoreNotFound(err) == nil {
-			log.Error(err, "ConfigMap not found", "CM", configMap.Name)
+		return err
+	}
+	annotations := patchedWorkload.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	if !gitOpsEnvApplied(lightrunJavaAgent, adapter.kind()) {
+		err = r.patchContainersEnv(lightrunJavaAgent, template, annotations, agentArg)
+		if err != nil {
+			return err
+		}
+		annotations[annotationPatchedEnvName] = agentEnvVarName(lightrunJavaAgent)
+		annotations[annotationPatchedEnvValue] = agentArg
+		patchedWorkload.SetAnnotations(annotations)
+		err = adapter.setPodTemplate(patchedWorkload, template)
+		if err != nil {
+			return err
+		}
+		err = r.Patch(ctx, patchedWorkload, clientSidePatch)
+		if err != nil {
+			return err
+		}
+	} else if previous := workload.GetAnnotations(); previous[annotationPatchedEnvName] != "" && previous[annotationPatchedEnvName] != agentEnvVarName(lightrunJavaAgent) {
+		// Env var is applied with the pod template and owned only by the operator field manager.
+		// The env var patched on the client side before GitOps compatibility mode was enabled is removed
+		for i, container := range template.Spec.Containers {
+			if containsString(lightrunJavaAgent.Spec.ContainerSelector, container.Name) {
+				r.unpatchJavaToolEnv(previous, &template.Spec.Containers[i])
+			}
+		}
+		err = adapter.setPodTemplate(patchedWorkload, template)
+		if err != nil {
+			return err
+		}
+		err = r.Patch(ctx, patchedWorkload, clientSidePatch)
+		if err != nil {
+			return err
+		}
+	}
+	// Reconciliation without changes doesn't change the resource version and isn't recorded
+	if patchedWorkload.GetResourceVersion() != workload.GetResourceVersion() {
+		wasPatched := workload.GetAnnotations()[annotationAgentName] == lightrunJavaAgent.Name
+		r.recordPatchEvent(lightrunJavaAgent, adapter, patchedWorkload, wasPatched)
+		origTemplate, err := adapter.podTemplate(workload)
+		if err == nil && wasPatched && origTemplate.Annotations[annotationConfigMapHash] != "" &&
+			origTemplate.Annotations[annotationConfigMapHash] != template.Annotations[annotationConfigMapHash] {
+			configRolloutsTotal.WithLabelValues(string(adapter.kind()), workload.GetNamespace()).Inc()
 		}
-		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
-	cmDataHash := configMapDataHash(cm.Data)
+	return nil
+}
 
-	// Server side apply
-	log.V(2).Info("Patching deployment, SSA", "Deployment", deploymentName, "LightunrJavaAgent", lightrunJavaAgent.Name)
-	err = r.patchDeployment(lightrunJavaAgent, secret, originalDeployment, deploymentApplyConfig, cmDataHash)
+// workloadApplyPatch returns the server side apply object of the workload with the agent injected.
+// Image volume is used if it is requested by the LightrunJavaAgent and available in the cluster.
+// Availability is checked with dry run apply on the first use, init container is used as a fallback
+func (r *LightrunJavaAgentReconciler) workloadApplyPatch(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, adapter workloadAdapter, workload client.Object, secret *corev1.Secret, cmDataHash uint64) (*unstructured.Unstructured, error) {
+	annotations := map[string]string{annotationAgentName: lightrunJavaAgent.Name}
+	origTemplate, err := adapter.podTemplate(workload)
 	if err != nil {
-		log.Error(err, "unable to patch deployment")
-		return r.errorStatus(ctx, lightrunJavaAgent, err)
+		return nil, err
+	}
+	cmDataHash, err = rolloutConfigHash(lightrunJavaAgent, origTemplate, cmDataHash, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	err = checkGitOpsEnvVar(lightrunJavaAgent, origTemplate)
+	if err != nil {
+		return nil, err
+	}
+	addGitOpsAnnotations(lightrunJavaAgent, workload.GetAnnotations(), annotations)
+	if gitOpsEnvApplied(lightrunJavaAgent, adapter.kind()) {
+		// Drift detection reads the env var applied with the pod template from the same annotations
+		agentArg, err := agentEnvVarArgument(lightrunJavaAgent.Spec.InitContainer.SharedVolumeMountPath, lightrunJavaAgent.Spec.AgentCliFlags)
+		if err != nil {
+			return nil, withReason(reasonEnvTooLong, err)
+		}
+		annotations[annotationPatchedEnvName] = agentEnvVarName(lightrunJavaAgent)
+		annotations[annotationPatchedEnvValue] = agentArg
+	}
+
+	initContainer := lightrunJavaAgent.Spec.InitContainer
+	imageVolumes := r.imageVolumesState(time.Now())
+	if initContainer.InjectionMode == agentv1beta.AgentInstallModeImageVolume && !initContainer.Sidecar && imageVolumes != imageVolumesUnsupported {
+		image, err := r.agentImage(lightrunJavaAgent, origTemplate)
+		if err != nil {
+			return nil, err
+		}
+		templateApplyConfig, err := r.imageVolumePodTemplate(lightrunJavaAgent, origTemplate, cmDataHash)
+		if err != nil {
+			return nil, err
+		}
+		patch, err := adapter.applyConfig(workload, annotations, templateApplyConfig)
+		if err != nil {
+			return nil, err
+		}
+		if !setImageVolumeSource(patch.Object, initContainer.SharedVolumeName, image, initContainer.ImagePullPolicy) {
+			return nil, errors.New("unable to find agent volume in the pod template")
+		}
+		if imageVolumes == imageVolumesSupported {
+			return patch, nil
+		}
+
+		err = r.applyWorkload(ctx, workload, patch.DeepCopy(), true)
+		switch {
+		case err == nil:
+			r.setImageVolumesState(imageVolumesSupported, time.Now())
+			return patch, nil
+		case imageVolumeRejected(err, initContainer.SharedVolumeName):
+			r.Log.Info("Image volumes are not available in the cluster, falling back to init container", "reason", err.Error())
+			r.setImageVolumesState(imageVolumesUnsupported, time.Now())
+		default:
+			return nil, err
+		}
 	}
 
-	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(deploymentApplyConfig)
+	templateApplyConfig, err := r.patchPodTemplate(lightrunJavaAgent, secret, origTemplate, cmDataHash)
 	if err != nil {
-		log.Error(err, "failed to convert Deployment to unstructured")
-		return r.errorStatus(ctx, lightrunJavaAgent, err)
+		return nil, err
 	}
+	return adapter.applyConfig(workload, annotations, templateApplyConfig)
+}
 
-	patch := &unstructured.Unstructured{
-		Object: obj,
+// unpatchWorkload returns the workload to the original state.
+// Agent env var is removed with client side patch, volumes and init container by releasing fields owned by the operator
+func (r *LightrunJavaAgentReconciler) unpatchWorkload(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, adapter workloadAdapter, workload client.Object) (err error) {
+	defer func(start time.Time) {
+		observeWorkloadOperation(adapter.kind(), operationUnpatch, start, err)
+	}(time.Now())
+	if workload.GetLabels()[labelCanary] == lightrunJavaAgent.Name {
+		return r.deleteCanary(ctx, lightrunJavaAgent, workload)
+	}
+	wasPatched := workload.GetAnnotations()[annotationAgentName] == lightrunJavaAgent.Name
+	clientSidePatch := client.MergeFrom(workload.DeepCopyObject().(client.Object))
+	template, err := adapter.podTemplate(workload)
+	if err != nil {
+		return err
+	}
+	annotations := workload.GetAnnotations()
+	// Env var applied with the pod template is released with the volumes, declaration of the env var in Git is kept
+	envApplied := gitOpsEnvApplied(lightrunJavaAgent, adapter.kind()) && annotations[annotationPatchedEnvName] == agentEnvVarName(lightrunJavaAgent)
+	for i, container := range template.Spec.Containers {
+		for _, targetContainer := range lightrunJavaAgent.Spec.ContainerSelector {
+			if targetContainer == container.Name && !envApplied {
+				r.unpatchJavaToolEnv(annotations, &template.Spec.Containers[i])
+			}
+		}
+	}
+	delete(annotations, annotationPatchedEnvName)
+	delete(annotations, annotationPatchedEnvValue)
+	delete(annotations, annotationAgentName)
+	workload.SetAnnotations(annotations)
+	err = adapter.setPodTemplate(workload, template)
+	if err != nil {
+		return err
+	}
+	err = r.Patch(ctx, workload, clientSidePatch)
+	if err != nil {
+		return err
 	}
 
-	err = r.Patch(ctx, patch, client.Apply, &client.PatchOptions{
-		FieldManager: fieldManager,
+	// Remove Volumes and init container
+	patch, err := adapter.applyConfig(workload, nil, nil)
+	if err != nil {
+		return err
+	}
+	err = r.applyWorkload(ctx, workload, patch, false)
+	if err != nil {
+		return err
+	}
+	err = r.releaseLegacyFieldManager(ctx, workload)
+	if err != nil {
+		return err
+	}
+	if wasPatched {
+		r.recordEvent(lightrunJavaAgent, workload, corev1.EventTypeNormal, eventReasonAgentRemoved, "agent removed from "+string(adapter.kind())+" "+workload.GetName())
+	}
+	return nil
+}
+
+// imageVolumesState returns the detected availability of image volumes.
+// Detection older than imageVolumesCheckInterval is unknown, so it is done again with the next patch
+func (r *LightrunJavaAgentReconciler) imageVolumesState(now time.Time) int32 {
+	state := r.imageVolumes.Load()
+	if state != imageVolumesUnknown && now.Sub(time.Unix(0, r.imageVolumesCheckedAt.Load())) > imageVolumesCheckInterval {
+		return imageVolumesUnknown
+	}
+	return state
+}
+
+func (r *LightrunJavaAgentReconciler) setImageVolumesState(state int32, now time.Time) {
+	r.imageVolumesCheckedAt.Store(now.UnixNano())
+	r.imageVolumes.Store(state)
+}
+
+// applyWorkload applies the patch object of the workload with server side apply.
+// Argo Rollouts are merge patched with the changes against the live object, see rolloutMergeObject
+func (r *LightrunJavaAgentReconciler) applyWorkload(ctx context.Context, workload client.Object, patch *unstructured.Unstructured, dryRun bool) error {
+	if patch.GroupVersionKind() == rolloutGVK {
+		rollout, ok := workload.(*unstructured.Unstructured)
+		if !ok {
+			return errors.New("unexpected type of the rollout object")
+		}
+		merged, err := rolloutMergeObject(rollout, patch)
+		if err != nil {
+			return err
+		}
+		var opts []client.PatchOption
+		if dryRun {
+			opts = append(opts, client.DryRunAll)
+		}
+		return r.Patch(ctx, merged, client.MergeFrom(rollout), opts...)
+	}
+	opts := []client.PatchOption{client.ForceOwnership, client.FieldOwner(fieldManager)}
+	if dryRun {
+		opts = append(opts, client.DryRunAll)
+	}
+	return r.Patch(ctx, patch, client.Apply, opts...)
+}
+
+// releaseLegacyFieldManager releases the fields applied by the operator versions that used misspelled field manager name
+func (r *LightrunJavaAgentReconciler) releaseLegacyFieldManager(ctx context.Context, workload client.Object) error {
+	found := false
+	for _, managedField := range workload.GetManagedFields() {
+		if managedField.Manager == legacyFieldManager && managedField.Operation == metav1.ManagedFieldsOperationApply {
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	gvk, err := apiutil.GVKForObject(workload, r.Scheme)
+	if err != nil {
+		return err
+	}
+	patch := &unstructured.Unstructured{}
+	patch.SetGroupVersionKind(gvk)
+	patch.SetName(workload.GetName())
+	patch.SetNamespace(workload.GetNamespace())
+	return r.Patch(ctx, patch, client.Apply, &client.PatchOptions{
+		FieldManager: legacyFieldManager,
 		Force:        pointer.Bool(true),
 	})
+}
+
+// reconcileAgentConfig applies the ConfigMap with the agent configuration and
+// returns the hash of the stored ConfigMap data, used as a rollout trigger
+func (r *LightrunJavaAgentReconciler) reconcileAgentConfig(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent) (uint64, error) {
+	log := r.Log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name)
+	log.V(2).Info("Reconciling config map with agent configuration")
+	configMap, err := r.createAgentConfig(lightrunJavaAgent)
 	if err != nil {
-		log.Error(err, "failed to patch deployment")
-		return r.errorStatus(ctx, lightrunJavaAgent, err)
+		return 0, err
 	}
+	applyOpts := []client.PatchOption{client.ForceOwnership, client.FieldOwner(fieldManager)}
 
-	// Client side patch (we can't rollback JAVA_TOOL_OPTIONS env with server side apply)
-	log.V(2).Info("Patching Java Env", "Deployment", deploymentName, "LightunrJavaAgent", lightrunJavaAgent.Name)
-	originalDeployment = &appsv1.Deployment{}
-	err = r.Get(ctx, deplNamespacedObj, originalDeployment)
+	err = r.Patch(ctx, &configMap, client.Apply, applyOpts...)
+	if err != nil {
+		return 0, err
+	}
+
+	cm := &corev1.ConfigMap{}
+	err = r.Get(ctx, client.ObjectKeyFromObject(&configMap), cm)
 	if err != nil {
 		if client.IgnoreNotFound(err) == nil {
-			log.Info("Deployment not found", "Deployment", deploymentName)
-			err = r.removeFinalizer(ctx, lightrunJavaAgent, finalizerName)
-			if err != nil {
-				return r.errorStatus(ctx, lightrunJavaAgent, err)
-			}
-			return r.errorStatus(ctx, lightrunJavaAgent, errors.New("deployment not found"))
+			log.Error(err, "ConfigMap not found", "CM", configMap.Name)
 		}
-		return r.errorStatus(ctx, lightrunJavaAgent, err)
+		return 0, err
 	}
-	clientSidePatch := client.MergeFrom(originalDeployment.DeepCopy())
-	for i, container := range originalDeployment.Spec.Template.Spec.Containers {
-		for _, targetContainer := range lightrunJavaAgent.Spec.ContainerSelector {
-			if targetContainer == container.Name {
-				err = r.patchJavaToolEnv(originalDeployment.Annotations, &originalDeployment.Spec.Template.Spec.Containers[i], lightrunJavaAgent.Spec.AgentEnvVarName, agentArg)
-				if err != nil {
-					log.Error(err, "failed to patch "+lightrunJavaAgent.Spec.AgentEnvVarName)
-					return r.errorStatus(ctx, lightrunJavaAgent, err)
-				}
-			}
-		}
+	return configMapDataHash(cm.Data), nil
+}
+
+// reconcileAgentConfigSecret applies the Secret with the agent config used in ImageVolume mode.
+// It returns the hash of the Secret data
+func (r *LightrunJavaAgentReconciler) reconcileAgentConfigSecret(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, secret *corev1.Secret) (uint64, error) {
+	configSecret, err := r.createAgentConfigSecret(lightrunJavaAgent, secret)
+	if err != nil {
+		return 0, err
 	}
-	originalDeployment.Annotations[annotationPatchedEnvName] = lightrunJavaAgent.Spec.AgentEnvVarName
-	originalDeployment.Annotations[annotationPatchedEnvValue] = agentArg
-	err = r.Patch(ctx, originalDeployment, clientSidePatch)
+	err = r.Patch(ctx, &configSecret, client.Apply, client.ForceOwnership, client.FieldOwner(fieldManager))
 	if err != nil {
-		log.Error(err, "failed to patch "+lightrunJavaAgent.Spec.AgentEnvVarName)
-		return r.errorStatus(ctx, lightrunJavaAgent, err)
+		return 0, err
 	}
-
-	// Update status to Healthy
-	log.V(1).Info("Reconciling finished successfully", "Deployment", deploymentName, "LightunrJavaAgent", lightrunJavaAgent.Name)
-	return r.successStatus(ctx, lightrunJavaAgent, reconcileTypeReady)
+	data := map[string]string{}
+	for k, v := range configSecret.Data {
+		data[k] = string(v)
+	}
+	return configMapDataHash(data), nil
 }
 
-// reconcileStatefulSet handles the reconciliation logic for StatefulSet workloads
-func (r *LightrunJavaAgentReconciler) reconcileStatefulSet(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, namespace string) (ctrl.Result, error) {
-	log := r.Log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name, "statefulSet", lightrunJavaAgent.Spec.WorkloadName)
-	fieldManager := "lightrun-controller"
-	statefulSetName := lightrunJavaAgent.Spec.WorkloadName
-	if statefulSetName == "" {
-		return r.errorStatus(ctx, lightrunJavaAgent, errors.New("unable to reconcile statefulset: missing workloadName field"))
+// reconcileJob handles the reconciliation logic for Job workloads.
+// Pod template of a Job is immutable, so only Jobs that were created suspended after the
+// LightrunJavaAgent are patched. Such Job is recreated with the agent injected and resumed.
+func (r *LightrunJavaAgentReconciler) reconcileJob(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, namespace string) (ctrl.Result, error) {
+	log := r.Log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name, "job", lightrunJavaAgent.Spec.WorkloadName)
+	jobName := lightrunJavaAgent.Spec.WorkloadName
+	if jobName == "" {
+		return r.errorStatus(ctx, lightrunJavaAgent, withReason(reasonInvalidSpec, errors.New("unable to reconcile job: missing workloadName field")))
 	}
-	stsNamespacedObj := client.ObjectKey{
-		Name:      lightrunJavaAgent.Spec.WorkloadName,
+	jobNamespacedObj := client.ObjectKey{
+		Name:      jobName,
 		Namespace: namespace,
 	}
-	originalStatefulSet := &appsv1.StatefulSet{}
-	err = r.Get(ctx, stsNamespacedObj, originalStatefulSet)
+	originalJob := &batchv1.Job{}
+	err := r.Get(ctx, jobNamespacedObj, originalJob)
 	if err != nil {
-		// StatefulSet not found
-		if client.IgnoreNotFound(err) == nil {
-			log.Info("StatefulSet not found. Verify name/namespace", "StatefulSet", lightrunJavaAgent.Spec.WorkloadName)
-			// remove our finalizer from the list and update it.
+		if client.IgnoreNotFound(err) != nil {
+			log.Error(err, "unable to fetch job")
+			return r.errorStatus(ctx, lightrunJavaAgent, err)
+		}
+		if !lightrunJavaAgent.ObjectMeta.DeletionTimestamp.IsZero() {
+			// Nothing to restore
+			log.Info("Removing finalizer")
 			err = r.removeFinalizer(ctx, lightrunJavaAgent, finalizerName)
 			if err != nil {
 				return r.errorStatus(ctx, lightrunJavaAgent, err)
 			}
-			return r.errorStatus(ctx, lightrunJavaAgent, errors.New("statefulset not found: "+statefulSetName))
-		} else {
-			log.Error(err, "unable to fetch statefulset")
-			return r.errorStatus(ctx, lightrunJavaAgent, err)
+			return r.progressingStatus(ctx, lightrunJavaAgent, reasonDeleting)
 		}
+		// Job will be patched as soon as it is created
+		log.Info("Job not found. Waiting for it to be created", "Job", jobName)
+		setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionWorkloadFound, metav1.ConditionFalse, reasonWorkloadNotFound, "job not found: "+jobName)
+		return r.progressingStatus(ctx, lightrunJavaAgent, reasonWaitingForWorkload)
 	}
 
+	setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionWorkloadFound, metav1.ConditionTrue, reasonWorkloadFound, "")
+
 	// Check if this LightrunJavaAgent is being deleted
 	if !lightrunJavaAgent.ObjectMeta.DeletionTimestamp.IsZero() {
-		// The object is being deleted
 		if containsString(lightrunJavaAgent.ObjectMeta.Finalizers, finalizerName) {
-			// our finalizer is present, so lets handle any cleanup operations
-
-			// Restore original StatefulSet (unpatch)
-			// Volume and init container
-			log.Info("Unpatching StatefulSet", "StatefulSet", lightrunJavaAgent.Spec.WorkloadName)
-
-			originalStatefulSet = &appsv1.StatefulSet{}
-			err = r.Get(ctx, stsNamespacedObj, originalStatefulSet)
-			if err != nil {
-				if client.IgnoreNotFound(err) == nil {
-					log.Info("StatefulSet not found", "StatefulSet", lightrunJavaAgent.Spec.WorkloadName)
-					// remove our finalizer from the list and update it.
-					log.Info("Removing finalizer")
-					err = r.removeFinalizer(ctx, lightrunJavaAgent, finalizerName)
-					if err != nil {
-						return r.errorStatus(ctx, lightrunJavaAgent, err)
-					}
-					// Successfully removed finalizer and nothing to restore
-					return r.successStatus(ctx, lightrunJavaAgent, reconcileTypeReady)
-				}
-				log.Error(err, "unable to unpatch statefulset", "StatefulSet", lightrunJavaAgent.Spec.WorkloadName)
-				return r.errorStatus(ctx, lightrunJavaAgent, err)
-			}
-
-			// Revert environment variable modifications
-			clientSidePatch := client.MergeFrom(originalStatefulSet.DeepCopy())
-			for i, container := range originalStatefulSet.Spec.Template.Spec.Containers {
-				for _, targetContainer := range lightrunJavaAgent.Spec.ContainerSelector {
-					if targetContainer == container.Name {
-						r.unpatchJavaToolEnv(originalStatefulSet.Annotations, &originalStatefulSet.Spec.Template.Spec.Containers[i])
-					}
+			// Pod template can't be restored. Pods of the Job keep the agent until the Job is finished
+			if originalJob.Annotations[annotationAgentName] == lightrunJavaAgent.Name {
+				log.Info("Removing annotations from Job", "Job", jobName)
+				clientSidePatch := client.MergeFrom(originalJob.DeepCopy())
+				delete(originalJob.Annotations, annotationPatchedEnvName)
+				delete(originalJob.Annotations, annotationPatchedEnvValue)
+				delete(originalJob.Annotations, annotationAgentName)
+				err = r.Patch(ctx, originalJob, clientSidePatch)
+				if err != nil {
+					log.Error(err, "failed to remove annotations from job")
+					return r.errorStatus(ctx, lightrunJavaAgent, err)
 				}
 			}
-			delete(originalStatefulSet.Annotations, annotationPatchedEnvName)
-			delete(originalStatefulSet.Annotations, annotationPatchedEnvValue)
-			delete(originalStatefulSet.Annotations, annotationAgentName)
-			err = r.Patch(ctx, originalStatefulSet, clientSidePatch)
-			if err != nil {
-				log.Error(err, "failed to unpatch statefulset environment variables")
-				return r.errorStatus(ctx, lightrunJavaAgent, err)
-			}
 
-			// Remove Volumes and init container
-			emptyApplyConfig := appsv1ac.StatefulSet(stsNamespacedObj.Name, stsNamespacedObj.Namespace)
-			obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(emptyApplyConfig)
-			if err != nil {
-				log.Error(err, "failed to convert StatefulSet to unstructured")
-				return r.errorStatus(ctx, lightrunJavaAgent, err)
-			}
-			patch := &unstructured.Unstructured{
-				Object: obj,
-			}
-			err = r.Patch(ctx, patch, client.Apply, &client.PatchOptions{
-				FieldManager: fieldManager,
-				Force:        pointer.Bool(true),
-			})
-			if err != nil {
-				log.Error(err, "failed to unpatch statefulset")
-				return r.errorStatus(ctx, lightrunJavaAgent, err)
-			}
-
-			// remove our finalizer from the list and update it.
 			log.Info("Removing finalizer")
 			err = r.removeFinalizer(ctx, lightrunJavaAgent, finalizerName)
 			if err != nil {
 				return r.errorStatus(ctx, lightrunJavaAgent, err)
 			}
-
-			log.Info("StatefulSet returned to original state", "StatefulSet", lightrunJavaAgent.Spec.WorkloadName)
-			return r.successStatus(ctx, lightrunJavaAgent, reconcileTypeProgressing)
+			return r.progressingStatus(ctx, lightrunJavaAgent, reasonDeleting)
 		}
 		// Nothing to do here
-		return r.successStatus(ctx, lightrunJavaAgent, reconcileTypeProgressing)
+		return r.progressingStatus(ctx, lightrunJavaAgent, reasonDeleting)
 	}
 
 	// Check if already patched by another LightrunJavaAgent
-	if oldLrjaName, ok := originalStatefulSet.Annotations[annotationAgentName]; ok && oldLrjaName != lightrunJavaAgent.Name {
-		log.Error(err, "StatefulSet already patched by LightrunJavaAgent", "Existing LightrunJavaAgent", oldLrjaName)
-		return r.errorStatus(ctx, lightrunJavaAgent, errors.New("statefulset :"+statefulSetName+" already patched"))
+	oldLrjaName, alreadyPatched := originalJob.Annotations[annotationAgentName]
+	if alreadyPatched && oldLrjaName != lightrunJavaAgent.Name {
+		log.Error(err, "Job already patched by LightrunJavaAgent", "Existing LightrunJavaAgent", oldLrjaName)
+		err = withReason(reasonWorkloadAlreadyPatched, errors.New("job already patched: "+jobName+" by LightrunJavaAgent "+oldLrjaName))
+		r.recordWorkloadError(lightrunJavaAgent, originalJob, err)
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
 
-	// Add finalizer if not already present
-	if !containsString(lightrunJavaAgent.ObjectMeta.Finalizers, finalizerName) {
-		log.V(2).Info("Adding finalizer")
-		err = r.addFinalizer(ctx, lightrunJavaAgent, finalizerName)
-		if err != nil {
-			log.Error(err, "unable to add finalizer")
-			return r.errorStatus(ctx, lightrunJavaAgent, err)
-		}
+	// Only a Job that didn't start any pods yet can be recreated
+	if !alreadyPatched && !isJobRecreatable(originalJob, lightrunJavaAgent) {
+		log.Info("Job can't be patched, pod template is immutable", "Job", jobName)
+		err = withReason(reasonJobImmutable, errors.New("job pod template is immutable, only Jobs created suspended after the LightrunJavaAgent can be patched: "+jobName))
+		r.recordWorkloadError(lightrunJavaAgent, originalJob, err)
+		lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{{
+			Kind:    agentv1beta.WorkloadTypeJob,
+			Name:    jobName,
+			UID:     originalJob.UID,
+			Status:  workloadStatusSkipped,
+			Message: err.Error(),
+		}}
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
 
-	// Get the secret
-	secretObj := client.ObjectKey{
-		Name:      lightrunJavaAgent.Spec.SecretName,
-		Namespace: namespace,
-	}
-	secret = &corev1.Secret{}
-	err = r.Get(ctx, secretObj, secret)
+	secret, agentArg, cmDataHash, err := r.prepareAgent(ctx, lightrunJavaAgent, namespace)
 	if err != nil {
-		log.Error(err, "unable to fetch Secret", "Secret", lightrunJavaAgent.Spec.SecretName)
 		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
 
-	// Verify that env var won't exceed 1024 chars
-	agentArg, err := agentEnvVarArgument(lightrunJavaAgent.Spec.InitContainer.SharedVolumeMountPath, lightrunJavaAgent.Spec.AgentCliFlags)
-	if err != nil {
-		log.Error(err, "agentEnvVarArgument exceeds 1024 chars")
-		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	if alreadyPatched {
+		if lightrunJavaAgent.Spec.DryRun {
+			// Pod template of the patched Job is immutable, nothing will be changed
+			status := r.dryRunWorkloadStatus(lightrunJavaAgent, jobAdapter{}, originalJob, cmDataHash, &agentv1beta.WorkloadPatchPreview{})
+			lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{status}
+			return r.dryRunStatus(ctx, lightrunJavaAgent)
+		}
+		lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{r.workloadStatus(lightrunJavaAgent, jobAdapter{}, originalJob, cmDataHash)}
+		// Config changes will be picked up only by the pods that are not started yet
+		log.V(1).Info("Reconciling finished successfully", "Job", jobName, "LightunrJavaAgent", lightrunJavaAgent.Name)
+		return r.successStatus(ctx, lightrunJavaAgent)
 	}
 
-	// Create config map
-	log.V(2).Info("Reconciling config map with agent configuration")
-	configMap, err := r.createAgentConfig(lightrunJavaAgent)
+	log.V(2).Info("Preparing patched Job", "Job", jobName, "LightunrJavaAgent", lightrunJavaAgent.Name)
+	err = checkGitOpsEnvVar(lightrunJavaAgent, &originalJob.Spec.Template)
 	if err != nil {
-		log.Error(err, "unable to create configMap")
 		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
-	applyOpts := []client.PatchOption{client.ForceOwnership, client.FieldOwner("lightrun-controller")}
-
-	err = r.Patch(ctx, &configMap, client.Apply, applyOpts...)
+	annotations := map[string]string{annotationAgentName: lightrunJavaAgent.Name}
+	addGitOpsAnnotations(lightrunJavaAgent, originalJob.Annotations, annotations)
+	templateApplyConfig, err := r.patchPodTemplate(lightrunJavaAgent, secret, &originalJob.Spec.Template, cmDataHash)
 	if err != nil {
-		log.Error(err, "unable to apply configMap")
+		log.Error(err, "failed to patch job")
+		r.recordWorkloadError(lightrunJavaAgent, originalJob, err)
 		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
-
-	// Calculate ConfigMap data hash
-	cmDataHash := configMapDataHash(configMap.Data)
-
-	// Extract StatefulSet for applying changes
-	statefulSetApplyConfig, err := appsv1ac.ExtractStatefulSet(originalStatefulSet, fieldManager)
+	injected, err := podTemplateFromApplyConfig(templateApplyConfig)
 	if err != nil {
-		log.Error(err, "failed to extract StatefulSet")
+		log.Error(err, "failed to build patched job")
 		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
-
-	// Server side apply for StatefulSet changes
-	log.V(2).Info("Patching StatefulSet", "StatefulSet", lightrunJavaAgent.Spec.WorkloadName, "LightunrJavaAgent", lightrunJavaAgent.Name)
-	err = r.patchStatefulSet(lightrunJavaAgent, secret, originalStatefulSet, statefulSetApplyConfig, cmDataHash)
+	patchedJob := recreatedJob(originalJob, annotations, injected)
+	err = r.patchContainersEnv(lightrunJavaAgent, &patchedJob.Spec.Template, patchedJob.Annotations, agentArg)
 	if err != nil {
-		log.Error(err, "failed to patch statefulset")
+		log.Error(err, "failed to patch "+agentEnvVarName(lightrunJavaAgent))
 		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
+	patchedJob.Annotations[annotationPatchedEnvName] = agentEnvVarName(lightrunJavaAgent)
+	patchedJob.Annotations[annotationPatchedEnvValue] = agentArg
 
-	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(statefulSetApplyConfig)
+	// Validate patched Job before deleting the original one
+	dryRunJob := patchedJob.DeepCopy()
+	dryRunJob.Name = ""
+	dryRunJob.GenerateName = jobName + "-"
+	err = r.Create(ctx, dryRunJob, client.DryRunAll)
 	if err != nil {
-		log.Error(err, "failed to convert StatefulSet to unstructured")
+		log.Error(err, "patched job is not valid")
 		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
-	patch := &unstructured.Unstructured{
-		Object: obj,
-	}
-	err = r.Patch(ctx, patch, client.Apply, &client.PatchOptions{
-		FieldManager: fieldManager,
-		Force:        pointer.Bool(true),
-	})
-	if err != nil {
-		log.Error(err, "failed to patch statefulset")
-		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	if lightrunJavaAgent.Spec.DryRun {
+		status := r.dryRunWorkloadStatus(lightrunJavaAgent, jobAdapter{}, originalJob, cmDataHash, templatePreview(lightrunJavaAgent, &originalJob.Spec.Template, &dryRunJob.Spec.Template))
+		lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{status}
+		log.V(1).Info("Dry run finished successfully", "Job", jobName)
+		return r.dryRunStatus(ctx, lightrunJavaAgent)
 	}
 
-	// Client side patch (we can't rollback JAVA_TOOL_OPTIONS env with server side apply)
-	log.V(2).Info("Patching Java Env", "StatefulSet", lightrunJavaAgent.Spec.WorkloadName, "LightunrJavaAgent", lightrunJavaAgent.Name)
-	originalStatefulSet = &appsv1.StatefulSet{}
-	err = r.Get(ctx, stsNamespacedObj, originalStatefulSet)
+	log.Info("Recreating Job with the agent", "Job", jobName)
+	recreateStart := time.Now()
+	err = r.Delete(ctx, originalJob, client.Preconditions{UID: &originalJob.UID}, client.PropagationPolicy(metav1.DeletePropagationBackground))
 	if err != nil {
-		if client.IgnoreNotFound(err) == nil {
-			log.Info("StatefulSet not found", "StatefulSet", lightrunJavaAgent.Spec.WorkloadName)
-			err = r.removeFinalizer(ctx, lightrunJavaAgent, finalizerName)
-			if err != nil {
-				return r.errorStatus(ctx, lightrunJavaAgent, err)
-			}
-			return r.errorStatus(ctx, lightrunJavaAgent, errors.New("statefulset not found"))
-		}
+		log.Error(err, "failed to delete original job")
 		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
-	clientSidePatch := client.MergeFrom(originalStatefulSet.DeepCopy())
-	for i, container := range originalStatefulSet.Spec.Template.Spec.Containers {
-		for _, targetContainer := range lightrunJavaAgent.Spec.ContainerSelector {
-			if targetContainer == container.Name {
-				err = r.patchJavaToolEnv(originalStatefulSet.Annotations, &originalStatefulSet.Spec.Template.Spec.Containers[i], lightrunJavaAgent.Spec.AgentEnvVarName, agentArg)
-				if err != nil {
-					log.Error(err, "failed to patch "+lightrunJavaAgent.Spec.AgentEnvVarName)
-					return r.errorStatus(ctx, lightrunJavaAgent, err)
-				}
-			}
+	var createdJob *batchv1.Job
+	err = wait.PollUntilContextTimeout(ctx, time.Second, jobRecreateTimeout, true, func(ctx context.Context) (bool, error) {
+		createdJob = patchedJob.DeepCopy()
+		err := r.Create(ctx, createdJob, client.FieldOwner(fieldManager))
+		if apierrors.IsAlreadyExists(err) {
+			// Original Job is still being deleted
+			return false, nil
 		}
-	}
-	originalStatefulSet.Annotations[annotationPatchedEnvName] = lightrunJavaAgent.Spec.AgentEnvVarName
-	originalStatefulSet.Annotations[annotationPatchedEnvValue] = agentArg
-	err = r.Patch(ctx, originalStatefulSet, clientSidePatch)
+		return err == nil, err
+	})
+	observeWorkloadOperation(agentv1beta.WorkloadTypeJob, operationPatch, recreateStart, err)
 	if err != nil {
-		log.Error(err, "failed to patch "+lightrunJavaAgent.Spec.AgentEnvVarName)
+		log.Error(err, "failed to recreate job")
 		return r.errorStatus(ctx, lightrunJavaAgent, err)
 	}
+	r.recordPatchEvent(lightrunJavaAgent, jobAdapter{}, createdJob, false)
+	lightrunJavaAgent.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{r.workloadStatus(lightrunJavaAgent, jobAdapter{}, createdJob, cmDataHash)}
 
 	// Update status to Healthy
-	log.V(1).Info("Reconciling finished successfully", "StatefulSet", lightrunJavaAgent.Spec.WorkloadName, "LightunrJavaAgent", lightrunJavaAgent.Name)
-	return r.successStatus(ctx, lightrunJavaAgent, reconcileTypeReady)
+	log.V(1).Info("Reconciling finished successfully", "Job", jobName, "LightunrJavaAgent", lightrunJavaAgent.Name)
+	return r.successStatus(ctx, lightrunJavaAgent)
 }
 
 // SetupWithManager configures the controller with the Manager and sets up watches and indexers.
 // It creates several field indexers to enable efficient lookups of LightrunJavaAgent CRs based on:
-// - WorkloadName
+// - WorkloadType and WorkloadName
+// - WorkloadSelector
 // - SecretName
 //
-// It also sets up watches for Deployments, StatefulSets, and Secrets so the controller can
+// It also sets up watches for every workload kind with a workloadAdapter and for Secrets so the controller can
 // react to changes in these resources that are referenced by LightrunJavaAgent CRs.
+// Argo Rollouts are watched only if the Rollout CRD is installed in the cluster when the operator starts.
 func (r *LightrunJavaAgentReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	// Index field for workloads by name - allows looking up LightrunJavaAgents by WorkloadName
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor(fieldManager)
+	}
+	agentState.setClient(mgr.GetClient(), r.Log)
+
+	// Index field for workloads by type and name - allows looking up LightrunJavaAgents by WorkloadType and WorkloadName
+	err := mgr.GetFieldIndexer().IndexField(
+		context.Background(),
+		&agentv1beta.LightrunJavaAgent{},
+		workloadIndexField,
+		indexAgentWorkload)
+	if err != nil {
+		return err
+	}
+
+	// Index field for agents using workloadSelector - they are matched against every workload of their kinds
 	err = mgr.GetFieldIndexer().IndexField(
 		context.Background(),
 		&agentv1beta.LightrunJavaAgent{},
-		workloadNameIndexField,
-		func(object client.Object) []string {
-			agent := object.(*agentv1beta.LightrunJavaAgent)
-			if agent.Spec.WorkloadName == "" {
-				return nil
-			}
-			r.Log.Info("Indexing WorkloadName", "WorkloadName", agent.Spec.WorkloadName)
-			return []string{agent.Spec.WorkloadName}
-		})
+		selectorIndexField,
+		indexAgentSelector)
 	if err != nil {
 		return err
 	}
@@ -606,22 +1180,33 @@ func (r *LightrunJavaAgentReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	// Configure the controller builder:
 	// - For: register LightrunJavaAgent as the primary resource this controller reconciles
 	// - Watches: set up event handlers to watch for changes in related resources:
-	//   * Deployments: reconcile LightrunJavaAgents when their target Deployment changes
-	//   * StatefulSets: reconcile LightrunJavaAgents when their target StatefulSet changes
+	//   * Workloads of every supported kind: reconcile LightrunJavaAgents when their target workload changes
+	//     (Argo Rollouts are watched only if Argo Rollouts is installed)
 	//   * Secrets: reconcile LightrunJavaAgents when their referenced Secret changes
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&agentv1beta.LightrunJavaAgent{}).
-		Watches(
-			&appsv1.Deployment{},
-			handler.EnqueueRequestsFromMapFunc(r.mapDeploymentToAgent),
-		).
-		Watches(
-			&appsv1.StatefulSet{},
-			handler.EnqueueRequestsFromMapFunc(r.mapStatefulSetToAgent),
-		).
+	builder := ctrl.NewControllerManagedBy(mgr).
+		For(&agentv1beta.LightrunJavaAgent{})
+
+	for _, adapter := range workloadAdapters(nil) {
+		if adapter.kind() == agentv1beta.WorkloadTypeRollout {
+			_, err = mgr.GetRESTMapper().RESTMapping(rolloutGVK.GroupKind(), rolloutGVK.Version)
+			if meta.IsNoMatchError(err) {
+				r.Log.Info("Argo Rollout CRD not found, Rollout workloads will not be watched")
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		builder = builder.Watches(
+			adapter.newObject(),
+			handler.EnqueueRequestsFromMapFunc(r.mapWorkloadToAgent(adapter.kind())),
+		)
+	}
+
+	return builder.
 		Watches(
 			&corev1.Secret{},
-			handler.EnqueueRequestsFromMapFunc(r.mapSecretToAgent),
+			r.secretEventHandler(),
 		).
 		Complete(r)
 }
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -10,9 +11,11 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -23,6 +26,9 @@ var _ = Describe("LightrunJavaAgent controller", func() {
 		lragent1Name         = "lragent"
 		deployment           = "app-deployment"
 		statefulset          = "app-statefulset"
+		daemonset            = "app-daemonset"
+		cronjob              = "app-cronjob"
+		job                  = "app-job"
 		secretName           = "agent-secret"
 		server               = "example.lightrun.com"
 		agentName            = "coolio-agent"
@@ -123,6 +129,42 @@ var _ = Describe("LightrunJavaAgent controller", func() {
 		Namespace: testNamespace,
 	}
 
+	var patchedDs appsv1.DaemonSet
+	dsRequest := types.NamespacedName{
+		Name:      daemonset,
+		Namespace: testNamespace,
+	}
+
+	var lrAgentDs agentsv1beta.LightrunJavaAgent
+	lrAgentDsRequest := types.NamespacedName{
+		Name:      "lragent-ds",
+		Namespace: testNamespace,
+	}
+
+	var patchedCronJob batchv1.CronJob
+	cronJobRequest := types.NamespacedName{
+		Name:      cronjob,
+		Namespace: testNamespace,
+	}
+
+	var lrAgentCronJob agentsv1beta.LightrunJavaAgent
+	lrAgentCronJobRequest := types.NamespacedName{
+		Name:      "lragent-cronjob",
+		Namespace: testNamespace,
+	}
+
+	var patchedJob batchv1.Job
+	jobRequest := types.NamespacedName{
+		Name:      job,
+		Namespace: testNamespace,
+	}
+
+	var lrAgentJob agentsv1beta.LightrunJavaAgent
+	lrAgentJobRequest := types.NamespacedName{
+		Name:      "lragent-job",
+		Namespace: testNamespace,
+	}
+
 	ctx := context.Background()
 	Context("When setting up the test environment", func() {
 		It("Should create a test Namespace", func() {
@@ -1000,7 +1042,7 @@ var _ = Describe("LightrunJavaAgent controller", func() {
 						Expect(err).ShouldNot(HaveOccurred())
 					}
 					lrAgent5.Spec.AgentCliFlags = "--new-flags"
-					err = k8sClient.Update(ctx, &lrAgent5)
+					err := k8sClient.Update(ctx, &lrAgent5)
 					return err == nil
 				}).Should(BeTrue())
 
@@ -1245,4 +1287,474 @@ var _ = Describe("LightrunJavaAgent controller", func() {
 			}, timeout, interval).Should(BeTrue())
 		})
 	})
+
+	Context("When patching DaemonSet matched by CRD", func() {
+		It("Should create DaemonSet and LightrunJavaAgent", func() {
+			By("Creating DaemonSet")
+			ds := appsv1.DaemonSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      daemonset,
+					Namespace: testNamespace,
+				},
+				Spec: appsv1.DaemonSetSpec{
+					Selector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"app": "daemon-app"},
+					},
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: map[string]string{"app": "daemon-app"},
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{
+									Name:  "app",
+									Image: "busybox",
+								},
+								{
+									Name:  "app2",
+									Image: "busybox",
+									Env: []corev1.EnvVar{
+										{
+											Name:  javaEnv,
+											Value: javaEnvNonEmptyValue,
+										},
+									},
+								},
+								{
+									Name:  "no-patch",
+									Image: "busybox",
+								},
+							},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, &ds)).Should(Succeed())
+
+			By("Creating a DaemonSet-targeting LightrunJavaAgent resource")
+			lrAgentDs := agentsv1beta.LightrunJavaAgent{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      lrAgentDsRequest.Name,
+					Namespace: testNamespace,
+				},
+				Spec: agentsv1beta.LightrunJavaAgentSpec{
+					WorkloadName:      daemonset,
+					WorkloadType:      agentsv1beta.WorkloadTypeDaemonSet,
+					SecretName:        secretName,
+					ServerHostname:    server,
+					AgentName:         agentName,
+					AgentTags:         agentTags,
+					AgentConfig:       agentConfig,
+					AgentCliFlags:     agentCliFlags,
+					AgentEnvVarName:   javaEnv,
+					ContainerSelector: containerSelector,
+					InitContainer: agentsv1beta.InitContainer{
+						Image:                 initContainerImage,
+						SharedVolumeName:      initVolumeName,
+						SharedVolumeMountPath: "/lightrun",
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, &lrAgentDs)).Should(Succeed())
+		})
+
+		It("Should add init Container to DaemonSet", func() {
+			Eventually(func() bool {
+				if err := k8sClient.Get(ctx, dsRequest, &patchedDs); err != nil {
+					return false
+				}
+				return len(patchedDs.Spec.Template.Spec.InitContainers) == 1 &&
+					patchedDs.Spec.Template.Spec.InitContainers[0].Name == initContainerName
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("Should add volumes to DaemonSet", func() {
+			Eventually(func() bool {
+				if err := k8sClient.Get(ctx, dsRequest, &patchedDs); err != nil {
+					return false
+				}
+				// 3 volumes: shared init volume, configmap volume, and secret volume (useSecretsAsMountedFiles defaults to true)
+				return len(patchedDs.Spec.Template.Spec.Volumes) == 3 &&
+					patchedDs.Spec.Template.Spec.Volumes[0].Name == initVolumeName
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("Should patch DaemonSet environment variables", func() {
+			Eventually(func() bool {
+				if err := k8sClient.Get(ctx, dsRequest, &patchedDs); err != nil {
+					return false
+				}
+				for _, c := range patchedDs.Spec.Template.Spec.Containers {
+					if c.Name == "app2" {
+						for _, e := range c.Env {
+							if e.Name == javaEnv && strings.Contains(e.Value, defaultAgentPath) && strings.Contains(e.Value, javaEnvNonEmptyValue) {
+								return true
+							}
+						}
+					}
+				}
+				return false
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("Should not patch container that not mentioned in CRD", func() {
+			Expect(k8sClient.Get(ctx, dsRequest, &patchedDs)).Should(Succeed())
+			for _, c := range patchedDs.Spec.Template.Spec.Containers {
+				if c.Name == "no-patch" {
+					Expect(c.Env).Should(BeEmpty())
+					Expect(c.VolumeMounts).Should(BeEmpty())
+				}
+			}
+		})
+
+		It("Should add annotations to DaemonSet", func() {
+			Eventually(func() bool {
+				if err := k8sClient.Get(ctx, dsRequest, &patchedDs); err != nil {
+					return false
+				}
+				return patchedDs.Annotations[annotationAgentName] == lrAgentDsRequest.Name &&
+					patchedDs.Spec.Template.Annotations[annotationConfigMapHash] != ""
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Context("When deleting LightrunJavaAgent for DaemonSet", func() {
+		It("Should remove the finalizer from DaemonSet-targeting LightrunJavaAgent", func() {
+			Expect(k8sClient.Get(ctx, lrAgentDsRequest, &lrAgentDs)).Should(Succeed())
+			Expect(k8sClient.Delete(ctx, &lrAgentDs)).Should(Succeed())
+
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, lrAgentDsRequest, &lrAgentDs)
+				if err != nil {
+					return client.IgnoreNotFound(err) == nil
+				}
+				return len(lrAgentDs.Finalizers) == 0
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("Should restore DaemonSet to original state", func() {
+			Eventually(func() bool {
+				if err := k8sClient.Get(ctx, dsRequest, &patchedDs); err != nil {
+					return false
+				}
+				if len(patchedDs.Spec.Template.Spec.InitContainers) != 0 || len(patchedDs.Spec.Template.Spec.Volumes) != 0 {
+					return false
+				}
+				if _, ok := patchedDs.Annotations[annotationAgentName]; ok {
+					return false
+				}
+				for _, c := range patchedDs.Spec.Template.Spec.Containers {
+					if c.Name == "app2" {
+						if len(c.Env) != 1 || c.Env[0].Value != javaEnvNonEmptyValue {
+							return false
+						}
+					}
+				}
+				return true
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Context("When patching CronJob matched by CRD", func() {
+		It("Should create CronJob and LightrunJavaAgent", func() {
+			By("Creating CronJob")
+			cj := batchv1.CronJob{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      cronjob,
+					Namespace: testNamespace,
+				},
+				Spec: batchv1.CronJobSpec{
+					Schedule: "0 0 * * *",
+					JobTemplate: batchv1.JobTemplateSpec{
+						Spec: batchv1.JobSpec{
+							Template: corev1.PodTemplateSpec{
+								Spec: corev1.PodSpec{
+									RestartPolicy: corev1.RestartPolicyNever,
+									Containers: []corev1.Container{
+										{
+											Name:  "app",
+											Image: "busybox",
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, &cj)).Should(Succeed())
+
+			By("Creating a CronJob-targeting LightrunJavaAgent resource")
+			lrAgentCronJob := agentsv1beta.LightrunJavaAgent{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      lrAgentCronJobRequest.Name,
+					Namespace: testNamespace,
+				},
+				Spec: agentsv1beta.LightrunJavaAgentSpec{
+					WorkloadName:      cronjob,
+					WorkloadType:      agentsv1beta.WorkloadTypeCronJob,
+					SecretName:        secretName,
+					ServerHostname:    server,
+					AgentTags:         agentTags,
+					AgentEnvVarName:   javaEnv,
+					ContainerSelector: containerSelector,
+					InitContainer: agentsv1beta.InitContainer{
+						Image:                 initContainerImage,
+						SharedVolumeName:      initVolumeName,
+						SharedVolumeMountPath: "/lightrun",
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, &lrAgentCronJob)).Should(Succeed())
+		})
+
+		It("Should patch Job template of the CronJob", func() {
+			Eventually(func() bool {
+				if err := k8sClient.Get(ctx, cronJobRequest, &patchedCronJob); err != nil {
+					return false
+				}
+				podSpec := patchedCronJob.Spec.JobTemplate.Spec.Template.Spec
+				if len(podSpec.InitContainers) != 1 || len(podSpec.Volumes) != 3 {
+					return false
+				}
+				for _, e := range podSpec.Containers[0].Env {
+					if e.Name == javaEnv && e.Value == defaultAgentPath {
+						return patchedCronJob.Annotations[annotationAgentName] == lrAgentCronJobRequest.Name
+					}
+				}
+				return false
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("Should restore CronJob when LightrunJavaAgent is deleted", func() {
+			Expect(k8sClient.Get(ctx, lrAgentCronJobRequest, &lrAgentCronJob)).Should(Succeed())
+			Expect(k8sClient.Delete(ctx, &lrAgentCronJob)).Should(Succeed())
+
+			Eventually(func() bool {
+				if err := k8sClient.Get(ctx, cronJobRequest, &patchedCronJob); err != nil {
+					return false
+				}
+				podSpec := patchedCronJob.Spec.JobTemplate.Spec.Template.Spec
+				_, hasAnnotation := patchedCronJob.Annotations[annotationAgentName]
+				return len(podSpec.InitContainers) == 0 && len(podSpec.Volumes) == 0 && len(podSpec.Containers[0].Env) == 0 && !hasAnnotation
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Context("When patching Job matched by CRD", func() {
+		It("Should create LightrunJavaAgent before the Job", func() {
+			lrAgentJob := agentsv1beta.LightrunJavaAgent{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      lrAgentJobRequest.Name,
+					Namespace: testNamespace,
+				},
+				Spec: agentsv1beta.LightrunJavaAgentSpec{
+					WorkloadName:      job,
+					WorkloadType:      agentsv1beta.WorkloadTypeJob,
+					SecretName:        secretName,
+					ServerHostname:    server,
+					AgentTags:         agentTags,
+					AgentEnvVarName:   javaEnv,
+					ContainerSelector: containerSelector,
+					InitContainer: agentsv1beta.InitContainer{
+						Image:                 initContainerImage,
+						SharedVolumeName:      initVolumeName,
+						SharedVolumeMountPath: "/lightrun",
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, &lrAgentJob)).Should(Succeed())
+
+			Eventually(func() bool {
+				if err := k8sClient.Get(ctx, lrAgentJobRequest, &lrAgentJob); err != nil {
+					return false
+				}
+				return lrAgentJob.Status.WorkloadStatus == reconcileTypeProgressing
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("Should create suspended Job", func() {
+			// Make sure Job is created strictly after the CR, creation timestamps have seconds precision
+			time.Sleep(time.Second)
+			j := batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      job,
+					Namespace: testNamespace,
+				},
+				Spec: batchv1.JobSpec{
+					Suspend: pointer.Bool(true),
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							RestartPolicy: corev1.RestartPolicyNever,
+							Containers: []corev1.Container{
+								{
+									Name:  "app",
+									Image: "busybox",
+								},
+							},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, &j)).Should(Succeed())
+		})
+
+		It("Should recreate the Job with the agent and resume it", func() {
+			Eventually(func() bool {
+				if err := k8sClient.Get(ctx, jobRequest, &patchedJob); err != nil {
+					return false
+				}
+				podSpec := patchedJob.Spec.Template.Spec
+				if len(podSpec.InitContainers) != 1 || len(podSpec.Containers[0].VolumeMounts) != 1 {
+					return false
+				}
+				if patchedJob.Spec.Suspend == nil || *patchedJob.Spec.Suspend {
+					return false
+				}
+				return patchedJob.Annotations[annotationAgentName] == lrAgentJobRequest.Name &&
+					patchedJob.Annotations[annotationPatchedEnvValue] == defaultAgentPath
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("Should remove finalizer and annotations when LightrunJavaAgent is deleted", func() {
+			Expect(k8sClient.Get(ctx, lrAgentJobRequest, &lrAgentJob)).Should(Succeed())
+			Expect(k8sClient.Delete(ctx, &lrAgentJob)).Should(Succeed())
+
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, lrAgentJobRequest, &lrAgentJob)
+				return client.IgnoreNotFound(err) == nil && err != nil
+			}, timeout, interval).Should(BeTrue())
+			Eventually(func() bool {
+				if err := k8sClient.Get(ctx, jobRequest, &patchedJob); err != nil {
+					return false
+				}
+				_, hasAnnotation := patchedJob.Annotations[annotationAgentName]
+				return !hasAnnotation
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Context("When patching Deployment in GitOps compatibility mode", func() {
+		const gitOpsManager = "argocd-controller"
+		const gitOpsEnv = "LIGHTRUN_AGENT_OPTS"
+		gitOpsDeplRequest := types.NamespacedName{
+			Name:      deployment + "-gitops",
+			Namespace: testNamespace,
+		}
+		gitOpsJavaEnv := corev1.EnvVar{Name: javaEnv, Value: "-Xmx1g $(" + gitOpsEnv + ")"}
+		var gitOpsDepl appsv1.Deployment
+
+		It("Should apply Deployment from Git with the agent env var declared", func() {
+			depl := appsv1.Deployment{
+				TypeMeta: metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "Deployment"},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      gitOpsDeplRequest.Name,
+					Namespace: testNamespace,
+				},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"app": "app-gitops"},
+					},
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: map[string]string{"app": "app-gitops"},
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{
+									Name:  "app",
+									Image: "busybox",
+									Env:   []corev1.EnvVar{{Name: gitOpsEnv}, gitOpsJavaEnv},
+								},
+							},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Patch(ctx, &depl, client.Apply, client.FieldOwner(gitOpsManager))).Should(Succeed())
+
+			lrAgentGitOps := agentsv1beta.LightrunJavaAgent{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "lragent-gitops",
+					Namespace: testNamespace,
+				},
+				Spec: agentsv1beta.LightrunJavaAgentSpec{
+					WorkloadName:      gitOpsDeplRequest.Name,
+					WorkloadType:      agentsv1beta.WorkloadTypeDeployment,
+					SecretName:        secretName,
+					ServerHostname:    server,
+					AgentTags:         agentTags,
+					AgentEnvVarName:   javaEnv,
+					ContainerSelector: []string{"app"},
+					GitOpsCompatibility: &agentsv1beta.GitOpsCompatibility{
+						AgentEnvVarName: gitOpsEnv,
+					},
+					InitContainer: agentsv1beta.InitContainer{
+						Image:                 initContainerImage,
+						SharedVolumeName:      initVolumeName,
+						SharedVolumeMountPath: "/lightrun",
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, &lrAgentGitOps)).Should(Succeed())
+		})
+
+		It("Should set the agent env var in place of the declaration", func() {
+			Eventually(func() bool {
+				if err := k8sClient.Get(ctx, gitOpsDeplRequest, &gitOpsDepl); err != nil {
+					return false
+				}
+				env := gitOpsDepl.Spec.Template.Spec.Containers[0].Env
+				return len(env) == 2 && env[0].Name == gitOpsEnv && strings.HasPrefix(env[0].Value, defaultAgentPath) && env[1] == gitOpsJavaEnv
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("Should own only the agent env var value with the apply field manager", func() {
+			Expect(k8sClient.Get(ctx, gitOpsDeplRequest, &gitOpsDepl)).Should(Succeed())
+			Expect(envFieldOwners(gitOpsDepl.ManagedFields, "app", gitOpsEnv, "f:value")).Should(Equal([]string{fieldManager + "/" + string(metav1.ManagedFieldsOperationApply)}))
+			Expect(envFieldOwners(gitOpsDepl.ManagedFields, "app", javaEnv, "f:value")).Should(Equal([]string{gitOpsManager + "/" + string(metav1.ManagedFieldsOperationApply)}))
+			Expect(envFieldOwners(gitOpsDepl.ManagedFields, "app", javaEnv, "f:name")).ShouldNot(ContainElement(HavePrefix(fieldManager + "/")))
+		})
+
+		It("Should keep the declaration from Git after the LightrunJavaAgent is deleted", func() {
+			lrAgentGitOps := agentsv1beta.LightrunJavaAgent{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "lragent-gitops", Namespace: testNamespace}, &lrAgentGitOps)).Should(Succeed())
+			Expect(k8sClient.Delete(ctx, &lrAgentGitOps)).Should(Succeed())
+			Eventually(func() bool {
+				if err := k8sClient.Get(ctx, gitOpsDeplRequest, &gitOpsDepl); err != nil {
+					return false
+				}
+				env := gitOpsDepl.Spec.Template.Spec.Containers[0].Env
+				return len(env) == 2 && env[0] == corev1.EnvVar{Name: gitOpsEnv} && env[1] == gitOpsJavaEnv
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
 })
+
+// envFieldOwners returns the field managers with their operations that own the field of the env var of the container
+func envFieldOwners(managedFields []metav1.ManagedFieldsEntry, container, envVar, field string) []string {
+	path := []string{"f:spec", "f:template", "f:spec", "f:containers", `k:{"name":"` + container + `"}`, "f:env", `k:{"name":"` + envVar + `"}`, field}
+	var owners []string
+	for _, entry := range managedFields {
+		if entry.FieldsV1 == nil {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		found := true
+		for _, key := range path {
+			next, ok := fields[key].(map[string]interface{})
+			if !ok {
+				found = false
+				break
+			}
+			fields = next
+		}
+		if found {
+			owners = append(owners, entry.Manager+"/"+string(entry.Operation))
+		}
+	}
+	return owners
+}
@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+//+kubebuilder:webhook:path=/validate-agents-lightrun-com-v1beta-lightrunjavaagent,mutating=false,failurePolicy=fail,sideEffects=None,groups=agents.lightrun.com,resources=lightrunjavaagents,verbs=create;update,versions=v1beta,name=vlightrunjavaagent.agents.lightrun.com,admissionReviewVersions=v1
+
+// LightrunJavaAgentValidator rejects LightrunJavaAgents that would fail the reconciliation because of
+// misconfiguration, so the error is returned on apply instead of the ReconcileFailed condition
+type LightrunJavaAgentValidator struct {
+	Client client.Reader
+}
+
+// SetupWebhookWithManager registers the validating webhook of LightrunJavaAgent in the webhook server of the manager
+func (v *LightrunJavaAgentValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&agentv1beta.LightrunJavaAgent{}).
+		WithValidator(v).
+		Complete()
+}
+
+func (v *LightrunJavaAgentValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	lightrunJavaAgent, ok := obj.(*agentv1beta.LightrunJavaAgent)
+	if !ok {
+		return nil, fmt.Errorf("expected LightrunJavaAgent, got %T", obj)
+	}
+	return nil, v.validate(ctx, lightrunJavaAgent)
+}
+
+func (v *LightrunJavaAgentValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldAgent, ok := oldObj.(*agentv1beta.LightrunJavaAgent)
+	if !ok {
+		return nil, fmt.Errorf("expected LightrunJavaAgent, got %T", oldObj)
+	}
+	lightrunJavaAgent, ok := newObj.(*agentv1beta.LightrunJavaAgent)
+	if !ok {
+		return nil, fmt.Errorf("expected LightrunJavaAgent, got %T", newObj)
+	}
+	// Finalizer and label changes of the existing CRs, including the ones created before the webhook, are always allowed
+	if !lightrunJavaAgent.DeletionTimestamp.IsZero() || apiequality.Semantic.DeepEqual(oldAgent.Spec, lightrunJavaAgent.Spec) {
+		return nil, nil
+	}
+	return nil, v.validate(ctx, lightrunJavaAgent)
+}
+
+func (v *LightrunJavaAgentValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *LightrunJavaAgentValidator) validate(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent) error {
+	allErrs := validateLightrunJavaAgentSpec(&lightrunJavaAgent.Spec, field.NewPath("spec"))
+	if len(allErrs) == 0 {
+		targetErr, err := v.validateTarget(ctx, lightrunJavaAgent, field.NewPath("spec", "workloadName"))
+		if err != nil {
+			return apierrors.NewInternalError(err)
+		}
+		if targetErr != nil {
+			allErrs = append(allErrs, targetErr)
+		}
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(agentv1beta.GroupVersion.WithKind("LightrunJavaAgent").GroupKind(), lightrunJavaAgent.Name, allErrs)
+}
+
+// validateLightrunJavaAgentSpec returns the spec errors that don't depend on the cluster state
+func validateLightrunJavaAgentSpec(spec *agentv1beta.LightrunJavaAgentSpec, specPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	switch {
+	case spec.WorkloadSelector != nil && spec.WorkloadName != "":
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("workloadName"), "workloadName and workloadSelector can't be used together"))
+	case spec.WorkloadSelector == nil && spec.WorkloadName == "":
+		allErrs = append(allErrs, field.Required(specPath.Child("workloadName"), "workloadName and workloadType or workloadSelector must be set"))
+	case spec.WorkloadSelector == nil && spec.WorkloadType == "":
+		allErrs = append(allErrs, field.Required(specPath.Child("workloadType"), "workloadType must be set together with workloadName"))
+	}
+
+	if len(spec.ContainerSelector) == 0 {
+		allErrs = append(allErrs, field.Required(specPath.Child("containerSelector"), "at least one container has to be selected"))
+	}
+
+	if spec.DryRun && spec.InjectionMode == agentv1beta.InjectionModeWebhook {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("dryRun"), "dryRun can't be used with Webhook injection mode"))
+	}
+
+	if spec.GitOpsCompatibility != nil && spec.InjectionMode == agentv1beta.InjectionModeWebhook {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("gitOpsCompatibility"), "gitOpsCompatibility can't be used with Webhook injection mode"))
+	}
+
+	if spec.InitContainer.InjectionMode == agentv1beta.AgentInstallModeImageVolume && spec.InjectionMode == agentv1beta.InjectionModeWebhook {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("initContainer", "injectionMode"), "ImageVolume can't be used with Webhook injection mode"))
+	}
+
+	if backoff := spec.DriftBackoff; backoff != nil {
+		switch {
+		case backoff.Initial != nil && backoff.Initial.Duration <= 0:
+			allErrs = append(allErrs, field.Invalid(specPath.Child("driftBackoff", "initial"), backoff.Initial.Duration.String(), "must be positive"))
+		case backoff.Max != nil && backoff.Max.Duration <= 0:
+			allErrs = append(allErrs, field.Invalid(specPath.Child("driftBackoff", "max"), backoff.Max.Duration.String(), "must be positive"))
+		}
+	}
+
+	if err := validateCanary(spec); err != nil {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("canary"), err.Error()))
+	}
+
+	if err := validateExpiry(spec); err != nil {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("ttl"), spec.TTL.Duration.String(), err.Error()))
+	}
+
+	if spec.RolloutPolicy == agentv1beta.RolloutPolicyMaintenanceWindow {
+		if _, err := parseMaintenanceWindow(spec.MaintenanceWindow); err != nil {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("maintenanceWindow"), spec.MaintenanceWindow, err.Error()))
+		}
+	}
+
+	if spec.InitContainer.Sidecar && spec.InitContainer.InjectionMode == agentv1beta.AgentInstallModeImageVolume {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("initContainer", "sidecar"), "sidecar can't be used with ImageVolume injection mode"))
+	}
+
+	switch {
+	case spec.InitContainer.Image != "" && spec.InitContainer.AgentVersion != "":
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("initContainer", "agentVersion"), "image and agentVersion can't be used together"))
+	case spec.InitContainer.Image == "" && spec.InitContainer.AgentVersion == "":
+		allErrs = append(allErrs, field.Required(specPath.Child("initContainer", "image"), "image or agentVersion must be set"))
+	case spec.InitContainer.Image != "" && spec.InitContainer.AgentPlatform != "":
+		// Image is used as is, platform selects only the catalog image of agentVersion
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("initContainer", "agentPlatform"), "agentPlatform applies only to agentVersion, it can't be used with image"))
+	}
+
+	for i, envVar := range spec.InitContainer.Env {
+		if slices.Contains(reservedInitContainerEnv, envVar.Name) {
+			allErrs = append(allErrs, field.Forbidden(specPath.Child("initContainer", "env").Index(i).Child("name"), envVar.Name+" is set by the operator"))
+		}
+	}
+	if sc := spec.InitContainer.SecurityContext; sc != nil && sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("initContainer", "securityContext", "runAsUser"), *sc.RunAsUser, "init container must run as non-root user"))
+	}
+
+	mountPath := spec.InitContainer.SharedVolumeMountPath
+	if !path.IsAbs(mountPath) {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("initContainer", "sharedVolumeMountPath"), mountPath, "must be an absolute path"))
+	} else if _, err := agentEnvVarArgument(mountPath, spec.AgentCliFlags); err != nil {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("agentCliFlags"), spec.AgentCliFlags, err.Error()))
+	}
+	return allErrs
+}
+
+// validateTarget checks that the workload set by workloadName is not targeted by another LightrunJavaAgent.
+// Workloads matched by workloadSelector are checked during the reconciliation, as they may change after the apply
+func (v *LightrunJavaAgentValidator) validateTarget(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, fldPath *field.Path) (*field.Error, error) {
+	spec := lightrunJavaAgent.Spec
+	if spec.WorkloadSelector != nil {
+		return nil, nil
+	}
+
+	var agents agentv1beta.LightrunJavaAgentList
+	err := v.Client.List(ctx, &agents, client.InNamespace(lightrunJavaAgent.Namespace))
+	if err != nil {
+		return nil, err
+	}
+	for _, agent := range agents.Items {
+		if agent.Name != lightrunJavaAgent.Name && agent.Spec.WorkloadSelector == nil &&
+			agent.Spec.WorkloadType == spec.WorkloadType && agent.Spec.WorkloadName == spec.WorkloadName {
+			return field.Forbidden(fldPath, string(spec.WorkloadType)+" "+spec.WorkloadName+" is already targeted by LightrunJavaAgent "+agent.Name), nil
+		}
+	}
+
+	adapter, err := newWorkloadAdapter(spec.WorkloadType, lightrunJavaAgent)
+	if err != nil {
+		return field.Invalid(field.NewPath("spec", "workloadType"), spec.WorkloadType, err.Error()), nil
+	}
+	workload := adapter.newObject()
+	err = v.Client.Get(ctx, client.ObjectKey{Name: spec.WorkloadName, Namespace: lightrunJavaAgent.Namespace}, workload)
+	if err != nil {
+		// Missing workload or kind is reported by the reconciler, the workload may be created later
+		if apierrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if patchedBy, ok := workload.GetAnnotations()[annotationAgentName]; ok && patchedBy != lightrunJavaAgent.Name {
+		return field.Forbidden(fldPath, string(spec.WorkloadType)+" "+spec.WorkloadName+" is already patched by LightrunJavaAgent "+patchedBy), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,233 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func testValidator(t *testing.T, objs ...client.Object) *LightrunJavaAgentValidator {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return &LightrunJavaAgentValidator{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()}
+}
+
+func Test_LightrunJavaAgentValidator_ValidateCreate(t *testing.T) {
+	otherAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	otherAgent.Name = "other"
+	patchedDeployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "patched", Namespace: "default",
+		Annotations: map[string]string{annotationAgentName: "other"}}}
+
+	tests := []struct {
+		name    string
+		objs    []client.Object
+		modify  func(agent *agentv1beta.LightrunJavaAgent)
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {},
+		},
+		{
+			name:    "empty containerSelector",
+			modify:  func(agent *agentv1beta.LightrunJavaAgent) { agent.Spec.ContainerSelector = nil },
+			wantErr: "spec.containerSelector",
+		},
+		{
+			name: "relative sharedVolumeMountPath",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.InitContainer.SharedVolumeMountPath = "lightrun"
+			},
+			wantErr: "spec.initContainer.sharedVolumeMountPath",
+		},
+		{
+			name:    "too long agentCliFlags",
+			modify:  func(agent *agentv1beta.LightrunJavaAgent) { agent.Spec.AgentCliFlags = strings.Repeat("a", 1024) },
+			wantErr: "spec.agentCliFlags",
+		},
+		{
+			name: "sidecar with image volume",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.InitContainer.Sidecar = true
+				agent.Spec.InitContainer.InjectionMode = agentv1beta.AgentInstallModeImageVolume
+			},
+			wantErr: "spec.initContainer.sidecar",
+		},
+		{
+			name: "dryRun with webhook injection mode",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.DryRun = true
+				agent.Spec.InjectionMode = agentv1beta.InjectionModeWebhook
+			},
+			wantErr: "spec.dryRun",
+		},
+		{
+			name: "gitOpsCompatibility with webhook injection mode",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.GitOpsCompatibility = &agentv1beta.GitOpsCompatibility{}
+				agent.Spec.InjectionMode = agentv1beta.InjectionModeWebhook
+			},
+			wantErr: "spec.gitOpsCompatibility",
+		},
+		{
+			name: "image volume with webhook injection mode",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.InitContainer.InjectionMode = agentv1beta.AgentInstallModeImageVolume
+				agent.Spec.InjectionMode = agentv1beta.InjectionModeWebhook
+			},
+			wantErr: "spec.initContainer.injectionMode",
+		},
+		{
+			name: "expiresAt and ttl",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				expiresAt := metav1.Now()
+				agent.Spec.ExpiresAt = &expiresAt
+				agent.Spec.TTL = &metav1.Duration{Duration: time.Hour}
+			},
+			wantErr: "spec.ttl",
+		},
+		{
+			name: "non positive drift backoff",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.DriftBackoff = &agentv1beta.DriftBackoff{Max: &metav1.Duration{}}
+			},
+			wantErr: "spec.driftBackoff.max",
+		},
+		{
+			name: "maintenance window policy without window",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.RolloutPolicy = agentv1beta.RolloutPolicyMaintenanceWindow
+			},
+			wantErr: "spec.maintenanceWindow",
+		},
+		{
+			name: "invalid maintenance window schedule",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.RolloutPolicy = agentv1beta.RolloutPolicyMaintenanceWindow
+				agent.Spec.MaintenanceWindow = &agentv1beta.MaintenanceWindow{Schedule: "every saturday", Duration: metav1.Duration{Duration: time.Hour}}
+			},
+			wantErr: "spec.maintenanceWindow",
+		},
+		{
+			name: "image and agentVersion",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.InitContainer.AgentVersion = "1.7.0"
+			},
+			wantErr: "spec.initContainer.agentVersion",
+		},
+		{
+			name: "auto agentPlatform with image",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.InitContainer.AgentPlatform = "auto"
+			},
+			wantErr: "spec.initContainer.agentPlatform",
+		},
+		{
+			name: "agentPlatform with agentVersion",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.InitContainer.Image = ""
+				agent.Spec.InitContainer.AgentVersion = "1.7.0"
+				agent.Spec.InitContainer.AgentPlatform = "alpine"
+			},
+		},
+		{
+			name: "agentVersion without image",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.InitContainer.Image = ""
+				agent.Spec.InitContainer.AgentVersion = "1.7.0"
+			},
+		},
+		{
+			name: "reserved init container env",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.InitContainer.Env = []corev1.EnvVar{{Name: "LIGHTRUN_KEY", Value: "key"}}
+			},
+			wantErr: "spec.initContainer.env[0].name",
+		},
+		{
+			name: "root init container",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				runAsUser := int64(0)
+				agent.Spec.InitContainer.SecurityContext = &agentv1beta.InitContainerSecurityContext{RunAsUser: &runAsUser}
+			},
+			wantErr: "spec.initContainer.securityContext.runAsUser",
+		},
+		{
+			name: "workloadName and workloadSelector",
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.WorkloadSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "java"}}
+			},
+			wantErr: "spec.workloadName",
+		},
+		{
+			name:    "workload targeted by another agent",
+			objs:    []client.Object{otherAgent},
+			modify:  func(agent *agentv1beta.LightrunJavaAgent) {},
+			wantErr: "already targeted by LightrunJavaAgent other",
+		},
+		{
+			name:    "workload patched by another agent",
+			objs:    []client.Object{patchedDeployment},
+			modify:  func(agent *agentv1beta.LightrunJavaAgent) { agent.Spec.WorkloadName = patchedDeployment.Name },
+			wantErr: "already patched by LightrunJavaAgent other",
+		},
+		{
+			name: "selector agent is not checked for duplicates",
+			objs: []client.Object{otherAgent},
+			modify: func(agent *agentv1beta.LightrunJavaAgent) {
+				agent.Spec.WorkloadName = ""
+				agent.Spec.WorkloadSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "java"}}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+			tt.modify(agent)
+			_, err := testValidator(t, tt.objs...).ValidateCreate(context.Background(), agent)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateCreate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateCreate() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_LightrunJavaAgentValidator_ValidateUpdate(t *testing.T) {
+	oldAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	// Created before the webhook was enabled
+	oldAgent.Spec.ContainerSelector = nil
+	v := testValidator(t)
+
+	withFinalizer := oldAgent.DeepCopy()
+	withFinalizer.Finalizers = []string{finalizerName}
+	if _, err := v.ValidateUpdate(context.Background(), oldAgent, withFinalizer); err != nil {
+		t.Errorf("ValidateUpdate() of metadata error = %v", err)
+	}
+
+	specChanged := oldAgent.DeepCopy()
+	specChanged.Spec.AgentTags = []string{"new"}
+	if _, err := v.ValidateUpdate(context.Background(), oldAgent, specChanged); err == nil {
+		t.Error("ValidateUpdate() of invalid spec succeeded")
+	}
+}
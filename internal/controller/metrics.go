@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+// Operations on the workloads measured by the workload operation metrics
+const (
+	operationPatch   = "patch"
+	operationUnpatch = "unpatch"
+)
+
+// Timeout of listing LightrunJavaAgents from the cache on scrape
+const stateMetricsTimeout = 5 * time.Second
+
+var (
+	workloadOperationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lightrun_operator_workload_operations_total",
+		Help: "Number of agent injections (patch) and removals (unpatch) of the workloads by the result",
+	}, []string{"kind", "operation", "result"})
+
+	workloadOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lightrun_operator_workload_operation_duration_seconds",
+		Help:    "Duration of agent injections (patch) and removals (unpatch) of the workloads",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"kind", "operation"})
+
+	secretResolutionFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lightrun_operator_secret_resolution_failures_total",
+		Help: "Number of reconciliations failed because the agent Secret is missing or invalid",
+	}, []string{"workload_namespace", "reason"})
+
+	configRolloutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lightrun_operator_config_rollouts_total",
+		Help: "Number of pod rollouts of the patched workloads triggered by agent config hash changes",
+	}, []string{"kind", "workload_namespace"})
+
+	workloadDriftsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lightrun_operator_workload_drifts_total",
+		Help: "Number of reverts of the agent env var in the patched workloads re-applied by the operator",
+	}, []string{"kind", "workload_namespace"})
+
+	agentsDesc = prometheus.NewDesc(
+		"lightrun_operator_java_agents",
+		"Number of LightrunJavaAgents by the status of the Ready, Progressing and Degraded conditions",
+		[]string{"condition", "status"}, nil,
+	)
+
+	patchedWorkloadsDesc = prometheus.NewDesc(
+		"lightrun_operator_patched_workloads",
+		"Number of workloads with the agent injected by the operator, including the ones waiting for the drift backoff",
+		[]string{"kind", "workload_namespace"}, nil,
+	)
+)
+
+// agentState is registered once per process, the reconciler sets its client in SetupWithManager
+var agentState = &agentStateCollector{}
+
+func init() {
+	metrics.Registry.MustRegister(workloadOperationsTotal, workloadOperationDuration, secretResolutionFailuresTotal, configRolloutsTotal, workloadDriftsTotal, agentState)
+}
+
+// observeWorkloadOperation records the result and the duration of the operation on the workload
+func observeWorkloadOperation(kind agentv1beta.WorkloadType, operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	workloadOperationsTotal.WithLabelValues(string(kind), operation, result).Inc()
+	workloadOperationDuration.WithLabelValues(string(kind), operation).Observe(time.Since(start).Seconds())
+}
+
+// agentStateCollector reports the state of the LightrunJavaAgents from the cache on every scrape,
+// so the metrics are correct after restarts of the operator and deletions of the CRs
+type agentStateCollector struct {
+	mu     sync.RWMutex
+	client client.Reader
+	log    logr.Logger
+}
+
+// setClient sets the reader of the LightrunJavaAgents, nothing is reported until it is set
+func (c *agentStateCollector) setClient(reader client.Reader, log logr.Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client, c.log = reader, log
+}
+
+func (c *agentStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- agentsDesc
+	ch <- patchedWorkloadsDesc
+}
+
+func (c *agentStateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	reader, log := c.client, c.log
+	c.mu.RUnlock()
+	if reader == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stateMetricsTimeout)
+	defer cancel()
+	var agents agentv1beta.LightrunJavaAgentList
+	if err := reader.List(ctx, &agents); err != nil {
+		log.Error(err, "unable to list LightrunJavaAgents for metrics")
+		return
+	}
+
+	conditionTypes := []string{conditionReady, conditionProgressing, conditionDegraded}
+	statuses := []metav1.ConditionStatus{metav1.ConditionTrue, metav1.ConditionFalse, metav1.ConditionUnknown}
+	conditionCounts := map[string]map[metav1.ConditionStatus]int{}
+	for _, conditionType := range conditionTypes {
+		conditionCounts[conditionType] = map[metav1.ConditionStatus]int{}
+	}
+	type workloadKey struct {
+		kind      agentv1beta.WorkloadType
+		namespace string
+	}
+	workloadCounts := map[workloadKey]int{}
+	for _, agent := range agents.Items {
+		for _, conditionType := range conditionTypes {
+			status := metav1.ConditionUnknown
+			if condition := meta.FindStatusCondition(agent.Status.Conditions, conditionType); condition != nil {
+				status = condition.Status
+			}
+			conditionCounts[conditionType][status]++
+		}
+		for _, workload := range agent.Status.Workloads {
+			// Drifted workload keeps the agent until the env var revert is re-applied
+			if workload.Status == workloadStatusPatched || workload.Status == workloadStatusDrifted {
+				workloadCounts[workloadKey{workload.Kind, agent.Namespace}]++
+			}
+		}
+	}
+
+	for _, conditionType := range conditionTypes {
+		for _, status := range statuses {
+			ch <- prometheus.MustNewConstMetric(agentsDesc, prometheus.GaugeValue, float64(conditionCounts[conditionType][status]), conditionType, string(status))
+		}
+	}
+	for key, count := range workloadCounts {
+		ch <- prometheus.MustNewConstMetric(patchedWorkloadsDesc, prometheus.GaugeValue, float64(count), string(key.kind), key.namespace)
+	}
+}
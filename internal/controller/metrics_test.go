@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func Test_agentStateCollector(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	ready := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	ready.Status.Conditions = []metav1.Condition{
+		{Type: conditionReady, Status: metav1.ConditionTrue, Reason: reasonReconcileSucceeded},
+		{Type: conditionProgressing, Status: metav1.ConditionFalse, Reason: reasonRolloutComplete},
+		{Type: conditionDegraded, Status: metav1.ConditionFalse, Reason: reasonReconcileSucceeded},
+	}
+	ready.Status.Workloads = []agentv1beta.WorkloadReconcileStatus{
+		{Kind: agentv1beta.WorkloadTypeDeployment, Name: "a", Status: workloadStatusPatched},
+		{Kind: agentv1beta.WorkloadTypeDeployment, Name: "b", Status: workloadStatusPatched},
+		{Kind: agentv1beta.WorkloadTypeStatefulSet, Name: "c", Status: workloadStatusFailed},
+		{Kind: agentv1beta.WorkloadTypeDeployment, Name: "d", Status: workloadStatusDrifted},
+	}
+	// New CR without conditions
+	pending := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	pending.Name = "pending"
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(ready, pending).Build()
+	collector := &agentStateCollector{client: c, log: zap.New()}
+
+	expected := `
+# HELP lightrun_operator_java_agents Number of LightrunJavaAgents by the status of the Ready, Progressing and Degraded conditions
+# TYPE lightrun_operator_java_agents gauge
+lightrun_operator_java_agents{condition="Degraded",status="False"} 1
+lightrun_operator_java_agents{condition="Degraded",status="True"} 0
+lightrun_operator_java_agents{condition="Degraded",status="Unknown"} 1
+lightrun_operator_java_agents{condition="Progressing",status="False"} 1
+lightrun_operator_java_agents{condition="Progressing",status="True"} 0
+lightrun_operator_java_agents{condition="Progressing",status="Unknown"} 1
+lightrun_operator_java_agents{condition="Ready",status="False"} 0
+lightrun_operator_java_agents{condition="Ready",status="True"} 1
+lightrun_operator_java_agents{condition="Ready",status="Unknown"} 1
+# HELP lightrun_operator_patched_workloads Number of workloads with the agent injected by the operator, including the ones waiting for the drift backoff
+# TYPE lightrun_operator_patched_workloads gauge
+lightrun_operator_patched_workloads{kind="Deployment",workload_namespace="default"} 3
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_agentStateCollector_withoutClient(t *testing.T) {
+	// Collector is registered before the manager is set up and reports nothing until then
+	if count := testutil.CollectAndCount(&agentStateCollector{}); count != 0 {
+		t.Errorf("metrics without client = %d, want 0", count)
+	}
+}
+
+func Test_observeWorkloadOperation(t *testing.T) {
+	success := workloadOperationsTotal.WithLabelValues(string(agentv1beta.WorkloadTypeDaemonSet), operationUnpatch, "success")
+	failure := workloadOperationsTotal.WithLabelValues(string(agentv1beta.WorkloadTypeDaemonSet), operationUnpatch, "error")
+	successBefore, failureBefore := testutil.ToFloat64(success), testutil.ToFloat64(failure)
+
+	observeWorkloadOperation(agentv1beta.WorkloadTypeDaemonSet, operationUnpatch, time.Now(), nil)
+	observeWorkloadOperation(agentv1beta.WorkloadTypeDaemonSet, operationUnpatch, time.Now(), errors.New("conflict"))
+	observeWorkloadOperation(agentv1beta.WorkloadTypeDaemonSet, operationUnpatch, time.Now(), nil)
+
+	if got := testutil.ToFloat64(success) - successBefore; got != 2 {
+		t.Errorf("successful operations = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(failure) - failureBefore; got != 1 {
+		t.Errorf("failed operations = %v, want 1", got)
+	}
+}
@@ -4,16 +4,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
 	"slices"
 	"strings"
 
 	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
-	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	appsv1ac "k8s.io/client-go/applyconfigurations/apps/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
 )
 
@@ -25,8 +29,16 @@ const (
 	annotationPatchedEnvValue = "lightrun.com/patched-env-value"
 	annotationConfigMapHash   = "lightrun.com/configmap-hash"
 	annotationAgentName       = "lightrun.com/lightrunjavaagent"
+	configSecretNamePrefix    = "lightrunagent-config-"
+	// Names of the pull secrets added to the pod spec by the operator, so the ones set by the user are kept on unpatch
+	annotationImagePullSecrets = "lightrun.com/image-pull-secrets"
+	// Created by the sidecar installer in the shared volume once the agent is installed
+	sidecarReadyFile = "/tmp/agent/.ready"
 )
 
+// Env vars of the init container set by the operator, they can't be overridden by the spec
+var reservedInitContainerEnv = []string{"LIGHTRUN_SERVER", "LIGHTRUN_KEY", "PINNED_CERT", "LIGHTRUN_SYNC_CONFIG"}
+
 func (r *LightrunJavaAgentReconciler) createAgentConfig(lightrunJavaAgent *agentv1beta.LightrunJavaAgent) (corev1.ConfigMap, error) {
 	populateTags(lightrunJavaAgent.Spec.AgentTags, lightrunJavaAgent.Spec.AgentName, &metadata)
 	jsonString, err := json.Marshal(metadata)
@@ -51,29 +63,213 @@ func (r *LightrunJavaAgentReconciler) createAgentConfig(lightrunJavaAgent *agent
 	return configMap, nil
 }
 
-func (r *LightrunJavaAgentReconciler) patchDeployment(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, secret *corev1.Secret, origDeployment *appsv1.Deployment, deploymentApplyConfig *appsv1ac.DeploymentApplyConfiguration, cmDataHash uint64) error {
-	// init spec.template.spec
-	deploymentApplyConfig.WithSpec(
-		appsv1ac.DeploymentSpec().WithTemplate(
-			corev1ac.PodTemplateSpec().WithSpec(
-				corev1ac.PodSpec(),
-			).WithAnnotations(map[string]string{
-				annotationConfigMapHash: fmt.Sprint(cmDataHash),
-			}),
-		),
-	).WithAnnotations(map[string]string{
-		annotationAgentName: lightrunJavaAgent.Name,
-	})
-	r.addVolume(deploymentApplyConfig, lightrunJavaAgent)
-	r.addInitContainer(deploymentApplyConfig, lightrunJavaAgent, secret)
-	err = r.patchAppContainers(lightrunJavaAgent, origDeployment, deploymentApplyConfig)
+// patchPodTemplate returns the apply configuration of the pod template with the Lightrun agent injected.
+// It is shared by all the workload kinds, see workloadAdapter
+func (r *LightrunJavaAgentReconciler) patchPodTemplate(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, secret *corev1.Secret, origTemplate *corev1.PodTemplateSpec, cmDataHash uint64) (*corev1ac.PodTemplateSpecApplyConfiguration, error) {
+	image, err := r.agentImage(lightrunJavaAgent, origTemplate)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	podSpec := corev1ac.PodSpec()
+	r.addVolume(podSpec, lightrunJavaAgent, secret)
+	r.addInitContainer(podSpec, lightrunJavaAgent, secret, image)
+	err = r.patchAppContainers(lightrunJavaAgent, origTemplate, podSpec)
+	if err != nil {
+		return nil, err
+	}
+	templateApplyConfig := corev1ac.PodTemplateSpec().WithSpec(podSpec)
+	r.addImagePullSecrets(templateApplyConfig, lightrunJavaAgent, origTemplate)
+	// Sidecar installer syncs the config into the running pods, no need to recreate them
+	if !lightrunJavaAgent.Spec.InitContainer.Sidecar {
+		templateApplyConfig.WithAnnotations(map[string]string{
+			annotationConfigMapHash: fmt.Sprint(cmDataHash),
+		})
+	}
+	return templateApplyConfig, nil
 }
 
-func (r *LightrunJavaAgentReconciler) addVolume(deploymentApplyConfig *appsv1ac.DeploymentApplyConfiguration, lightrunJavaAgent *agentv1beta.LightrunJavaAgent) {
+// addImagePullSecrets adds the pull secrets of the agent image to the pod spec. Secrets that are already
+// in the original pod template and weren't added by the operator belong to the workload and are skipped
+func (r *LightrunJavaAgentReconciler) addImagePullSecrets(templateApplyConfig *corev1ac.PodTemplateSpecApplyConfiguration, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, origTemplate *corev1.PodTemplateSpec) {
+	names := slices.Clone(r.DefaultImagePullSecrets)
+	for _, pullSecret := range lightrunJavaAgent.Spec.InitContainer.ImagePullSecrets {
+		names = append(names, pullSecret.Name)
+	}
+	addedBefore := strings.Split(origTemplate.Annotations[annotationImagePullSecrets], ",")
+	var added []string
+	for _, name := range names {
+		if name == "" || slices.Contains(added, name) {
+			continue
+		}
+		ownedByWorkload := slices.ContainsFunc(origTemplate.Spec.ImagePullSecrets, func(s corev1.LocalObjectReference) bool { return s.Name == name })
+		if ownedByWorkload && !slices.Contains(addedBefore, name) {
+			continue
+		}
+		added = append(added, name)
+		templateApplyConfig.Spec.WithImagePullSecrets(corev1ac.LocalObjectReference().WithName(name))
+	}
+	if len(added) > 0 {
+		templateApplyConfig.WithAnnotations(map[string]string{
+			annotationImagePullSecrets: strings.Join(added, ","),
+		})
+	}
+}
+
+// imageVolumePodTemplate returns the apply configuration of the pod template with the agent image mounted as an image volume.
+// k8s.io/api used by the operator predates image volumes, so the volume is added without a source here,
+// setImageVolumeSource sets it in the apply object. Agent config is mounted over the defaults of the image
+func (r *LightrunJavaAgentReconciler) imageVolumePodTemplate(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, origTemplate *corev1.PodTemplateSpec, cmDataHash uint64) (*corev1ac.PodTemplateSpecApplyConfiguration, error) {
+	spec := lightrunJavaAgent.Spec
+	podSpec := corev1ac.PodSpec().WithVolumes(
+		corev1ac.Volume().WithName(spec.InitContainer.SharedVolumeName),
+		corev1ac.Volume().
+			WithName(cmVolumeName).
+			WithProjected(
+				corev1ac.ProjectedVolumeSource().WithSources(
+					corev1ac.VolumeProjection().WithSecret(
+						corev1ac.SecretProjection().
+							WithName(configSecretNamePrefix+lightrunJavaAgent.Name).
+							WithItems(corev1ac.KeyToPath().WithKey("agent.config").WithPath("agent.config")),
+					),
+					corev1ac.VolumeProjection().WithConfigMap(
+						corev1ac.ConfigMapProjection().
+							WithName(cmNamePrefix+lightrunJavaAgent.Name).
+							WithItems(corev1ac.KeyToPath().WithKey("metadata").WithPath("agent.metadata.json")),
+					),
+				),
+			),
+	)
+
+	agentDir := spec.InitContainer.SharedVolumeMountPath + "/agent/"
+	found := false
+	for _, container := range origTemplate.Spec.Containers {
+		if !slices.Contains(spec.ContainerSelector, container.Name) {
+			continue
+		}
+		found = true
+		env, err := gitOpsEnvApplyConfigs(lightrunJavaAgent)
+		if err != nil {
+			return nil, err
+		}
+		podSpec.WithContainers(
+			corev1ac.Container().
+				WithName(container.Name).
+				WithImage(container.Image).
+				WithVolumeMounts(
+					corev1ac.VolumeMount().WithName(spec.InitContainer.SharedVolumeName).WithMountPath(spec.InitContainer.SharedVolumeMountPath).WithReadOnly(true),
+					corev1ac.VolumeMount().WithName(cmVolumeName).WithMountPath(agentDir+"agent.config").WithSubPath("agent.config").WithReadOnly(true),
+					corev1ac.VolumeMount().WithName(cmVolumeName).WithMountPath(agentDir+"agent.metadata.json").WithSubPath("agent.metadata.json").WithReadOnly(true),
+				).
+				WithEnv(env...),
+		)
+	}
+	if !found {
+		return nil, withReason(reasonContainerNotFound, errors.New("unable to find matching container to patch"))
+	}
+	// Files mounted with subPath are not updated, so every config change recreates the pods
+	templateApplyConfig := corev1ac.PodTemplateSpec().
+		WithSpec(podSpec).
+		WithAnnotations(map[string]string{
+			annotationConfigMapHash: fmt.Sprint(cmDataHash),
+		})
+	r.addImagePullSecrets(templateApplyConfig, lightrunJavaAgent, origTemplate)
+	return templateApplyConfig, nil
+}
+
+// setImageVolumeSource sets the image volume source of the named volume in the unstructured apply object.
+// It returns false if the volume is not found
+func setImageVolumeSource(obj map[string]interface{}, volumeName string, reference string, pullPolicy corev1.PullPolicy) bool {
+	for key, value := range obj {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if setImageVolumeSource(value, volumeName, reference, pullPolicy) {
+				return true
+			}
+		case []interface{}:
+			for _, item := range value {
+				item, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if key == "volumes" && item["name"] == volumeName {
+					source := map[string]interface{}{"reference": reference}
+					if pullPolicy != "" {
+						source["pullPolicy"] = string(pullPolicy)
+					}
+					item["image"] = source
+					return true
+				}
+				if setImageVolumeSource(item, volumeName, reference, pullPolicy) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// volumeFieldPath matches the field path of a pod volume or its image source in the validation errors
+var volumeFieldPath = regexp.MustCompile(`(^|\.)volumes\[\d+\](\.image(\..+)?)?$`)
+
+// imageVolumeRejected reports whether the dry run apply of the image volume failed because the API server
+// doesn't support image volumes. API server with the ImageVolume feature disabled drops the image source and
+// rejects the volume without a source, API server older than the feature doesn't know the image field
+func imageVolumeRejected(err error, volumeName string) bool {
+	var status apierrors.APIStatus
+	if !errors.As(err, &status) {
+		return false
+	}
+	switch {
+	case apierrors.IsInvalid(err):
+		details := status.Status().Details
+		if details == nil {
+			return false
+		}
+		for _, cause := range details.Causes {
+			if !volumeFieldPath.MatchString(cause.Field) {
+				continue
+			}
+			// Volumes of the workload are valid already, only the agent volume can be left without a source
+			if strings.Contains(cause.Field, ".image") || cause.Type == metav1.CauseTypeFieldValueRequired {
+				return true
+			}
+		}
+	case apierrors.IsBadRequest(err):
+		return strings.Contains(status.Status().Message, `volumes[name="`+volumeName+`"].image: field not declared in schema`)
+	}
+	return false
+}
+
+// createAgentConfigSecret returns the Secret with the complete agent config used in ImageVolume mode.
+// Image volume is read-only, so the config rendered by the init container is rendered by the operator instead
+func (r *LightrunJavaAgentReconciler) createAgentConfigSecret(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, secret *corev1.Secret) (corev1.Secret, error) {
+	lightrunKey := secret.Data["lightrun_key"]
+	pinnedCert := secret.Data["pinned_cert_hash"]
+	if len(lightrunKey) == 0 || len(pinnedCert) == 0 {
+		return corev1.Secret{}, withReason(reasonSecretInvalid, errors.New("secret "+secret.Name+" has to contain lightrun_key and pinned_cert_hash"))
+	}
+	agentConfig := "com.lightrun.server=https://" + lightrunJavaAgent.Spec.ServerHostname + "\n" +
+		"com.lightrun.secret=" + string(lightrunKey) + "\n" +
+		"pinned_certs=" + string(pinnedCert) + "\n" +
+		parseAgentConfig(lightrunJavaAgent.Spec.AgentConfig)
+	configSecret := corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      configSecretNamePrefix + lightrunJavaAgent.Name,
+			Namespace: lightrunJavaAgent.Namespace,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"agent.config": []byte(agentConfig),
+		},
+	}
+	if err := ctrl.SetControllerReference(lightrunJavaAgent, &configSecret, r.Scheme); err != nil {
+		return configSecret, err
+	}
+	return configSecret, nil
+}
+
+func (r *LightrunJavaAgentReconciler) addVolume(podSpec *corev1ac.PodSpecApplyConfiguration, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, secret *corev1.Secret) {
 	// Start with base volumes
 	volumes := []*corev1ac.VolumeApplyConfiguration{
 		corev1ac.Volume().
@@ -107,10 +303,10 @@ func (r *LightrunJavaAgentReconciler) addVolume(deploymentApplyConfig *appsv1ac.
 		)
 	}
 
-	deploymentApplyConfig.Spec.Template.Spec.WithVolumes(volumes...)
+	podSpec.WithVolumes(volumes...)
 }
 
-func (r *LightrunJavaAgentReconciler) addInitContainer(deploymentApplyConfig *appsv1ac.DeploymentApplyConfiguration, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, secret *corev1.Secret) {
+func (r *LightrunJavaAgentReconciler) addInitContainer(podSpec *corev1ac.PodSpecApplyConfiguration, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, secret *corev1.Secret, image string) {
 	spec := lightrunJavaAgent.Spec
 	isImagePullPolicyConfigured := spec.InitContainer.ImagePullPolicy != ""
 
@@ -148,61 +344,185 @@ func (r *LightrunJavaAgentReconciler) addInitContainer(deploymentApplyConfig *ap
 
 	initContainer := corev1ac.Container().
 		WithName(initContainerName).
-		WithImage(spec.InitContainer.Image).
+		WithImage(image).
 		WithVolumeMounts(volumeMounts...).
 		WithEnv(envVars...).
-		WithSecurityContext(
-			corev1ac.SecurityContext().
-				WithCapabilities(
-					corev1ac.Capabilities().WithDrop(corev1.Capability("ALL")),
-				).
-				WithRunAsNonRoot(true).
-				WithAllowPrivilegeEscalation(false).
-				WithSeccompProfile(
-					corev1ac.SeccompProfile().
-						WithType(corev1.SeccompProfileTypeRuntimeDefault),
-				),
-		).
-		WithResources(
-			corev1ac.ResourceRequirements().
-				WithLimits(
-					corev1.ResourceList{
-						corev1.ResourceCPU:    *resource.NewMilliQuantity(int64(50), resource.BinarySI),
-						corev1.ResourceMemory: *resource.NewScaledQuantity(int64(64), resource.Scale(6)), // 64M
-					},
-				).WithRequests(
-				corev1.ResourceList{
-					corev1.ResourceCPU:    *resource.NewMilliQuantity(int64(50), resource.BinarySI),
-					corev1.ResourceMemory: *resource.NewScaledQuantity(int64(64), resource.Scale(6)),
-				},
-			),
-		)
+		WithSecurityContext(initContainerSecurityContext(spec.InitContainer.SecurityContext))
+	resources := initContainerResources(spec.InitContainer.Resources)
+	initContainer.WithResources(
+		corev1ac.ResourceRequirements().
+			WithLimits(resources.Limits).
+			WithRequests(resources.Requests),
+	)
 	if isImagePullPolicyConfigured {
 		initContainer.WithImagePullPolicy(spec.InitContainer.ImagePullPolicy)
 	}
-	deploymentApplyConfig.Spec.Template.Spec.WithInitContainers(initContainer)
+	if spec.InitContainer.Sidecar {
+		// Native sidecar keeps running after the agent is installed. App containers are started
+		// only after the startup probe confirms that the agent is in the shared volume
+		initContainer.
+			WithRestartPolicy(corev1.ContainerRestartPolicyAlways).
+			WithEnv(corev1ac.EnvVar().WithName("LIGHTRUN_SYNC_CONFIG").WithValue("true")).
+			WithStartupProbe(
+				corev1ac.Probe().
+					WithExec(corev1ac.ExecAction().WithCommand("test", "-f", sidecarReadyFile)).
+					WithPeriodSeconds(1).
+					WithFailureThreshold(300),
+			)
+	}
+	for _, envVar := range spec.InitContainer.Env {
+		if slices.Contains(reservedInitContainerEnv, envVar.Name) {
+			continue
+		}
+		initContainer.WithEnv(envVarApplyConfig(envVar))
+	}
+	podSpec.WithInitContainers(initContainer)
+}
+
+// initContainerSecurityContext returns the restricted security context of the init container with the overrides from the spec
+func initContainerSecurityContext(overrides *agentv1beta.InitContainerSecurityContext) *corev1ac.SecurityContextApplyConfiguration {
+	securityContext := corev1ac.SecurityContext().
+		WithCapabilities(
+			corev1ac.Capabilities().WithDrop(corev1.Capability("ALL")),
+		).
+		WithRunAsNonRoot(true).
+		WithAllowPrivilegeEscalation(false).
+		WithSeccompProfile(
+			corev1ac.SeccompProfile().
+				WithType(corev1.SeccompProfileTypeRuntimeDefault),
+		)
+	if overrides == nil {
+		return securityContext
+	}
+	if overrides.RunAsUser != nil {
+		securityContext.WithRunAsUser(*overrides.RunAsUser)
+	}
+	if overrides.RunAsGroup != nil {
+		securityContext.WithRunAsGroup(*overrides.RunAsGroup)
+	}
+	if overrides.ReadOnlyRootFilesystem != nil {
+		securityContext.WithReadOnlyRootFilesystem(*overrides.ReadOnlyRootFilesystem)
+	}
+	return securityContext
 }
 
-func (r *LightrunJavaAgentReconciler) patchAppContainers(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, origDeployment *appsv1.Deployment, deploymentApplyConfig *appsv1ac.DeploymentApplyConfiguration) error {
+// initContainerResources merges the resources from the spec onto the default ones. Limits lower than
+// the requests are raised, otherwise the pod would be rejected by the API server
+func initContainerResources(overrides *corev1.ResourceRequirements) corev1.ResourceRequirements {
+	resources := corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    *resource.NewMilliQuantity(int64(50), resource.BinarySI),
+			corev1.ResourceMemory: *resource.NewScaledQuantity(int64(64), resource.Scale(6)), // 64M
+		},
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    *resource.NewMilliQuantity(int64(50), resource.BinarySI),
+			corev1.ResourceMemory: *resource.NewScaledQuantity(int64(64), resource.Scale(6)),
+		},
+	}
+	if overrides == nil {
+		return resources
+	}
+	for name, quantity := range overrides.Limits {
+		resources.Limits[name] = quantity
+	}
+	for name, quantity := range overrides.Requests {
+		resources.Requests[name] = quantity
+	}
+	for name, limit := range resources.Limits {
+		request, ok := resources.Requests[name]
+		if !ok || limit.Cmp(request) >= 0 {
+			continue
+		}
+		// Limit is raised only to the request set explicitly, default request is lowered,
+		// so the limit allowed by a LimitRange is kept
+		if _, requested := overrides.Requests[name]; requested {
+			resources.Limits[name] = request
+		} else {
+			resources.Requests[name] = limit
+		}
+	}
+	return resources
+}
+
+// envVarApplyConfig converts the env var from the spec to its apply configuration
+func envVarApplyConfig(envVar corev1.EnvVar) *corev1ac.EnvVarApplyConfiguration {
+	envVarConfig := corev1ac.EnvVar().WithName(envVar.Name)
+	if envVar.ValueFrom == nil {
+		return envVarConfig.WithValue(envVar.Value)
+	}
+	source := corev1ac.EnvVarSource()
+	valueFrom := envVar.ValueFrom
+	switch {
+	case valueFrom.FieldRef != nil:
+		source.WithFieldRef(corev1ac.ObjectFieldSelector().
+			WithAPIVersion(valueFrom.FieldRef.APIVersion).
+			WithFieldPath(valueFrom.FieldRef.FieldPath))
+	case valueFrom.ResourceFieldRef != nil:
+		selector := corev1ac.ResourceFieldSelector().
+			WithContainerName(valueFrom.ResourceFieldRef.ContainerName).
+			WithResource(valueFrom.ResourceFieldRef.Resource)
+		if !valueFrom.ResourceFieldRef.Divisor.IsZero() {
+			selector.WithDivisor(valueFrom.ResourceFieldRef.Divisor)
+		}
+		source.WithResourceFieldRef(selector)
+	case valueFrom.ConfigMapKeyRef != nil:
+		selector := corev1ac.ConfigMapKeySelector().
+			WithName(valueFrom.ConfigMapKeyRef.Name).
+			WithKey(valueFrom.ConfigMapKeyRef.Key)
+		if valueFrom.ConfigMapKeyRef.Optional != nil {
+			selector.WithOptional(*valueFrom.ConfigMapKeyRef.Optional)
+		}
+		source.WithConfigMapKeyRef(selector)
+	case valueFrom.SecretKeyRef != nil:
+		selector := corev1ac.SecretKeySelector().
+			WithName(valueFrom.SecretKeyRef.Name).
+			WithKey(valueFrom.SecretKeyRef.Key)
+		if valueFrom.SecretKeyRef.Optional != nil {
+			selector.WithOptional(*valueFrom.SecretKeyRef.Optional)
+		}
+		source.WithSecretKeyRef(selector)
+	}
+	return envVarConfig.WithValueFrom(source)
+}
+
+func (r *LightrunJavaAgentReconciler) patchAppContainers(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, origTemplate *corev1.PodTemplateSpec, podSpec *corev1ac.PodSpecApplyConfiguration) error {
 	var found bool = false
-	for _, container := range origDeployment.Spec.Template.Spec.Containers {
+	for _, container := range origTemplate.Spec.Containers {
 		for _, targetContainer := range lightrunJavaAgent.Spec.ContainerSelector {
 			if targetContainer == container.Name {
 				found = true
-				deploymentApplyConfig.Spec.Template.Spec.WithContainers(
+				env, err := gitOpsEnvApplyConfigs(lightrunJavaAgent)
+				if err != nil {
+					return err
+				}
+				podSpec.WithContainers(
 					corev1ac.Container().
 						WithName(container.Name).
 						WithImage(container.Image).
 						WithVolumeMounts(
 							corev1ac.VolumeMount().WithMountPath(lightrunJavaAgent.Spec.InitContainer.SharedVolumeMountPath).WithName(lightrunJavaAgent.Spec.InitContainer.SharedVolumeName),
-						),
+						).
+						WithEnv(env...),
 				)
 			}
 		}
 	}
 	if !found {
-		err = errors.New("unable to find matching container to patch")
-		return err
+		return withReason(reasonContainerNotFound, errors.New("unable to find matching container to patch"))
+	}
+	return nil
+}
+
+// patchContainersEnv patches the agent env var of the containers selected by the LightrunJavaAgent.
+// Annotations of the workload are used to unpatch the previously patched env var
+func (r *LightrunJavaAgentReconciler) patchContainersEnv(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, template *corev1.PodTemplateSpec, annotations map[string]string, agentArg string) error {
+	for i, container := range template.Spec.Containers {
+		if containsString(lightrunJavaAgent.Spec.ContainerSelector, container.Name) {
+			err := r.patchJavaToolEnv(annotations, &template.Spec.Containers[i], agentEnvVarName(lightrunJavaAgent), agentArg)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -213,23 +533,30 @@ func (r *LightrunJavaAgentReconciler) patchJavaToolEnv(deplAnnotations map[strin
 	patchedEnv := deplAnnotations[annotationPatchedEnvName]
 	patchedEnvValue := deplAnnotations[annotationPatchedEnvValue]
 
-	if patchedEnv != targetEnvVar || patchedEnvValue != agentArg {
+	// Env var applied in GitOps compatibility mode already has the new value
+	alreadyPatched := strings.Contains(envVarValue(targetEnvVar, container.Env), agentArg)
+	if patchedEnv != targetEnvVar || (patchedEnvValue != agentArg && !alreadyPatched) {
 		// If different env was patched before - unpatch it
 		r.unpatchJavaToolEnv(deplAnnotations, container)
 	}
 
 	targetEnvVarIndex := findEnvVarIndex(targetEnvVar, container.Env)
 	if targetEnvVarIndex == -1 {
-		// No such env - add new
-		container.Env = append(container.Env, corev1.EnvVar{
+		// No such env - add new, before the env vars referencing it, so $(NAME) is expanded
+		index := slices.IndexFunc(container.Env, func(envVar corev1.EnvVar) bool { return referencesEnvVar(envVar, targetEnvVar) })
+		if index == -1 {
+			index = len(container.Env)
+		}
+		container.Env = slices.Insert(container.Env, index, corev1.EnvVar{
 			Name:  targetEnvVar,
 			Value: agentArg,
 		})
 	} else {
 		if !strings.Contains(container.Env[targetEnvVarIndex].Value, agentArg) {
-			container.Env[targetEnvVarIndex].Value = container.Env[targetEnvVarIndex].Value + " " + agentArg
+			// Env var declared without a value gets only the agent argument
+			container.Env[targetEnvVarIndex].Value = strings.TrimSpace(container.Env[targetEnvVarIndex].Value + " " + agentArg)
 			if len(container.Env[targetEnvVarIndex].Value) > 1024 {
-				return errors.New(targetEnvVar + " has more that 1024 chars. This is a limitation of Java")
+				return withReason(reasonEnvTooLong, errors.New(targetEnvVar+" has more that 1024 chars. This is a limitation of Java"))
 			}
 		}
 	}
@@ -255,166 +582,108 @@ func (r *LightrunJavaAgentReconciler) unpatchJavaToolEnv(deplAnnotations map[str
 	}
 }
 
-// patchStatefulSet applies changes to a StatefulSet to inject the Lightrun agent
-func (r *LightrunJavaAgentReconciler) patchStatefulSet(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, secret *corev1.Secret, origStatefulSet *appsv1.StatefulSet, statefulSetApplyConfig *appsv1ac.StatefulSetApplyConfiguration, cmDataHash uint64) error {
-	// init spec.template.spec
-	statefulSetApplyConfig.WithSpec(
-		appsv1ac.StatefulSetSpec().WithTemplate(
-			corev1ac.PodTemplateSpec().WithSpec(
-				corev1ac.PodSpec(),
-			).WithAnnotations(map[string]string{
-				annotationConfigMapHash: fmt.Sprint(cmDataHash),
-			}),
-		),
-	).WithAnnotations(map[string]string{
-		annotationAgentName: lightrunJavaAgent.Name,
-	})
-
-	// Add volumes to the StatefulSet
-	r.addVolumeToStatefulSet(statefulSetApplyConfig, lightrunJavaAgent)
-	// Add init container to the StatefulSet
-	r.addInitContainerToStatefulSet(statefulSetApplyConfig, lightrunJavaAgent, secret)
-	// Patch app containers in the StatefulSet
-	err = r.patchStatefulSetAppContainers(lightrunJavaAgent, origStatefulSet, statefulSetApplyConfig)
-	if err != nil {
-		return err
+// recreatedJob returns a copy of the original Job without server populated fields,
+// with the workload annotations and injected pod template merged in and the Job resumed
+func recreatedJob(origJob *batchv1.Job, annotations map[string]string, injected *corev1.PodTemplateSpec) *batchv1.Job {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            origJob.Name,
+			Namespace:       origJob.Namespace,
+			Labels:          origJob.Labels,
+			Annotations:     map[string]string{},
+			OwnerReferences: origJob.OwnerReferences,
+		},
+		Spec: *origJob.Spec.DeepCopy(),
 	}
-
-	return nil
-}
-
-func (r *LightrunJavaAgentReconciler) addVolumeToStatefulSet(statefulSetApplyConfig *appsv1ac.StatefulSetApplyConfiguration, lightrunJavaAgent *agentv1beta.LightrunJavaAgent) {
-	// Start with base volumes
-	volumes := []*corev1ac.VolumeApplyConfiguration{
-		corev1ac.Volume().
-			WithName(lightrunJavaAgent.Spec.InitContainer.SharedVolumeName).
-			WithEmptyDir(
-				corev1ac.EmptyDirVolumeSource(),
-			),
-		corev1ac.Volume().
-			WithName(cmVolumeName).
-			WithConfigMap(
-				corev1ac.ConfigMapVolumeSource().
-					WithName(cmNamePrefix+lightrunJavaAgent.Name).
-					WithItems(
-						corev1ac.KeyToPath().WithKey("config").WithPath("agent.config"),
-						corev1ac.KeyToPath().WithKey("metadata").WithPath("agent.metadata.json"),
-					),
-			),
+	for k, v := range origJob.Annotations {
+		job.Annotations[k] = v
+	}
+	for k, v := range annotations {
+		job.Annotations[k] = v
 	}
 
-	// Add secret volume if UseSecretsAsMountedFiles is true
-	if lightrunJavaAgent.Spec.UseSecretsAsMountedFiles {
-		volumes = append(volumes,
-			corev1ac.Volume().WithName("lightrun-secret").
-				WithSecret(corev1ac.SecretVolumeSource().
-					WithSecretName(secret.Name).
-					WithItems(
-						corev1ac.KeyToPath().WithKey("lightrun_key").WithPath("lightrun_key"),
-						corev1ac.KeyToPath().WithKey("pinned_cert_hash").WithPath("pinned_cert_hash"),
-					).
-					WithDefaultMode(0440)),
-		)
+	// Selector and matching labels are generated by the API server unless manualSelector is used
+	if job.Spec.ManualSelector == nil || !*job.Spec.ManualSelector {
+		job.Spec.Selector = nil
+		for _, label := range []string{"controller-uid", "job-name", batchv1.ControllerUidLabel, batchv1.JobNameLabel} {
+			delete(job.Spec.Template.Labels, label)
+		}
 	}
 
-	statefulSetApplyConfig.Spec.Template.Spec.WithVolumes(volumes...)
+	mergePodTemplate(&job.Spec.Template, injected)
+	job.Spec.Suspend = pointer.Bool(false)
+	return job
 }
 
-func (r *LightrunJavaAgentReconciler) addInitContainerToStatefulSet(statefulSetApplyConfig *appsv1ac.StatefulSetApplyConfiguration, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, secret *corev1.Secret) {
-	spec := lightrunJavaAgent.Spec
-	isImagePullPolicyConfigured := spec.InitContainer.ImagePullPolicy != ""
-
-	// Always mount shared and config volumes
-	volumeMounts := []*corev1ac.VolumeMountApplyConfiguration{
-		corev1ac.VolumeMount().WithName(spec.InitContainer.SharedVolumeName).WithMountPath("/tmp/"),
-		corev1ac.VolumeMount().WithName(cmVolumeName).WithMountPath("/tmp/cm/"),
+// podTemplateFromApplyConfig converts the pod template apply configuration to the typed pod template
+func podTemplateFromApplyConfig(applyConfig *corev1ac.PodTemplateSpecApplyConfiguration) (*corev1.PodTemplateSpec, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(applyConfig)
+	if err != nil {
+		return nil, err
 	}
-	// If using mounted files, mount the secret as a volume
-	if spec.UseSecretsAsMountedFiles {
-		volumeMounts = append(volumeMounts,
-			corev1ac.VolumeMount().WithName("lightrun-secret").WithMountPath("/etc/lightrun/secret").WithReadOnly(true),
-		)
+	template := &corev1.PodTemplateSpec{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj, template)
+	if err != nil {
+		return nil, err
 	}
+	return template, nil
+}
 
-	// Always set LIGHTRUN_SERVER
-	envVars := []*corev1ac.EnvVarApplyConfiguration{
-		corev1ac.EnvVar().WithName("LIGHTRUN_SERVER").WithValue(spec.ServerHostname),
+// mergePodTemplate adds annotations, volumes, pull secrets, init containers and volume mounts of the injected
+// template to the target one. Items with the same name are replaced, so merge can be repeated safely.
+// Volume mounts are matched by the mount path as well, as a volume can be mounted several times with subPath
+func mergePodTemplate(template *corev1.PodTemplateSpec, injected *corev1.PodTemplateSpec) {
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
 	}
-	// If not using mounted files, set LIGHTRUN_KEY and PINNED_CERT from secret as env vars
-	if !spec.UseSecretsAsMountedFiles {
-		envVars = append(envVars,
-			corev1ac.EnvVar().WithName("LIGHTRUN_KEY").WithValueFrom(
-				corev1ac.EnvVarSource().WithSecretKeyRef(
-					corev1ac.SecretKeySelector().WithName(secret.Name).WithKey("lightrun_key"),
-				),
-			),
-			corev1ac.EnvVar().WithName("PINNED_CERT").WithValueFrom(
-				corev1ac.EnvVarSource().WithSecretKeyRef(
-					corev1ac.SecretKeySelector().WithName(secret.Name).WithKey("pinned_cert_hash"),
-				),
-			),
-		)
+	for k, v := range injected.Annotations {
+		template.Annotations[k] = v
 	}
-
-	initContainer := corev1ac.Container().
-		WithName(initContainerName).
-		WithImage(spec.InitContainer.Image).
-		WithVolumeMounts(volumeMounts...).
-		WithEnv(envVars...).
-		WithSecurityContext(
-			corev1ac.SecurityContext().
-				WithCapabilities(
-					corev1ac.Capabilities().WithDrop(corev1.Capability("ALL")),
-				).
-				WithRunAsNonRoot(true).
-				WithAllowPrivilegeEscalation(false).
-				WithSeccompProfile(
-					corev1ac.SeccompProfile().
-						WithType(corev1.SeccompProfileTypeRuntimeDefault),
-				),
-		).
-		WithResources(
-			corev1ac.ResourceRequirements().
-				WithLimits(
-					corev1.ResourceList{
-						corev1.ResourceCPU:    *resource.NewMilliQuantity(int64(50), resource.BinarySI),
-						corev1.ResourceMemory: *resource.NewScaledQuantity(int64(64), resource.Scale(6)), // 64M
-					},
-				).WithRequests(
-				corev1.ResourceList{
-					corev1.ResourceCPU:    *resource.NewMilliQuantity(int64(50), resource.BinarySI),
-					corev1.ResourceMemory: *resource.NewScaledQuantity(int64(64), resource.Scale(6)),
-				},
-			),
-		)
-	if isImagePullPolicyConfigured {
-		initContainer.WithImagePullPolicy(spec.InitContainer.ImagePullPolicy)
+	for _, volume := range injected.Spec.Volumes {
+		template.Spec.Volumes = slices.DeleteFunc(template.Spec.Volumes, func(v corev1.Volume) bool { return v.Name == volume.Name })
+		template.Spec.Volumes = append(template.Spec.Volumes, volume)
 	}
-	statefulSetApplyConfig.Spec.Template.Spec.WithInitContainers(initContainer)
-}
-
-func (r *LightrunJavaAgentReconciler) patchStatefulSetAppContainers(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, origStatefulSet *appsv1.StatefulSet, statefulSetApplyConfig *appsv1ac.StatefulSetApplyConfiguration) error {
-	var found bool = false
-	for _, container := range origStatefulSet.Spec.Template.Spec.Containers {
-		for _, targetContainer := range lightrunJavaAgent.Spec.ContainerSelector {
-			if targetContainer == container.Name {
-				found = true
-				statefulSetApplyConfig.Spec.Template.Spec.WithContainers(
-					corev1ac.Container().
-						WithName(container.Name).
-						WithImage(container.Image).
-						WithVolumeMounts(
-							corev1ac.VolumeMount().WithMountPath(lightrunJavaAgent.Spec.InitContainer.SharedVolumeMountPath).WithName(lightrunJavaAgent.Spec.InitContainer.SharedVolumeName),
-						),
-				)
+	for _, pullSecret := range injected.Spec.ImagePullSecrets {
+		if !slices.Contains(template.Spec.ImagePullSecrets, pullSecret) {
+			template.Spec.ImagePullSecrets = append(template.Spec.ImagePullSecrets, pullSecret)
+		}
+	}
+	for _, initContainer := range injected.Spec.InitContainers {
+		template.Spec.InitContainers = slices.DeleteFunc(template.Spec.InitContainers, func(c corev1.Container) bool { return c.Name == initContainer.Name })
+		template.Spec.InitContainers = append(template.Spec.InitContainers, initContainer)
+	}
+	for _, injectedContainer := range injected.Spec.Containers {
+		for i, container := range template.Spec.Containers {
+			if container.Name != injectedContainer.Name {
+				continue
+			}
+			for _, mount := range injectedContainer.VolumeMounts {
+				template.Spec.Containers[i].VolumeMounts = slices.DeleteFunc(template.Spec.Containers[i].VolumeMounts, func(m corev1.VolumeMount) bool {
+					return m.Name == mount.Name && m.MountPath == mount.MountPath
+				})
+				template.Spec.Containers[i].VolumeMounts = append(template.Spec.Containers[i].VolumeMounts, mount)
 			}
 		}
 	}
-	if !found {
-		err = errors.New("unable to find matching container to patch")
-		return err
+}
+
+// unpatchPodTemplate removes everything that was added to the pod template by mergePodTemplate.
+// Mounts of the removed volumes are removed from every container, so no mount is left without its volume
+func unpatchPodTemplate(template *corev1.PodTemplateSpec, lightrunJavaAgent *agentv1beta.LightrunJavaAgent) {
+	volumeNames := []string{lightrunJavaAgent.Spec.InitContainer.SharedVolumeName, cmVolumeName, "lightrun-secret"}
+	delete(template.Annotations, annotationConfigMapHash)
+	if pullSecrets, ok := template.Annotations[annotationImagePullSecrets]; ok {
+		names := strings.Split(pullSecrets, ",")
+		template.Spec.ImagePullSecrets = slices.DeleteFunc(template.Spec.ImagePullSecrets, func(s corev1.LocalObjectReference) bool { return slices.Contains(names, s.Name) })
+		delete(template.Annotations, annotationImagePullSecrets)
+	}
+	template.Spec.Volumes = slices.DeleteFunc(template.Spec.Volumes, func(v corev1.Volume) bool { return slices.Contains(volumeNames, v.Name) })
+	template.Spec.InitContainers = slices.DeleteFunc(template.Spec.InitContainers, func(c corev1.Container) bool { return c.Name == initContainerName })
+	for i := range template.Spec.Containers {
+		template.Spec.Containers[i].VolumeMounts = slices.DeleteFunc(template.Spec.Containers[i].VolumeMounts, func(m corev1.VolumeMount) bool {
+			return slices.Contains(volumeNames, m.Name)
+		})
 	}
-	return nil
 }
 
 // configMapDataHash calculates a hash of the ConfigMap data to detect changes
@@ -430,3 +699,75 @@ func configMapDataHash(cmData map[string]string) uint64 {
 	}
 	return hash(hashString)
 }
+
+// rolloutPodTemplate returns the pod template of the Argo Rollout in a typed form
+func rolloutPodTemplate(rollout *unstructured.Unstructured) (*corev1.PodTemplateSpec, error) {
+	templateObj, found, err := unstructured.NestedMap(rollout.Object, "spec", "template")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("rollout has no spec.template, rollouts with workloadRef are not supported")
+	}
+	template := &corev1.PodTemplateSpec{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(templateObj, template)
+	if err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// rolloutApplyObject builds the patch object for the Argo Rollout with the whole pod template.
+// Rollout CRD doesn't define list merge keys for the pod template, so it is sent with merge patch, see rolloutMergeObject
+func rolloutApplyObject(rollout *unstructured.Unstructured, template *corev1.PodTemplateSpec, annotations map[string]string) (*unstructured.Unstructured, error) {
+	templateObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(template)
+	if err != nil {
+		return nil, err
+	}
+	unstructured.RemoveNestedField(templateObj, "metadata", "creationTimestamp")
+
+	patch := &unstructured.Unstructured{}
+	patch.SetGroupVersionKind(rolloutGVK)
+	patch.SetName(rollout.GetName())
+	patch.SetNamespace(rollout.GetNamespace())
+	if len(annotations) > 0 {
+		patch.SetAnnotations(annotations)
+	}
+	err = unstructured.SetNestedMap(patch.Object, templateObj, "spec", "template")
+	if err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// rolloutMergeObject returns a copy of the live Rollout with the pod template and the operator annotations of the patch.
+// Merge patch between them changes only the items injected or removed by the operator, server side apply
+// of the whole template would make the operator the owner of all the fields of the template
+func rolloutMergeObject(rollout *unstructured.Unstructured, patch *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	template, found, err := unstructured.NestedMap(patch.Object, "spec", "template")
+	if err != nil || !found {
+		return nil, errors.New("rollout patch has no spec.template")
+	}
+	merged := rollout.DeepCopy()
+	err = unstructured.SetNestedMap(merged.Object, template, "spec", "template")
+	if err != nil {
+		return nil, err
+	}
+	annotations := merged.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	// Annotations of the operator missing from the patch are not needed anymore. GitOps annotations
+	// with another value are set by the user
+	delete(annotations, annotationAgentName)
+	for key, value := range map[string]string{annotationArgoCDCompareOptions: argoCDServerSideDiff, annotationFluxSSA: fluxSSAMerge} {
+		if annotations[key] == value {
+			delete(annotations, key)
+		}
+	}
+	for key, value := range patch.GetAnnotations() {
+		annotations[key] = value
+	}
+	merged.SetAnnotations(annotations)
+	return merged, nil
+}
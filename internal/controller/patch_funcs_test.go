@@ -1,7 +1,24 @@
 package controller
 
 import (
+	"errors"
+	"reflect"
 	"testing"
+	"time"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/utils/pointer"
 )
 
 func Test_configMapDataHash(t *testing.T) {
@@ -82,3 +99,517 @@ func Test_configMapDataHash_key_order_independent(t *testing.T) {
 		t.Errorf("hash should be independent of insertion order: got %v and %v", hash1, hash2)
 	}
 }
+
+func Test_recreatedJob(t *testing.T) {
+	origJob := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "job",
+			Namespace:       "default",
+			UID:             "1234",
+			ResourceVersion: "42",
+			Annotations:     map[string]string{"user": "annotation"},
+		},
+		Spec: batchv1.JobSpec{
+			Suspend: pointer.Bool(true),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{batchv1.ControllerUidLabel: "1234"},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						batchv1.ControllerUidLabel: "1234",
+						batchv1.JobNameLabel:       "job",
+						"app":                      "batch",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "busybox"}},
+				},
+			},
+		},
+	}
+	templateApplyConfig := corev1ac.PodTemplateSpec().
+		WithAnnotations(map[string]string{annotationConfigMapHash: "1"}).
+		WithSpec(corev1ac.PodSpec().
+			WithVolumes(corev1ac.Volume().WithName("shared").WithEmptyDir(corev1ac.EmptyDirVolumeSource())).
+			WithInitContainers(corev1ac.Container().WithName(initContainerName).WithImage("init")).
+			WithContainers(corev1ac.Container().WithName("app").WithImage("busybox").
+				WithVolumeMounts(corev1ac.VolumeMount().WithName("shared").WithMountPath("/lightrun"))))
+	injected, err := podTemplateFromApplyConfig(templateApplyConfig)
+	if err != nil {
+		t.Fatalf("podTemplateFromApplyConfig() error = %v", err)
+	}
+
+	job := recreatedJob(origJob, map[string]string{annotationAgentName: "agent"}, injected)
+	if job.UID != "" || job.ResourceVersion != "" {
+		t.Errorf("recreatedJob() kept server populated fields: uid %q, resourceVersion %q", job.UID, job.ResourceVersion)
+	}
+	if job.Spec.Selector != nil {
+		t.Errorf("recreatedJob() kept generated selector %v", job.Spec.Selector)
+	}
+	if _, ok := job.Spec.Template.Labels[batchv1.ControllerUidLabel]; ok {
+		t.Errorf("recreatedJob() kept generated label %s", batchv1.ControllerUidLabel)
+	}
+	if job.Spec.Template.Labels["app"] != "batch" {
+		t.Errorf("recreatedJob() lost user label, got %v", job.Spec.Template.Labels)
+	}
+	if job.Annotations["user"] != "annotation" || job.Annotations[annotationAgentName] != "agent" {
+		t.Errorf("recreatedJob() annotations = %v", job.Annotations)
+	}
+	if job.Spec.Template.Annotations[annotationConfigMapHash] != "1" {
+		t.Errorf("recreatedJob() template annotations = %v", job.Spec.Template.Annotations)
+	}
+	if len(job.Spec.Template.Spec.Volumes) != 1 || len(job.Spec.Template.Spec.InitContainers) != 1 {
+		t.Errorf("recreatedJob() volumes = %v, init containers = %v", job.Spec.Template.Spec.Volumes, job.Spec.Template.Spec.InitContainers)
+	}
+	if len(job.Spec.Template.Spec.Containers[0].VolumeMounts) != 1 {
+		t.Errorf("recreatedJob() volume mounts = %v", job.Spec.Template.Spec.Containers[0].VolumeMounts)
+	}
+	if job.Spec.Suspend == nil || *job.Spec.Suspend {
+		t.Errorf("recreatedJob() should resume the job")
+	}
+	if origJob.Spec.Selector == nil || len(origJob.Spec.Template.Labels) != 3 {
+		t.Errorf("recreatedJob() modified the original job")
+	}
+}
+
+func Test_mergePodTemplate_unpatchPodTemplate(t *testing.T) {
+	lightrunJavaAgent := &agentv1beta.LightrunJavaAgent{
+		Spec: agentv1beta.LightrunJavaAgentSpec{
+			ContainerSelector: []string{"app"},
+			InitContainer: agentv1beta.InitContainer{
+				SharedVolumeName: "shared",
+			},
+		},
+	}
+	template := &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Volumes:    []corev1.Volume{{Name: "data"}},
+			Containers: []corev1.Container{{Name: "app", VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}}},
+		},
+	}
+	injected := &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{annotationConfigMapHash: "1"},
+		},
+		Spec: corev1.PodSpec{
+			Volumes:        []corev1.Volume{{Name: "shared"}, {Name: cmVolumeName}},
+			InitContainers: []corev1.Container{{Name: initContainerName}},
+			Containers:     []corev1.Container{{Name: "app", VolumeMounts: []corev1.VolumeMount{{Name: "shared", MountPath: "/lightrun"}}}},
+		},
+	}
+
+	mergePodTemplate(template, injected)
+	// Merge must be idempotent
+	mergePodTemplate(template, injected)
+	if len(template.Spec.Volumes) != 3 {
+		t.Errorf("mergePodTemplate() volumes = %v", template.Spec.Volumes)
+	}
+	if len(template.Spec.InitContainers) != 1 {
+		t.Errorf("mergePodTemplate() init containers = %v", template.Spec.InitContainers)
+	}
+	if len(template.Spec.Containers[0].VolumeMounts) != 2 {
+		t.Errorf("mergePodTemplate() volume mounts = %v", template.Spec.Containers[0].VolumeMounts)
+	}
+	if template.Annotations[annotationConfigMapHash] != "1" {
+		t.Errorf("mergePodTemplate() annotations = %v", template.Annotations)
+	}
+
+	unpatchPodTemplate(template, lightrunJavaAgent)
+	if len(template.Spec.Volumes) != 1 || template.Spec.Volumes[0].Name != "data" {
+		t.Errorf("unpatchPodTemplate() volumes = %v", template.Spec.Volumes)
+	}
+	if len(template.Spec.InitContainers) != 0 {
+		t.Errorf("unpatchPodTemplate() init containers = %v", template.Spec.InitContainers)
+	}
+	if len(template.Spec.Containers[0].VolumeMounts) != 1 || template.Spec.Containers[0].VolumeMounts[0].Name != "data" {
+		t.Errorf("unpatchPodTemplate() volume mounts = %v", template.Spec.Containers[0].VolumeMounts)
+	}
+	if _, ok := template.Annotations[annotationConfigMapHash]; ok {
+		t.Errorf("unpatchPodTemplate() annotations = %v", template.Annotations)
+	}
+}
+
+func Test_rolloutPodTemplate(t *testing.T) {
+	rollout := &unstructured.Unstructured{}
+	rollout.SetGroupVersionKind(rolloutGVK)
+	rollout.SetName("rollout")
+	rollout.SetNamespace("default")
+	if _, err := rolloutPodTemplate(rollout); err == nil {
+		t.Errorf("rolloutPodTemplate() expected error for rollout without template")
+	}
+
+	err := unstructured.SetNestedField(rollout.Object, map[string]interface{}{
+		"spec": map[string]interface{}{
+			"containers": []interface{}{map[string]interface{}{"name": "app", "image": "busybox"}},
+		},
+	}, "spec", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := rolloutPodTemplate(rollout)
+	if err != nil {
+		t.Fatalf("rolloutPodTemplate() error = %v", err)
+	}
+	if len(template.Spec.Containers) != 1 || template.Spec.Containers[0].Image != "busybox" {
+		t.Errorf("rolloutPodTemplate() containers = %v", template.Spec.Containers)
+	}
+
+	patch, err := rolloutApplyObject(rollout, template, map[string]string{annotationAgentName: "agent"})
+	if err != nil {
+		t.Fatalf("rolloutApplyObject() error = %v", err)
+	}
+	if patch.GroupVersionKind() != rolloutGVK || patch.GetName() != "rollout" || patch.GetNamespace() != "default" {
+		t.Errorf("rolloutApplyObject() object = %v", patch.Object)
+	}
+	if patch.GetAnnotations()[annotationAgentName] != "agent" {
+		t.Errorf("rolloutApplyObject() annotations = %v", patch.GetAnnotations())
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(patch.Object, "spec", "template", "metadata", "creationTimestamp"); found {
+		t.Errorf("rolloutApplyObject() kept creationTimestamp")
+	}
+	containers, _, _ := unstructured.NestedSlice(patch.Object, "spec", "template", "spec", "containers")
+	if len(containers) != 1 {
+		t.Errorf("rolloutApplyObject() containers = %v", containers)
+	}
+}
+
+func Test_rolloutMergeObject(t *testing.T) {
+	rollout := &unstructured.Unstructured{}
+	rollout.SetGroupVersionKind(rolloutGVK)
+	rollout.SetName("rollout")
+	rollout.SetAnnotations(map[string]string{
+		"team":                         "payments",
+		annotationAgentName:            "agent",
+		annotationFluxSSA:              fluxSSAMerge,
+		annotationArgoCDCompareOptions: "IgnoreExtraneous",
+	})
+	err := unstructured.SetNestedField(rollout.Object, int64(3), "spec", "replicas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "busybox"}}}}
+	patch, err := rolloutApplyObject(rollout, template, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := rolloutMergeObject(rollout, patch)
+	if err != nil {
+		t.Fatalf("rolloutMergeObject() error = %v", err)
+	}
+	// Fields outside of the pod template and annotations of the user are kept
+	if replicas, _, _ := unstructured.NestedInt64(merged.Object, "spec", "replicas"); replicas != 3 {
+		t.Errorf("rolloutMergeObject() replicas = %v", replicas)
+	}
+	wantAnnotations := map[string]string{"team": "payments", annotationArgoCDCompareOptions: "IgnoreExtraneous"}
+	if !reflect.DeepEqual(merged.GetAnnotations(), wantAnnotations) {
+		t.Errorf("rolloutMergeObject() annotations = %v, want %v", merged.GetAnnotations(), wantAnnotations)
+	}
+	mergedTemplate, err := rolloutPodTemplate(merged)
+	if err != nil || len(mergedTemplate.Spec.Containers) != 1 {
+		t.Errorf("rolloutMergeObject() template = %v, error = %v", mergedTemplate, err)
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(rollout.Object, "spec", "template"); found {
+		t.Errorf("rolloutMergeObject() changed the live object")
+	}
+}
+
+func Test_patchPodTemplate_sidecar(t *testing.T) {
+	r := &LightrunJavaAgentReconciler{}
+	origTemplate := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "busybox"}}}}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret"}}
+
+	for _, sidecar := range []bool{false, true} {
+		lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+		lightrunJavaAgent.Spec.InitContainer.Sidecar = sidecar
+		templateApplyConfig, err := r.patchPodTemplate(lightrunJavaAgent, secret, origTemplate, 42)
+		if err != nil {
+			t.Fatalf("patchPodTemplate() error = %v", err)
+		}
+		template, err := podTemplateFromApplyConfig(templateApplyConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		installer := template.Spec.InitContainers[0]
+		isSidecar := installer.RestartPolicy != nil && *installer.RestartPolicy == corev1.ContainerRestartPolicyAlways
+		if isSidecar != sidecar || (installer.StartupProbe != nil) != sidecar {
+			t.Errorf("sidecar = %v: installer restartPolicy = %v, startupProbe = %v", sidecar, installer.RestartPolicy, installer.StartupProbe)
+		}
+		// Pods are recreated on ConfigMap change only when the config is not synced by the sidecar
+		if _, hasHash := template.Annotations[annotationConfigMapHash]; hasHash == sidecar {
+			t.Errorf("sidecar = %v: annotations = %v", sidecar, template.Annotations)
+		}
+	}
+}
+
+func Test_patchPodTemplate_initContainerOverrides(t *testing.T) {
+	r := &LightrunJavaAgentReconciler{}
+	origTemplate := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "busybox"}}}}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret"}}
+	runAsUser := int64(1000)
+	readOnlyRootFilesystem := true
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeStatefulSet)
+	lightrunJavaAgent.Spec.InitContainer.Resources = &corev1.ResourceRequirements{
+		Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("20m")},
+		Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128M")},
+	}
+	lightrunJavaAgent.Spec.InitContainer.SecurityContext = &agentv1beta.InitContainerSecurityContext{
+		RunAsUser:              &runAsUser,
+		ReadOnlyRootFilesystem: &readOnlyRootFilesystem,
+	}
+	lightrunJavaAgent.Spec.InitContainer.Env = []corev1.EnvVar{
+		{Name: "HTTPS_PROXY", Value: "http://proxy:3128"},
+		{Name: "NODE_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"}}},
+		{Name: "LIGHTRUN_SERVER", Value: "overridden"},
+	}
+
+	templateApplyConfig, err := r.patchPodTemplate(lightrunJavaAgent, secret, origTemplate, 42)
+	if err != nil {
+		t.Fatalf("patchPodTemplate() error = %v", err)
+	}
+	template, err := podTemplateFromApplyConfig(templateApplyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	installer := template.Spec.InitContainers[0]
+
+	// CPU limit is lower than the default request and memory request is higher than the default limit
+	wantResources := corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("20m"),
+			corev1.ResourceMemory: resource.MustParse("128M"),
+		},
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("20m"),
+			corev1.ResourceMemory: resource.MustParse("128M"),
+		},
+	}
+	for name, want := range wantResources.Limits {
+		if got := installer.Resources.Limits[name]; got.Cmp(want) != 0 {
+			t.Errorf("limit %s = %s, want %s", name, got.String(), want.String())
+		}
+	}
+	for name, want := range wantResources.Requests {
+		if got := installer.Resources.Requests[name]; got.Cmp(want) != 0 {
+			t.Errorf("request %s = %s, want %s", name, got.String(), want.String())
+		}
+	}
+
+	sc := installer.SecurityContext
+	if sc.RunAsUser == nil || *sc.RunAsUser != runAsUser || sc.ReadOnlyRootFilesystem == nil || !*sc.ReadOnlyRootFilesystem {
+		t.Errorf("security context overrides are not applied: %v", sc)
+	}
+	if sc.RunAsNonRoot == nil || !*sc.RunAsNonRoot || sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation || sc.RunAsGroup != nil {
+		t.Errorf("security context defaults are changed: %v", sc)
+	}
+
+	env := map[string]corev1.EnvVar{}
+	for _, envVar := range installer.Env {
+		if _, ok := env[envVar.Name]; ok {
+			t.Errorf("duplicate env var %s", envVar.Name)
+		}
+		env[envVar.Name] = envVar
+	}
+	if env["LIGHTRUN_SERVER"].Value != lightrunJavaAgent.Spec.ServerHostname {
+		t.Errorf("LIGHTRUN_SERVER = %q, want %q", env["LIGHTRUN_SERVER"].Value, lightrunJavaAgent.Spec.ServerHostname)
+	}
+	if env["HTTPS_PROXY"].Value != "http://proxy:3128" {
+		t.Errorf("HTTPS_PROXY = %v", env["HTTPS_PROXY"])
+	}
+	if nodeName := env["NODE_NAME"]; nodeName.ValueFrom == nil || nodeName.ValueFrom.FieldRef == nil || nodeName.ValueFrom.FieldRef.FieldPath != "spec.nodeName" {
+		t.Errorf("NODE_NAME = %v", nodeName)
+	}
+}
+
+func Test_patchPodTemplate_imagePullSecrets(t *testing.T) {
+	r := &LightrunJavaAgentReconciler{
+		DefaultImagePullSecrets: []string{"default-registry"},
+		ImageRegistryMirror:     "registry.local",
+	}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Spec.InitContainer.Image = "lightruncom/agent:1.7.0"
+	lightrunJavaAgent.Spec.InitContainer.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "agent-registry"}, {Name: "app-registry"}}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret"}}
+	// app-registry belongs to the workload and must be kept on unpatch
+	template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers:       []corev1.Container{{Name: "app", Image: "busybox"}},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "app-registry"}},
+	}}
+
+	templateApplyConfig, err := r.patchPodTemplate(lightrunJavaAgent, secret, template, 42)
+	if err != nil {
+		t.Fatalf("patchPodTemplate() error = %v", err)
+	}
+	injected, err := podTemplateFromApplyConfig(templateApplyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image := injected.Spec.InitContainers[0].Image; image != "registry.local/lightruncom/agent:1.7.0" {
+		t.Errorf("init container image = %s", image)
+	}
+	if got := injected.Annotations[annotationImagePullSecrets]; got != "default-registry,agent-registry" {
+		t.Errorf("image pull secrets annotation = %q", got)
+	}
+
+	mergePodTemplate(template, injected)
+	if len(template.Spec.ImagePullSecrets) != 3 {
+		t.Errorf("mergePodTemplate() image pull secrets = %v", template.Spec.ImagePullSecrets)
+	}
+	// Secrets added before are still owned by the operator on the next patch
+	templateApplyConfig, err = r.patchPodTemplate(lightrunJavaAgent, secret, template, 42)
+	if err != nil {
+		t.Fatalf("patchPodTemplate() error = %v", err)
+	}
+	if len(templateApplyConfig.Spec.ImagePullSecrets) != 2 {
+		t.Errorf("repeated patchPodTemplate() image pull secrets = %v", templateApplyConfig.Spec.ImagePullSecrets)
+	}
+
+	unpatchPodTemplate(template, lightrunJavaAgent)
+	if len(template.Spec.ImagePullSecrets) != 1 || template.Spec.ImagePullSecrets[0].Name != "app-registry" {
+		t.Errorf("unpatchPodTemplate() image pull secrets = %v", template.Spec.ImagePullSecrets)
+	}
+}
+
+func Test_imageVolumePodTemplate(t *testing.T) {
+	r := &LightrunJavaAgentReconciler{}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Spec.InitContainer.InjectionMode = agentv1beta.AgentInstallModeImageVolume
+	lightrunJavaAgent.Spec.InitContainer.ImagePullPolicy = corev1.PullIfNotPresent
+	workload := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "workload", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "busybox"}},
+			Volumes:    []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}},
+		}}},
+	}
+
+	templateApplyConfig, err := r.imageVolumePodTemplate(lightrunJavaAgent, &workload.Spec.Template, 42)
+	if err != nil {
+		t.Fatalf("imageVolumePodTemplate() error = %v", err)
+	}
+	if len(templateApplyConfig.Spec.InitContainers) != 0 {
+		t.Errorf("init containers = %v, want none", templateApplyConfig.Spec.InitContainers)
+	}
+	mounts := templateApplyConfig.Spec.Containers[0].VolumeMounts
+	if len(mounts) != 3 || *mounts[0].MountPath != "/lightrun" || *mounts[1].MountPath != "/lightrun/agent/agent.config" {
+		t.Errorf("app container volume mounts = %v", mounts)
+	}
+
+	patch, err := deploymentAdapter{}.applyConfig(workload, nil, templateApplyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !setImageVolumeSource(patch.Object, "lightrun-agent-init", "init", corev1.PullIfNotPresent) {
+		t.Fatal("setImageVolumeSource() didn't find the volume")
+	}
+	volumes, _, _ := unstructured.NestedSlice(patch.Object, "spec", "template", "spec", "volumes")
+	source, _, _ := unstructured.NestedStringMap(volumes[0].(map[string]interface{}), "image")
+	if source["reference"] != "init" || source["pullPolicy"] != "IfNotPresent" {
+		t.Errorf("image volume source = %v", source)
+	}
+	if setImageVolumeSource(patch.Object, "missing", "init", "") {
+		t.Error("setImageVolumeSource() found missing volume")
+	}
+}
+
+func Test_imageVolumeRejected(t *testing.T) {
+	deployment := schema.GroupKind{Group: "apps", Kind: "Deployment"}
+	invalid := func(causes ...metav1.StatusCause) error {
+		errs := field.ErrorList{}
+		for _, cause := range causes {
+			errs = append(errs, &field.Error{Type: field.ErrorType(cause.Type), Field: cause.Field})
+		}
+		return apierrors.NewInvalid(deployment, "workload", errs)
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "image source dropped by the API server",
+			err:  invalid(metav1.StatusCause{Type: metav1.CauseTypeFieldValueRequired, Field: "spec.template.spec.volumes[2]"}),
+			want: true,
+		},
+		{
+			name: "image source rejected",
+			err:  invalid(metav1.StatusCause{Type: metav1.CauseType(field.ErrorTypeForbidden), Field: "spec.jobTemplate.spec.template.spec.volumes[0].image"}),
+			want: true,
+		},
+		{
+			name: "image field unknown to the API server",
+			err:  apierrors.NewBadRequest(`failed to create typed patch object: .spec.template.spec.volumes[name="lightrun-agent-init"].image: field not declared in schema`),
+			want: true,
+		},
+		{
+			name: "invalid mount of another volume",
+			err:  invalid(metav1.StatusCause{Type: metav1.CauseTypeFieldValueNotFound, Field: "spec.template.spec.containers[0].volumeMounts[1].name"}),
+		},
+		{
+			name: "invalid volume of the workload",
+			err:  invalid(metav1.StatusCause{Type: metav1.CauseTypeFieldValueInvalid, Field: "spec.template.spec.volumes[1].name"}),
+		},
+		{
+			name: "unrelated bad request",
+			err:  apierrors.NewBadRequest("volumes are not allowed"),
+		},
+		{
+			name: "not an API error",
+			err:  errors.New("spec.template.spec.volumes[0]"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := imageVolumeRejected(tt.err, "lightrun-agent-init"); got != tt.want {
+				t.Errorf("imageVolumeRejected() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_imageVolumesState(t *testing.T) {
+	r := &LightrunJavaAgentReconciler{}
+	now := time.Now()
+	if state := r.imageVolumesState(now); state != imageVolumesUnknown {
+		t.Fatalf("imageVolumesState() before detection = %v", state)
+	}
+	r.setImageVolumesState(imageVolumesUnsupported, now)
+	if state := r.imageVolumesState(now.Add(time.Minute)); state != imageVolumesUnsupported {
+		t.Errorf("imageVolumesState() after detection = %v", state)
+	}
+	if state := r.imageVolumesState(now.Add(imageVolumesCheckInterval + time.Minute)); state != imageVolumesUnknown {
+		t.Errorf("imageVolumesState() after check interval = %v", state)
+	}
+}
+
+func Test_createAgentConfigSecret(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &LightrunJavaAgentReconciler{Scheme: scheme}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Spec.AgentConfig = map[string]string{"max_log_cpu_cost": "2"}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret"},
+		Data:       map[string][]byte{"lightrun_key": []byte("key"), "pinned_cert_hash": []byte("hash")},
+	}
+
+	configSecret, err := r.createAgentConfigSecret(lightrunJavaAgent, secret)
+	if err != nil {
+		t.Fatalf("createAgentConfigSecret() error = %v", err)
+	}
+	want := "com.lightrun.server=https://example.lightrun.com\ncom.lightrun.secret=key\npinned_certs=hash\nmax_log_cpu_cost=2\n"
+	if got := string(configSecret.Data["agent.config"]); got != want {
+		t.Errorf("agent.config = %q, want %q", got, want)
+	}
+	if configSecret.Name != configSecretNamePrefix+lightrunJavaAgent.Name || len(configSecret.OwnerReferences) != 1 {
+		t.Errorf("secret metadata = %v", configSecret.ObjectMeta)
+	}
+
+	delete(secret.Data, "pinned_cert_hash")
+	if _, err = r.createAgentConfigSecret(lightrunJavaAgent, secret); err == nil {
+		t.Error("createAgentConfigSecret() succeeded without pinned_cert_hash")
+	}
+}
@@ -0,0 +1,220 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+// PodInjectionWebhookPath is the path of the pod injection webhook in the webhook server
+const PodInjectionWebhookPath = "/mutate-v1-pod"
+
+//+kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create,versions=v1,name=mpod.agents.lightrun.com,admissionReviewVersions=v1
+//+kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get
+
+// PodInjector is the mutating admission webhook that injects the agent into pods of the workloads targeted by
+// LightrunJavaAgents with Webhook injection mode. Injection is the same as the one done by the reconciler
+// for the workload pod template, but workload manifests stay untouched.
+// Pod is always admitted, if the agent can't be injected the reason is returned as a warning
+type PodInjector struct {
+	*LightrunJavaAgentReconciler
+	// Reader is used to find the workload owning the pod. ReplicaSets and Jobs are usually created
+	// just before their pods, so uncached reader is expected here
+	Reader  client.Reader
+	decoder *admission.Decoder
+}
+
+// NewPodInjector returns the pod injection webhook handler sharing the patch logic of the reconciler
+func NewPodInjector(reconciler *LightrunJavaAgentReconciler, reader client.Reader) *PodInjector {
+	return &PodInjector{
+		LightrunJavaAgentReconciler: reconciler,
+		Reader:                      reader,
+		decoder:                     admission.NewDecoder(reconciler.Scheme),
+	}
+}
+
+func (p *PodInjector) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+	if err := p.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// Namespace is not set yet for pods created by controllers
+	namespace := req.Namespace
+	log := p.Log.WithValues("namespace", namespace, "pod", pod.GenerateName+pod.Name)
+
+	for _, container := range pod.Spec.InitContainers {
+		if container.Name == initContainerName {
+			// Pod template was already patched by the reconciler
+			return admission.Allowed("agent already injected")
+		}
+	}
+
+	// Cached list of the agents goes first, owners of the pod are fetched with uncached reads only if it is needed
+	agents, err := p.webhookAgents(ctx, namespace)
+	if err != nil {
+		log.Error(err, "unable to list LightrunJavaAgents")
+		return admission.Allowed("").WithWarnings("lightrun agent is not injected: " + err.Error())
+	}
+	if len(agents) == 0 {
+		return admission.Allowed("no LightrunJavaAgent with Webhook injection mode in the namespace")
+	}
+
+	kind, workload, err := p.podWorkload(ctx, pod, namespace)
+	if err != nil {
+		log.Error(err, "unable to find workload of the pod")
+		return admission.Allowed("").WithWarnings("lightrun agent is not injected: " + err.Error())
+	}
+	if workload == nil {
+		return admission.Allowed("pod is not owned by a supported workload")
+	}
+
+	lightrunJavaAgent := findAgent(agents, kind, workload)
+	if lightrunJavaAgent == nil {
+		return admission.Allowed("pod is not targeted by LightrunJavaAgent")
+	}
+
+	log = log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name)
+	err = p.injectAgent(ctx, lightrunJavaAgent, pod, namespace)
+	if err != nil {
+		log.Error(err, "failed to inject agent")
+		return admission.Allowed("").WithWarnings("lightrun agent is not injected: " + err.Error())
+	}
+	marshaledPod, err := json.Marshal(pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	log.V(1).Info("Agent injected into pod", "kind", kind, "workload", workload.GetName())
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+}
+
+// podWorkload returns the kind and the top level workload owning the pod, following ReplicaSet and Job owners.
+// nil workload is returned for pods that are not owned by a supported workload
+func (p *PodInjector) podWorkload(ctx context.Context, pod *corev1.Pod, namespace string) (agentv1beta.WorkloadType, client.Object, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return "", nil, nil
+	}
+	switch owner.Kind {
+	case "ReplicaSet":
+		replicaSet := &appsv1.ReplicaSet{}
+		err := p.Reader.Get(ctx, client.ObjectKey{Name: owner.Name, Namespace: namespace}, replicaSet)
+		if err != nil {
+			return "", nil, err
+		}
+		// Deployment or Argo Rollout
+		if owner = metav1.GetControllerOf(replicaSet); owner == nil {
+			return "", nil, nil
+		}
+	case "Job":
+		job := &batchv1.Job{}
+		err := p.Reader.Get(ctx, client.ObjectKey{Name: owner.Name, Namespace: namespace}, job)
+		if err != nil {
+			return "", nil, err
+		}
+		if cronJob := metav1.GetControllerOf(job); cronJob != nil && cronJob.Kind == string(agentv1beta.WorkloadTypeCronJob) {
+			owner = cronJob
+		}
+	}
+
+	kind := agentv1beta.WorkloadType(owner.Kind)
+	adapter, err := newWorkloadAdapter(kind, nil)
+	if err != nil {
+		// Not supported kind
+		return "", nil, nil
+	}
+	workload := adapter.newObject()
+	err = p.Reader.Get(ctx, client.ObjectKey{Name: owner.Name, Namespace: namespace}, workload)
+	if err != nil {
+		return "", nil, err
+	}
+	return kind, workload, nil
+}
+
+// webhookAgents returns the active LightrunJavaAgents with Webhook injection mode in the namespace
+func (p *PodInjector) webhookAgents(ctx context.Context, namespace string) ([]*agentv1beta.LightrunJavaAgent, error) {
+	var agents agentv1beta.LightrunJavaAgentList
+	err := p.List(ctx, &agents, client.InNamespace(namespace))
+	if err != nil {
+		return nil, err
+	}
+	var active []*agentv1beta.LightrunJavaAgent
+	for i := range agents.Items {
+		agent := &agents.Items[i]
+		if agent.Spec.InjectionMode != agentv1beta.InjectionModeWebhook || agent.Spec.DryRun || agent.Spec.Suspend || !agent.DeletionTimestamp.IsZero() || validateExpiry(&agent.Spec) != nil || agentExpired(agent, time.Now()) {
+			continue
+		}
+		active = append(active, agent)
+	}
+	return active, nil
+}
+
+// findAgent returns the LightrunJavaAgent targeting the workload
+func findAgent(agents []*agentv1beta.LightrunJavaAgent, kind agentv1beta.WorkloadType, workload client.Object) *agentv1beta.LightrunJavaAgent {
+	for _, agent := range agents {
+		if agentTargetsWorkload(agent, kind, workload) {
+			return agent
+		}
+	}
+	return nil
+}
+
+// injectAgent adds the init container, volumes and agent env var to the pod
+func (p *PodInjector) injectAgent(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, pod *corev1.Pod, namespace string) error {
+	if lightrunJavaAgent.Spec.InitContainer.InjectionMode == agentv1beta.AgentInstallModeImageVolume {
+		return errors.New("initContainer.injectionMode ImageVolume can't be used with Webhook injection mode")
+	}
+	secret := &corev1.Secret{}
+	err := p.Get(ctx, client.ObjectKey{Name: lightrunJavaAgent.Spec.SecretName, Namespace: namespace}, secret)
+	if err != nil {
+		return err
+	}
+	// ConfigMap is created by the reconciler, pod can't start without it
+	cm := &corev1.ConfigMap{}
+	err = p.Get(ctx, client.ObjectKey{Name: cmNamePrefix + lightrunJavaAgent.Name, Namespace: namespace}, cm)
+	if err != nil {
+		return err
+	}
+	agentArg, err := agentEnvVarArgument(lightrunJavaAgent.Spec.InitContainer.SharedVolumeMountPath, lightrunJavaAgent.Spec.AgentCliFlags)
+	if err != nil {
+		return err
+	}
+
+	template := &corev1.PodTemplateSpec{ObjectMeta: pod.ObjectMeta, Spec: pod.Spec}
+	templateApplyConfig, err := p.patchPodTemplate(lightrunJavaAgent, secret, template, configMapDataHash(cm.Data))
+	if err != nil {
+		return err
+	}
+	injected, err := podTemplateFromApplyConfig(templateApplyConfig)
+	if err != nil {
+		return err
+	}
+	mergePodTemplate(template, injected)
+	for i, container := range template.Spec.Containers {
+		for _, targetContainer := range lightrunJavaAgent.Spec.ContainerSelector {
+			if targetContainer == container.Name {
+				err = p.patchJavaToolEnv(template.Annotations, &template.Spec.Containers[i], agentEnvVarName(lightrunJavaAgent), agentArg)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	template.Annotations[annotationAgentName] = lightrunJavaAgent.Name
+	template.Annotations[annotationPatchedEnvName] = agentEnvVarName(lightrunJavaAgent)
+	template.Annotations[annotationPatchedEnvValue] = agentArg
+
+	pod.ObjectMeta = template.ObjectMeta
+	pod.Spec = template.Spec
+	return nil
+}
@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func testPodInjector(t *testing.T, objs ...client.Object) *PodInjector {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	return NewPodInjector(&LightrunJavaAgentReconciler{Client: c, Scheme: scheme, Log: zap.New()}, c)
+}
+
+func Test_PodInjector_Handle(t *testing.T) {
+	isController := true
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "workload", Namespace: "default"}}
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "workload-5d8f", Namespace: "default",
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: deployment.Name, Controller: &isController}}}}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "default"}}
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: cmNamePrefix + "agent", Namespace: "default"}}
+	webhookAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	webhookAgent.Spec.InjectionMode = agentv1beta.InjectionModeWebhook
+	webhookAgent.Spec.AgentEnvVarName = "JAVA_TOOL_OPTIONS"
+	patchAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	patchAgent.Spec.InjectionMode = agentv1beta.InjectionModePatch
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "workload-5d8f-",
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: replicaSet.Name, Controller: &isController}}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "busybox"}}},
+	}
+	rawPod, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: rawPod},
+	}}
+
+	tests := []struct {
+		name        string
+		objs        []client.Object
+		wantPatched bool
+		wantWarning bool
+	}{
+		{
+			name:        "webhook mode agent targets the pod deployment",
+			objs:        []client.Object{deployment, replicaSet, secret, cm, webhookAgent},
+			wantPatched: true,
+		},
+		{
+			name: "patch mode agent is ignored",
+			objs: []client.Object{deployment, replicaSet, secret, cm, patchAgent},
+		},
+		{
+			// ReplicaSet would be missing for the uncached reader, but it isn't read without webhook mode agents
+			name: "owner is not fetched without webhook mode agents",
+			objs: []client.Object{secret, cm, patchAgent},
+		},
+		{
+			name:        "missing secret",
+			objs:        []client.Object{deployment, replicaSet, cm, webhookAgent},
+			wantWarning: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := testPodInjector(t, tt.objs...).Handle(context.Background(), req)
+			if !resp.Allowed {
+				t.Fatalf("Handle() denied the pod: %v", resp.Result)
+			}
+			if patched := len(resp.Patches) > 0; patched != tt.wantPatched {
+				t.Errorf("Handle() patched = %v, want %v", patched, tt.wantPatched)
+			}
+			if warned := len(resp.Warnings) > 0; warned != tt.wantWarning {
+				t.Errorf("Handle() warnings = %v, want warning %v", resp.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func Test_PodInjector_injectAgent(t *testing.T) {
+	agent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	agent.Spec.AgentEnvVarName = "JAVA_TOOL_OPTIONS"
+	p := testPodInjector(t,
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "default"}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: cmNamePrefix + agent.Name, Namespace: "default"}},
+	)
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		{Name: "app", Image: "busybox", Env: []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g"}}},
+		{Name: "sidecar", Image: "busybox"},
+	}}}
+
+	if err := p.injectAgent(context.Background(), agent, pod, "default"); err != nil {
+		t.Fatalf("injectAgent() error = %v", err)
+	}
+	if len(pod.Spec.InitContainers) != 1 || pod.Spec.InitContainers[0].Name != initContainerName {
+		t.Errorf("init containers = %v, want %s", pod.Spec.InitContainers, initContainerName)
+	}
+	agentArg := pod.Annotations[annotationPatchedEnvValue]
+	if agentArg == "" || pod.Annotations[annotationAgentName] != agent.Name {
+		t.Errorf("pod annotations = %v", pod.Annotations)
+	}
+	if env := pod.Spec.Containers[0].Env; len(env) != 1 || env[0].Value != "-Xmx1g "+agentArg {
+		t.Errorf("app container env = %v", env)
+	}
+	if len(pod.Spec.Containers[0].VolumeMounts) != 1 || len(pod.Spec.Containers[1].VolumeMounts) != 0 {
+		t.Errorf("volume mounts: app = %v, sidecar = %v", pod.Spec.Containers[0].VolumeMounts, pod.Spec.Containers[1].VolumeMounts)
+	}
+}
+
+func Test_PodInjector_injectAgent_defaultEnvVar(t *testing.T) {
+	agent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	p := testPodInjector(t,
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "default"}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: cmNamePrefix + agent.Name, Namespace: "default"}},
+	)
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "busybox"}}}}
+
+	if err := p.injectAgent(context.Background(), agent, pod, "default"); err != nil {
+		t.Fatalf("injectAgent() error = %v", err)
+	}
+	if env := pod.Spec.Containers[0].Env; len(env) != 1 || env[0].Name != defaultAgentEnvVarName {
+		t.Errorf("app container env = %v, want %s", env, defaultAgentEnvVarName)
+	}
+	if pod.Annotations[annotationPatchedEnvName] != defaultAgentEnvVarName {
+		t.Errorf("pod annotations = %v", pod.Annotations)
+	}
+
+	// Image volume mounts aren't supported by the webhook, pod is left as is
+	agent.Spec.InitContainer.InjectionMode = agentv1beta.AgentInstallModeImageVolume
+	pod = &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "busybox"}}}}
+	if err := p.injectAgent(context.Background(), agent, pod, "default"); err == nil || len(pod.Spec.InitContainers) != 0 {
+		t.Errorf("injectAgent() with ImageVolume error = %v, init containers = %v", err, pod.Spec.InitContainers)
+	}
+}
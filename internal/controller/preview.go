@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+// previewWorkload returns the changes of the workload that patchWorkload would make, without applying them.
+// Server side apply patch is validated with dry run, agent env var is patched on the dry run result
+func (r *LightrunJavaAgentReconciler) previewWorkload(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, adapter workloadAdapter, workload client.Object, secret *corev1.Secret, agentArg string, cmDataHash uint64) (*agentv1beta.WorkloadPatchPreview, error) {
+	patch, err := r.workloadApplyPatch(ctx, lightrunJavaAgent, adapter, workload, secret, cmDataHash)
+	if err != nil {
+		return nil, err
+	}
+	err = setCanaryPartition(lightrunJavaAgent, workload, patch)
+	if err != nil {
+		return nil, err
+	}
+	err = r.applyWorkload(ctx, workload, patch, true)
+	if err != nil {
+		return nil, err
+	}
+	dryRunWorkload := adapter.newObject()
+	if u, ok := dryRunWorkload.(*unstructured.Unstructured); ok {
+		u.Object = patch.Object
+	} else if err = runtime.DefaultUnstructuredConverter.FromUnstructured(patch.Object, dryRunWorkload); err != nil {
+		return nil, err
+	}
+	template, err := adapter.podTemplate(dryRunWorkload)
+	if err != nil {
+		return nil, err
+	}
+	annotations := map[string]string{}
+	for k, v := range dryRunWorkload.GetAnnotations() {
+		annotations[k] = v
+	}
+	err = r.patchContainersEnv(lightrunJavaAgent, template, annotations, agentArg)
+	if err != nil {
+		return nil, err
+	}
+	origTemplate, err := adapter.podTemplate(workload)
+	if err != nil {
+		return nil, err
+	}
+	return templatePreview(lightrunJavaAgent, origTemplate, template), nil
+}
+
+// templatePreview returns the summary of the changes between the original and the patched pod templates
+func templatePreview(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, origTemplate, template *corev1.PodTemplateSpec) *agentv1beta.WorkloadPatchPreview {
+	preview := &agentv1beta.WorkloadPatchPreview{
+		RolloutRequired: !apiequality.Semantic.DeepEqual(origTemplate, template),
+	}
+	preview.AddedVolumes, preview.RemovedVolumes = diffNames(volumeNames(origTemplate.Spec.Volumes), volumeNames(template.Spec.Volumes))
+	preview.AddedInitContainers, preview.RemovedInitContainers = diffNames(containerNames(origTemplate.Spec.InitContainers), containerNames(template.Spec.InitContainers))
+
+	envVarName := agentEnvVarName(lightrunJavaAgent)
+	for _, container := range template.Spec.Containers {
+		origContainer := corev1.Container{}
+		for _, c := range origTemplate.Spec.Containers {
+			if c.Name == container.Name {
+				origContainer = c
+			}
+		}
+		containerPreview := agentv1beta.ContainerPatchPreview{Name: container.Name}
+		containerPreview.AddedVolumeMounts, containerPreview.RemovedVolumeMounts = diffNames(volumeMountNames(origContainer.VolumeMounts), volumeMountNames(container.VolumeMounts))
+		before, after := envVarValue(envVarName, origContainer.Env), envVarValue(envVarName, container.Env)
+		if before != after {
+			containerPreview.EnvVar = envVarName
+			containerPreview.EnvBefore = before
+			containerPreview.EnvAfter = after
+		}
+		if containerPreview.AddedVolumeMounts != nil || containerPreview.RemovedVolumeMounts != nil || containerPreview.EnvVar != "" {
+			preview.Containers = append(preview.Containers, containerPreview)
+		}
+	}
+	return preview
+}
+
+// diffNames returns the sorted names that are only in the new list and only in the old list
+func diffNames(oldNames, newNames []string) (added, removed []string) {
+	for _, name := range newNames {
+		if !containsString(oldNames, name) {
+			added = append(added, name)
+		}
+	}
+	for _, name := range oldNames {
+		if !containsString(newNames, name) {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func volumeNames(volumes []corev1.Volume) []string {
+	names := make([]string, 0, len(volumes))
+	for _, volume := range volumes {
+		names = append(names, volume.Name)
+	}
+	return names
+}
+
+func containerNames(containers []corev1.Container) []string {
+	names := make([]string, 0, len(containers))
+	for _, container := range containers {
+		names = append(names, container.Name)
+	}
+	return names
+}
+
+func volumeMountNames(mounts []corev1.VolumeMount) []string {
+	names := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		names = append(names, mount.Name+":"+mount.MountPath)
+	}
+	return names
+}
+
+func envVarValue(name string, env []corev1.EnvVar) string {
+	index := findEnvVarIndex(name, env)
+	if index == -1 {
+		return ""
+	}
+	return env[index].Value
+}
@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_templatePreview(t *testing.T) {
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Spec.AgentEnvVarName = "JAVA_TOOL_OPTIONS"
+	origTemplate := &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{{Name: "data"}},
+			Containers: []corev1.Container{
+				{Name: "app", Env: []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g"}}},
+				{Name: "proxy"},
+			},
+		},
+	}
+	injected := &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationConfigMapHash: "1"}},
+		Spec: corev1.PodSpec{
+			Volumes:        []corev1.Volume{{Name: "lightrun-agent-init"}, {Name: cmVolumeName}},
+			InitContainers: []corev1.Container{{Name: initContainerName}},
+			Containers:     []corev1.Container{{Name: "app", VolumeMounts: []corev1.VolumeMount{{Name: "lightrun-agent-init", MountPath: "/lightrun"}}}},
+		},
+	}
+	template := origTemplate.DeepCopy()
+	mergePodTemplate(template, injected)
+	r := &LightrunJavaAgentReconciler{}
+	if err := r.patchContainersEnv(lightrunJavaAgent, template, map[string]string{}, "-agentpath:/lightrun/agent/lightrun_agent.so"); err != nil {
+		t.Fatal(err)
+	}
+
+	preview := templatePreview(lightrunJavaAgent, origTemplate, template)
+	want := &agentv1beta.WorkloadPatchPreview{
+		RolloutRequired:     true,
+		AddedVolumes:        []string{"lightrun-agent-init", cmVolumeName},
+		AddedInitContainers: []string{initContainerName},
+		Containers: []agentv1beta.ContainerPatchPreview{{
+			Name:              "app",
+			AddedVolumeMounts: []string{"lightrun-agent-init:/lightrun"},
+			EnvVar:            "JAVA_TOOL_OPTIONS",
+			EnvBefore:         "-Xmx1g",
+			EnvAfter:          "-Xmx1g -agentpath:/lightrun/agent/lightrun_agent.so",
+		}},
+	}
+	if !reflect.DeepEqual(preview, want) {
+		t.Errorf("templatePreview() = %+v, want %+v", preview, want)
+	}
+
+	// Patched workload without changes
+	preview = templatePreview(lightrunJavaAgent, template, template.DeepCopy())
+	if !reflect.DeepEqual(preview, &agentv1beta.WorkloadPatchPreview{}) {
+		t.Errorf("templatePreview() of unchanged template = %+v", preview)
+	}
+	unpatched := template.DeepCopy()
+	unpatchPodTemplate(unpatched, lightrunJavaAgent)
+	preview = templatePreview(lightrunJavaAgent, template, unpatched)
+	if !preview.RolloutRequired || len(preview.RemovedVolumes) != 2 || len(preview.RemovedInitContainers) != 1 {
+		t.Errorf("templatePreview() of removed agent = %+v", preview)
+	}
+}
+
+func Test_workloadStatusFromConditions_dryRun(t *testing.T) {
+	conditions := []metav1.Condition{}
+	setReconcileConditions(&conditions, 1, metav1.ConditionFalse, metav1.ConditionFalse, metav1.ConditionFalse, reasonDryRun, reasonDryRun, "")
+	if got := workloadStatusFromConditions(conditions); got != reconcileTypeDryRun {
+		t.Errorf("workloadStatusFromConditions() = %v, want %v", got, reconcileTypeDryRun)
+	}
+}
@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+// parseMaintenanceWindow returns the schedule of the maintenance window starts
+func parseMaintenanceWindow(window *agentv1beta.MaintenanceWindow) (cron.Schedule, error) {
+	if window == nil {
+		return nil, errors.New("maintenanceWindow must be set with MaintenanceWindow rollout policy")
+	}
+	if window.Duration.Duration <= 0 {
+		return nil, errors.New("maintenanceWindow duration must be positive")
+	}
+	return cron.ParseStandard(window.Schedule)
+}
+
+// maintenanceWindowActive reports whether the time is inside of the maintenance window.
+// Otherwise it returns the start of the next window
+func maintenanceWindowActive(window *agentv1beta.MaintenanceWindow, now time.Time) (bool, time.Time, error) {
+	schedule, err := parseMaintenanceWindow(window)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	// The last window started before now if the first start after now-duration is not after now
+	if start := schedule.Next(now.Add(-window.Duration.Duration)); !start.After(now) {
+		return true, time.Time{}, nil
+	}
+	return false, schedule.Next(now), nil
+}
+
+// rolloutConfigHash returns the agent config hash to set in the pod template of the workload.
+// Hash of the workload patched before is kept until rolloutPolicy allows the pods to be recreated.
+// Workload that is not patched yet gets the current hash, as its pods are recreated by the patch anyway
+func rolloutConfigHash(lightrunJavaAgent *agentv1beta.LightrunJavaAgent, origTemplate *corev1.PodTemplateSpec, cmDataHash uint64, now time.Time) (uint64, error) {
+	policy := lightrunJavaAgent.Spec.RolloutPolicy
+	if policy == "" || policy == agentv1beta.RolloutPolicyImmediate {
+		return cmDataHash, nil
+	}
+	appliedHash, err := strconv.ParseUint(origTemplate.Annotations[annotationConfigMapHash], 10, 64)
+	if err != nil || appliedHash == cmDataHash {
+		return cmDataHash, nil
+	}
+	if policy == agentv1beta.RolloutPolicyMaintenanceWindow {
+		active, _, err := maintenanceWindowActive(lightrunJavaAgent.Spec.MaintenanceWindow, now)
+		if err != nil {
+			return 0, withReason(reasonInvalidSpec, err)
+		}
+		if active {
+			return cmDataHash, nil
+		}
+	}
+	return appliedHash, nil
+}
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_maintenanceWindowActive(t *testing.T) {
+	// Saturdays 02:00-04:00 UTC
+	window := &agentv1beta.MaintenanceWindow{Schedule: "0 2 * * 6", Duration: metav1.Duration{Duration: 2 * time.Hour}}
+	saturday := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	nextSaturday := saturday.AddDate(0, 0, 7)
+	tests := []struct {
+		name       string
+		now        time.Time
+		wantActive bool
+		wantNext   time.Time
+	}{
+		{"before window", saturday.Add(time.Hour), false, saturday.Add(2 * time.Hour)},
+		{"window start", saturday.Add(2 * time.Hour), true, time.Time{}},
+		{"inside window", saturday.Add(3 * time.Hour), true, time.Time{}},
+		{"window end", saturday.Add(4 * time.Hour), false, nextSaturday.Add(2 * time.Hour)},
+		{"other day", saturday.AddDate(0, 0, 3), false, nextSaturday.Add(2 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			active, next, err := maintenanceWindowActive(window, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if active != tt.wantActive || !next.Equal(tt.wantNext) {
+				t.Errorf("maintenanceWindowActive() = %v, %v, want %v, %v", active, next, tt.wantActive, tt.wantNext)
+			}
+		})
+	}
+
+	if _, _, err := maintenanceWindowActive(&agentv1beta.MaintenanceWindow{Schedule: "0 2 * * 6"}, saturday); err == nil {
+		t.Errorf("maintenanceWindowActive() without duration returned no error")
+	}
+}
+
+func Test_rolloutConfigHash(t *testing.T) {
+	patchedTemplate := &corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationConfigMapHash: "1"}}}
+	window := &agentv1beta.MaintenanceWindow{Schedule: "0 2 * * 6", Duration: metav1.Duration{Duration: 2 * time.Hour}}
+	saturday := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		policy   agentv1beta.RolloutPolicy
+		template *corev1.PodTemplateSpec
+		now      time.Time
+		want     uint64
+	}{
+		{"default policy", "", patchedTemplate, saturday, 2},
+		{"immediate", agentv1beta.RolloutPolicyImmediate, patchedTemplate, saturday, 2},
+		{"on next restart", agentv1beta.RolloutPolicyOnNextRestart, patchedTemplate, saturday, 1},
+		{"not patched workload", agentv1beta.RolloutPolicyOnNextRestart, &corev1.PodTemplateSpec{}, saturday, 2},
+		{"outside of maintenance window", agentv1beta.RolloutPolicyMaintenanceWindow, patchedTemplate, saturday, 1},
+		{"inside of maintenance window", agentv1beta.RolloutPolicyMaintenanceWindow, patchedTemplate, saturday.Add(3 * time.Hour), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeStatefulSet)
+			lightrunJavaAgent.Spec.RolloutPolicy = tt.policy
+			lightrunJavaAgent.Spec.MaintenanceWindow = window
+			got, err := rolloutConfigHash(lightrunJavaAgent, tt.template, 2, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("rolloutConfigHash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_workloadStatus_pendingConfig(t *testing.T) {
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Spec.RolloutPolicy = agentv1beta.RolloutPolicyOnNextRestart
+	deployment := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationConfigMapHash: "1"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}}}
+	r := &LightrunJavaAgentReconciler{}
+
+	status := r.workloadStatus(lightrunJavaAgent, deploymentAdapter{}, deployment, 2)
+	if status.ConfigMapHash != "1" || status.PendingConfigMapHash != "2" {
+		t.Errorf("workloadStatus() hashes = %q, pending %q, want 1, pending 2", status.ConfigMapHash, status.PendingConfigMapHash)
+	}
+	status = r.workloadStatus(lightrunJavaAgent, deploymentAdapter{}, deployment, 1)
+	if status.ConfigMapHash != "1" || status.PendingConfigMapHash != "" {
+		t.Errorf("workloadStatus() hashes = %q, pending %q, want 1, no pending", status.ConfigMapHash, status.PendingConfigMapHash)
+	}
+}
@@ -0,0 +1,30 @@
+package controller
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+)
+
+// reconcileSuspended returns the workloads patched by the suspended LightrunJavaAgent to the original state,
+// the same way as on deletion. Agent ConfigMap and finalizer are kept, so the agent is injected again on resume
+func (r *LightrunJavaAgentReconciler) reconcileSuspended(ctx context.Context, lightrunJavaAgent *agentv1beta.LightrunJavaAgent, namespace string) (ctrl.Result, error) {
+	log := r.Log.WithValues("lightrunJavaAgent", lightrunJavaAgent.Name)
+	wasSuspended := meta.IsStatusConditionTrue(lightrunJavaAgent.Status.Conditions, conditionSuspended)
+	err := r.unpatchAgentWorkloads(ctx, lightrunJavaAgent, namespace)
+	if err != nil {
+		log.Error(err, "failed to unpatch workloads")
+		return r.errorStatus(ctx, lightrunJavaAgent, err)
+	}
+	setCondition(&lightrunJavaAgent.Status.Conditions, lightrunJavaAgent.Generation, conditionSuspended, metav1.ConditionTrue, reasonSuspended, "set suspend to false to inject the agent again")
+	if !wasSuspended {
+		log.Info("LightrunJavaAgent suspended, agent is removed from the workloads")
+		r.recordEvent(lightrunJavaAgent, nil, corev1.EventTypeNormal, eventReasonAgentSuspended, "agent is suspended and removed from the workloads")
+	}
+	return r.suspendedStatus(ctx, lightrunJavaAgent)
+}
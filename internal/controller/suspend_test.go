@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func Test_reconcileSuspended(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	lightrunJavaAgent.Finalizers = []string{finalizerName}
+	lightrunJavaAgent.Spec.Suspend = true
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(lightrunJavaAgent).WithStatusSubresource(lightrunJavaAgent).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &LightrunJavaAgentReconciler{Client: c, Scheme: scheme, Log: zap.New(), Recorder: recorder}
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(lightrunJavaAgent)}
+	stored := func() *agentv1beta.LightrunJavaAgent {
+		agent := &agentv1beta.LightrunJavaAgent{}
+		if err := c.Get(ctx, req.NamespacedName, agent); err != nil {
+			t.Fatal(err)
+		}
+		return agent
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+	}
+	agent := stored()
+	if !containsString(agent.Finalizers, finalizerName) {
+		t.Errorf("finalizer is removed from the suspended agent")
+	}
+	suspended := meta.FindStatusCondition(agent.Status.Conditions, conditionSuspended)
+	if suspended == nil || suspended.Status != metav1.ConditionTrue || suspended.Reason != reasonSuspended {
+		t.Errorf("Suspended condition = %+v", suspended)
+	}
+	if agent.Status.WorkloadStatus != reconcileTypeSuspended {
+		t.Errorf("workloadStatus = %v, want %v", agent.Status.WorkloadStatus, reconcileTypeSuspended)
+	}
+	// Repeated reconciliation of the suspended agent isn't recorded
+	expectEvents(t, recorder, "Normal AgentSuspended agent is suspended and removed from the workloads")
+
+	agent.Spec.Suspend = false
+	if err := c.Update(ctx, agent); err != nil {
+		t.Fatal(err)
+	}
+	// Deployment doesn't exist, resumed agent reports it
+	_, _ = r.Reconcile(ctx, req)
+	suspended = meta.FindStatusCondition(stored().Status.Conditions, conditionSuspended)
+	if suspended == nil || suspended.Status != metav1.ConditionFalse || suspended.Reason != reasonResumed {
+		t.Errorf("Suspended condition after resume = %+v", suspended)
+	}
+}
@@ -0,0 +1,312 @@
+package controller
+
+import (
+	"errors"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	appsv1ac "k8s.io/client-go/applyconfigurations/apps/v1"
+	batchv1ac "k8s.io/client-go/applyconfigurations/batch/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// workloadAdapter hides the differences between the workload kinds patched by the operator.
+// Reconcile flow, pod template patching and watch mapping are shared, so adding a new kind
+// only requires a new adapter registered in newWorkloadAdapter and workloadAdapters
+type workloadAdapter interface {
+	// kind returns the workload type as it is set in the LightrunJavaAgent spec
+	kind() agentv1beta.WorkloadType
+	// newObject returns an empty object of the workload kind, used for fetching and watching workloads
+	newObject() client.Object
+	// newObjectList returns an empty list of the workload kind, used for workloadSelector
+	newObjectList() client.ObjectList
+	// podTemplate returns a copy of the workload pod template
+	podTemplate(obj client.Object) (*corev1.PodTemplateSpec, error)
+	// setPodTemplate replaces the workload pod template
+	setPodTemplate(obj client.Object, template *corev1.PodTemplateSpec) error
+	// setRolloutProgress copies the desired, updated and ready pods of the workload to the status.
+	// Kinds without replicas leave the status as is
+	setRolloutProgress(obj client.Object, status *agentv1beta.WorkloadReconcileStatus)
+	// applyConfig returns the server side apply object with all the fields owned by the operator.
+	// Empty annotations and nil template release all the fields previously applied by the operator.
+	// The object is applied with applyWorkload
+	applyConfig(obj client.Object, annotations map[string]string, template *corev1ac.PodTemplateSpecApplyConfiguration) (*unstructured.Unstructured, error)
+}
+
+// newWorkloadAdapter returns the adapter of the workload kind for the LightrunJavaAgent
+func newWorkloadAdapter(kind agentv1beta.WorkloadType, lightrunJavaAgent *agentv1beta.LightrunJavaAgent) (workloadAdapter, error) {
+	for _, adapter := range workloadAdapters(lightrunJavaAgent) {
+		if adapter.kind() == kind {
+			return adapter, nil
+		}
+	}
+	return nil, errors.New("unsupported workload type: " + string(kind))
+}
+
+// workloadAdapters returns adapters of all the supported workload kinds
+func workloadAdapters(lightrunJavaAgent *agentv1beta.LightrunJavaAgent) []workloadAdapter {
+	return []workloadAdapter{
+		deploymentAdapter{},
+		statefulSetAdapter{},
+		daemonSetAdapter{},
+		cronJobAdapter{},
+		jobAdapter{},
+		rolloutAdapter{lightrunJavaAgent: lightrunJavaAgent},
+	}
+}
+
+func toUnstructured(applyConfig interface{}) (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(applyConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
+
+type deploymentAdapter struct{}
+
+func (deploymentAdapter) kind() agentv1beta.WorkloadType { return agentv1beta.WorkloadTypeDeployment }
+
+func (deploymentAdapter) newObject() client.Object { return &appsv1.Deployment{} }
+
+func (deploymentAdapter) newObjectList() client.ObjectList { return &appsv1.DeploymentList{} }
+
+func (deploymentAdapter) podTemplate(obj client.Object) (*corev1.PodTemplateSpec, error) {
+	return obj.(*appsv1.Deployment).Spec.Template.DeepCopy(), nil
+}
+
+func (deploymentAdapter) setPodTemplate(obj client.Object, template *corev1.PodTemplateSpec) error {
+	obj.(*appsv1.Deployment).Spec.Template = *template
+	return nil
+}
+
+func (deploymentAdapter) setRolloutProgress(obj client.Object, status *agentv1beta.WorkloadReconcileStatus) {
+	deployment := obj.(*appsv1.Deployment)
+	status.Replicas = pointer.Int32(pointer.Int32Deref(deployment.Spec.Replicas, 1))
+	status.UpdatedReplicas = pointer.Int32(deployment.Status.UpdatedReplicas)
+	status.ReadyReplicas = pointer.Int32(deployment.Status.ReadyReplicas)
+}
+
+func (deploymentAdapter) applyConfig(obj client.Object, annotations map[string]string, template *corev1ac.PodTemplateSpecApplyConfiguration) (*unstructured.Unstructured, error) {
+	applyConfig := appsv1ac.Deployment(obj.GetName(), obj.GetNamespace())
+	if len(annotations) > 0 {
+		applyConfig.WithAnnotations(annotations)
+	}
+	if template != nil {
+		applyConfig.WithSpec(appsv1ac.DeploymentSpec().WithTemplate(template))
+	}
+	return toUnstructured(applyConfig)
+}
+
+type statefulSetAdapter struct{}
+
+func (statefulSetAdapter) kind() agentv1beta.WorkloadType { return agentv1beta.WorkloadTypeStatefulSet }
+
+func (statefulSetAdapter) newObject() client.Object { return &appsv1.StatefulSet{} }
+
+func (statefulSetAdapter) newObjectList() client.ObjectList { return &appsv1.StatefulSetList{} }
+
+func (statefulSetAdapter) podTemplate(obj client.Object) (*corev1.PodTemplateSpec, error) {
+	return obj.(*appsv1.StatefulSet).Spec.Template.DeepCopy(), nil
+}
+
+func (statefulSetAdapter) setPodTemplate(obj client.Object, template *corev1.PodTemplateSpec) error {
+	obj.(*appsv1.StatefulSet).Spec.Template = *template
+	return nil
+}
+
+func (statefulSetAdapter) setRolloutProgress(obj client.Object, status *agentv1beta.WorkloadReconcileStatus) {
+	statefulSet := obj.(*appsv1.StatefulSet)
+	status.Replicas = pointer.Int32(pointer.Int32Deref(statefulSet.Spec.Replicas, 1))
+	status.UpdatedReplicas = pointer.Int32(statefulSet.Status.UpdatedReplicas)
+	status.ReadyReplicas = pointer.Int32(statefulSet.Status.ReadyReplicas)
+}
+
+func (statefulSetAdapter) applyConfig(obj client.Object, annotations map[string]string, template *corev1ac.PodTemplateSpecApplyConfiguration) (*unstructured.Unstructured, error) {
+	applyConfig := appsv1ac.StatefulSet(obj.GetName(), obj.GetNamespace())
+	if len(annotations) > 0 {
+		applyConfig.WithAnnotations(annotations)
+	}
+	if template != nil {
+		applyConfig.WithSpec(appsv1ac.StatefulSetSpec().WithTemplate(template))
+	}
+	return toUnstructured(applyConfig)
+}
+
+type daemonSetAdapter struct{}
+
+func (daemonSetAdapter) kind() agentv1beta.WorkloadType { return agentv1beta.WorkloadTypeDaemonSet }
+
+func (daemonSetAdapter) newObject() client.Object { return &appsv1.DaemonSet{} }
+
+func (daemonSetAdapter) newObjectList() client.ObjectList { return &appsv1.DaemonSetList{} }
+
+func (daemonSetAdapter) podTemplate(obj client.Object) (*corev1.PodTemplateSpec, error) {
+	return obj.(*appsv1.DaemonSet).Spec.Template.DeepCopy(), nil
+}
+
+func (daemonSetAdapter) setPodTemplate(obj client.Object, template *corev1.PodTemplateSpec) error {
+	obj.(*appsv1.DaemonSet).Spec.Template = *template
+	return nil
+}
+
+func (daemonSetAdapter) setRolloutProgress(obj client.Object, status *agentv1beta.WorkloadReconcileStatus) {
+	daemonSet := obj.(*appsv1.DaemonSet)
+	status.Replicas = pointer.Int32(daemonSet.Status.DesiredNumberScheduled)
+	status.UpdatedReplicas = pointer.Int32(daemonSet.Status.UpdatedNumberScheduled)
+	status.ReadyReplicas = pointer.Int32(daemonSet.Status.NumberReady)
+}
+
+func (daemonSetAdapter) applyConfig(obj client.Object, annotations map[string]string, template *corev1ac.PodTemplateSpecApplyConfiguration) (*unstructured.Unstructured, error) {
+	applyConfig := appsv1ac.DaemonSet(obj.GetName(), obj.GetNamespace())
+	if len(annotations) > 0 {
+		applyConfig.WithAnnotations(annotations)
+	}
+	if template != nil {
+		applyConfig.WithSpec(appsv1ac.DaemonSetSpec().WithTemplate(template))
+	}
+	return toUnstructured(applyConfig)
+}
+
+// cronJobAdapter patches the Job template of the CronJob, so only Jobs scheduled after the change get the agent
+type cronJobAdapter struct{}
+
+func (cronJobAdapter) kind() agentv1beta.WorkloadType { return agentv1beta.WorkloadTypeCronJob }
+
+func (cronJobAdapter) newObject() client.Object { return &batchv1.CronJob{} }
+
+func (cronJobAdapter) newObjectList() client.ObjectList { return &batchv1.CronJobList{} }
+
+func (cronJobAdapter) podTemplate(obj client.Object) (*corev1.PodTemplateSpec, error) {
+	return obj.(*batchv1.CronJob).Spec.JobTemplate.Spec.Template.DeepCopy(), nil
+}
+
+func (cronJobAdapter) setPodTemplate(obj client.Object, template *corev1.PodTemplateSpec) error {
+	obj.(*batchv1.CronJob).Spec.JobTemplate.Spec.Template = *template
+	return nil
+}
+
+func (cronJobAdapter) setRolloutProgress(obj client.Object, status *agentv1beta.WorkloadReconcileStatus) {
+	// Pods of the Jobs run to completion, there is no rollout to track
+}
+
+func (cronJobAdapter) applyConfig(obj client.Object, annotations map[string]string, template *corev1ac.PodTemplateSpecApplyConfiguration) (*unstructured.Unstructured, error) {
+	applyConfig := batchv1ac.CronJob(obj.GetName(), obj.GetNamespace())
+	if len(annotations) > 0 {
+		applyConfig.WithAnnotations(annotations)
+	}
+	if template != nil {
+		applyConfig.WithSpec(batchv1ac.CronJobSpec().WithJobTemplate(
+			batchv1ac.JobTemplateSpec().WithSpec(batchv1ac.JobSpec().WithTemplate(template)),
+		))
+	}
+	return toUnstructured(applyConfig)
+}
+
+// jobAdapter is used only for fetching and watching Jobs. Pod template of a Job is immutable,
+// so Jobs are recreated by reconcileJob instead of being applied
+type jobAdapter struct{}
+
+func (jobAdapter) kind() agentv1beta.WorkloadType { return agentv1beta.WorkloadTypeJob }
+
+func (jobAdapter) newObject() client.Object { return &batchv1.Job{} }
+
+func (jobAdapter) newObjectList() client.ObjectList { return &batchv1.JobList{} }
+
+func (jobAdapter) podTemplate(obj client.Object) (*corev1.PodTemplateSpec, error) {
+	return obj.(*batchv1.Job).Spec.Template.DeepCopy(), nil
+}
+
+func (jobAdapter) setPodTemplate(obj client.Object, template *corev1.PodTemplateSpec) error {
+	obj.(*batchv1.Job).Spec.Template = *template
+	return nil
+}
+
+func (jobAdapter) setRolloutProgress(obj client.Object, status *agentv1beta.WorkloadReconcileStatus) {
+	// Pods of the Jobs run to completion, there is no rollout to track
+}
+
+func (jobAdapter) applyConfig(obj client.Object, annotations map[string]string, template *corev1ac.PodTemplateSpecApplyConfiguration) (*unstructured.Unstructured, error) {
+	applyConfig := batchv1ac.Job(obj.GetName(), obj.GetNamespace())
+	if len(annotations) > 0 {
+		applyConfig.WithAnnotations(annotations)
+	}
+	if template != nil {
+		applyConfig.WithSpec(batchv1ac.JobSpec().WithTemplate(template))
+	}
+	return toUnstructured(applyConfig)
+}
+
+// rolloutAdapter handles Argo Rollouts as unstructured objects, so Argo types are not vendored.
+// Rollout CRD doesn't define list merge keys for the pod template, so the whole template is built
+// and sent with merge patch instead of server side apply, see applyWorkload
+type rolloutAdapter struct {
+	lightrunJavaAgent *agentv1beta.LightrunJavaAgent
+}
+
+func (rolloutAdapter) kind() agentv1beta.WorkloadType { return agentv1beta.WorkloadTypeRollout }
+
+func (rolloutAdapter) newObject() client.Object {
+	rollout := &unstructured.Unstructured{}
+	rollout.SetGroupVersionKind(rolloutGVK)
+	return rollout
+}
+
+func (rolloutAdapter) newObjectList() client.ObjectList {
+	rollouts := &unstructured.UnstructuredList{}
+	rollouts.SetGroupVersionKind(rolloutGVK.GroupVersion().WithKind(rolloutGVK.Kind + "List"))
+	return rollouts
+}
+
+func (rolloutAdapter) podTemplate(obj client.Object) (*corev1.PodTemplateSpec, error) {
+	return rolloutPodTemplate(obj.(*unstructured.Unstructured))
+}
+
+func (rolloutAdapter) setPodTemplate(obj client.Object, template *corev1.PodTemplateSpec) error {
+	templateObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(template)
+	if err != nil {
+		return err
+	}
+	unstructured.RemoveNestedField(templateObj, "metadata", "creationTimestamp")
+	return unstructured.SetNestedMap(obj.(*unstructured.Unstructured).Object, templateObj, "spec", "template")
+}
+
+func (rolloutAdapter) setRolloutProgress(obj client.Object, status *agentv1beta.WorkloadReconcileStatus) {
+	rollout := obj.(*unstructured.Unstructured).Object
+	replicas, found, err := unstructured.NestedInt64(rollout, "spec", "replicas")
+	if err != nil {
+		return
+	}
+	if !found {
+		replicas = 1
+	}
+	updated, _, _ := unstructured.NestedInt64(rollout, "status", "updatedReplicas")
+	ready, _, _ := unstructured.NestedInt64(rollout, "status", "readyReplicas")
+	status.Replicas = pointer.Int32(int32(replicas))
+	status.UpdatedReplicas = pointer.Int32(int32(updated))
+	status.ReadyReplicas = pointer.Int32(int32(ready))
+}
+
+func (a rolloutAdapter) applyConfig(obj client.Object, annotations map[string]string, template *corev1ac.PodTemplateSpecApplyConfiguration) (*unstructured.Unstructured, error) {
+	rollout := obj.(*unstructured.Unstructured)
+	fullTemplate, err := rolloutPodTemplate(rollout)
+	if err != nil {
+		return nil, err
+	}
+	// Drop previously injected items, so the items that are not needed anymore are removed
+	unpatchPodTemplate(fullTemplate, a.lightrunJavaAgent)
+	if template != nil {
+		injected, err := podTemplateFromApplyConfig(template)
+		if err != nil {
+			return nil, err
+		}
+		mergePodTemplate(fullTemplate, injected)
+	}
+	return rolloutApplyObject(rollout, fullTemplate, annotations)
+}
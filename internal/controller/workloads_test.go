@@ -0,0 +1,448 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	agentv1beta "github.com/lightrun-platform/lightrun-k8s-operator/api/v1beta"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func testLightrunJavaAgent(workloadType agentv1beta.WorkloadType) *agentv1beta.LightrunJavaAgent {
+	return &agentv1beta.LightrunJavaAgent{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "default"},
+		Spec: agentv1beta.LightrunJavaAgentSpec{
+			WorkloadName:      "workload",
+			WorkloadType:      workloadType,
+			SecretName:        "secret",
+			ServerHostname:    "example.lightrun.com",
+			ContainerSelector: []string{"app"},
+			InitContainer: agentv1beta.InitContainer{
+				Image:                 "init",
+				SharedVolumeName:      "lightrun-agent-init",
+				SharedVolumeMountPath: "/lightrun",
+			},
+		},
+	}
+}
+
+func Test_workloadAdapters(t *testing.T) {
+	appTemplate := corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "busybox"}},
+		},
+	}
+	rollout := &unstructured.Unstructured{}
+	rollout.SetGroupVersionKind(rolloutGVK)
+	rolloutTemplate, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&appTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = unstructured.SetNestedMap(rollout.Object, rolloutTemplate, "spec", "template"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		kind agentv1beta.WorkloadType
+		obj  client.Object
+		// path of the pod template in the apply object
+		templatePath []string
+	}{
+		{agentv1beta.WorkloadTypeDeployment, &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: appTemplate}}, []string{"spec", "template"}},
+		{agentv1beta.WorkloadTypeStatefulSet, &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Template: appTemplate}}, []string{"spec", "template"}},
+		{agentv1beta.WorkloadTypeDaemonSet, &appsv1.DaemonSet{Spec: appsv1.DaemonSetSpec{Template: appTemplate}}, []string{"spec", "template"}},
+		{agentv1beta.WorkloadTypeCronJob, &batchv1.CronJob{Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: appTemplate}}}}, []string{"spec", "jobTemplate", "spec", "template"}},
+		{agentv1beta.WorkloadTypeJob, &batchv1.Job{Spec: batchv1.JobSpec{Template: appTemplate}}, []string{"spec", "template"}},
+		{agentv1beta.WorkloadTypeRollout, rollout, []string{"spec", "template"}},
+	}
+	r := &LightrunJavaAgentReconciler{}
+	for _, tt := range tests {
+		t.Run(string(tt.kind), func(t *testing.T) {
+			lightrunJavaAgent := testLightrunJavaAgent(tt.kind)
+			adapter, err := newWorkloadAdapter(tt.kind, lightrunJavaAgent)
+			if err != nil {
+				t.Fatalf("newWorkloadAdapter() error = %v", err)
+			}
+			if adapter.kind() != tt.kind {
+				t.Errorf("newWorkloadAdapter() kind = %v, want %v", adapter.kind(), tt.kind)
+			}
+			obj := tt.obj.DeepCopyObject().(client.Object)
+			obj.SetName("workload")
+			obj.SetNamespace("default")
+
+			template, err := adapter.podTemplate(obj)
+			if err != nil {
+				t.Fatalf("podTemplate() error = %v", err)
+			}
+			if len(template.Spec.Containers) != 1 || template.Spec.Containers[0].Name != "app" {
+				t.Fatalf("podTemplate() containers = %v", template.Spec.Containers)
+			}
+
+			// podTemplate returns a copy, object is changed only with setPodTemplate
+			template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-agentpath"}}
+			if unchanged, _ := adapter.podTemplate(obj); len(unchanged.Spec.Containers[0].Env) != 0 {
+				t.Errorf("podTemplate() returned template shared with the object")
+			}
+			if err = adapter.setPodTemplate(obj, template); err != nil {
+				t.Fatalf("setPodTemplate() error = %v", err)
+			}
+			if changed, _ := adapter.podTemplate(obj); len(changed.Spec.Containers[0].Env) != 1 {
+				t.Errorf("setPodTemplate() didn't change the object")
+			}
+
+			templateApplyConfig, err := r.patchPodTemplate(lightrunJavaAgent, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret"}}, template, 1)
+			if err != nil {
+				t.Fatalf("patchPodTemplate() error = %v", err)
+			}
+			patch, err := adapter.applyConfig(obj, map[string]string{annotationAgentName: "agent"}, templateApplyConfig)
+			if err != nil {
+				t.Fatalf("applyConfig() error = %v", err)
+			}
+			if patch.GetName() != "workload" || patch.GetNamespace() != "default" || patch.GetKind() == "" {
+				t.Errorf("applyConfig() object = %v", patch.Object)
+			}
+			if patch.GetAnnotations()[annotationAgentName] != "agent" {
+				t.Errorf("applyConfig() annotations = %v", patch.GetAnnotations())
+			}
+			initContainers, _, _ := unstructured.NestedSlice(patch.Object, append(tt.templatePath, "spec", "initContainers")...)
+			if len(initContainers) != 1 {
+				t.Errorf("applyConfig() init containers = %v", initContainers)
+			}
+			hash, _, _ := unstructured.NestedString(patch.Object, append(tt.templatePath, "metadata", "annotations", annotationConfigMapHash)...)
+			if hash != "1" {
+				t.Errorf("applyConfig() template hash annotation = %q", hash)
+			}
+
+			release, err := adapter.applyConfig(obj, nil, nil)
+			if err != nil {
+				t.Fatalf("applyConfig() error = %v", err)
+			}
+			if len(release.GetAnnotations()) != 0 {
+				t.Errorf("applyConfig() release annotations = %v", release.GetAnnotations())
+			}
+			initContainers, _, _ = unstructured.NestedSlice(release.Object, append(tt.templatePath, "spec", "initContainers")...)
+			if len(initContainers) != 0 {
+				t.Errorf("applyConfig() release init containers = %v", initContainers)
+			}
+		})
+	}
+}
+
+func Test_rolloutAdapter_imageVolume(t *testing.T) {
+	lightrunJavaAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeRollout)
+	lightrunJavaAgent.Spec.InitContainer.InjectionMode = agentv1beta.AgentInstallModeImageVolume
+	origTemplate := corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Volumes:    []corev1.Volume{{Name: "data"}},
+			Containers: []corev1.Container{{Name: "app", Image: "busybox", VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}}},
+		},
+	}
+	rollout := &unstructured.Unstructured{}
+	rollout.SetGroupVersionKind(rolloutGVK)
+	rollout.SetName("workload")
+	rolloutTemplate, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&origTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = unstructured.SetNestedMap(rollout.Object, rolloutTemplate, "spec", "template"); err != nil {
+		t.Fatal(err)
+	}
+	adapter, err := newWorkloadAdapter(agentv1beta.WorkloadTypeRollout, lightrunJavaAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &LightrunJavaAgentReconciler{}
+	templateApplyConfig, err := r.imageVolumePodTemplate(lightrunJavaAgent, &origTemplate, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := adapter.applyConfig(rollout, map[string]string{annotationAgentName: lightrunJavaAgent.Name}, templateApplyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !setImageVolumeSource(patch.Object, lightrunJavaAgent.Spec.InitContainer.SharedVolumeName, "init", "") {
+		t.Fatal("agent volume is not found in the rollout patch")
+	}
+	patched, err := rolloutMergeObject(rollout, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := rolloutPodTemplate(patched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both files of the agent config are mounted from the same volume with subPath
+	var subPaths []string
+	for _, mount := range template.Spec.Containers[0].VolumeMounts {
+		if mount.Name == cmVolumeName {
+			subPaths = append(subPaths, mount.SubPath)
+		}
+	}
+	if len(template.Spec.Containers[0].VolumeMounts) != 4 || !reflect.DeepEqual(subPaths, []string{"agent.config", "agent.metadata.json"}) {
+		t.Errorf("patched volume mounts = %+v", template.Spec.Containers[0].VolumeMounts)
+	}
+
+	// Unpatch leaves no mount of the removed volumes
+	patch, err = adapter.applyConfig(patched, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpatched, err := rolloutMergeObject(patched, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err = rolloutPodTemplate(unpatched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(template.Spec, origTemplate.Spec) {
+		t.Errorf("unpatched pod spec = %+v, want %+v", template.Spec, origTemplate.Spec)
+	}
+	if _, ok := unpatched.GetAnnotations()[annotationAgentName]; ok {
+		t.Errorf("unpatched annotations = %v", unpatched.GetAnnotations())
+	}
+}
+
+func Test_newWorkloadAdapter_unsupported(t *testing.T) {
+	if _, err := newWorkloadAdapter("ReplicaSet", testLightrunJavaAgent("ReplicaSet")); err == nil {
+		t.Errorf("newWorkloadAdapter() expected error for unsupported workload type")
+	}
+}
+
+func Test_patchPodTemplate_missingContainer(t *testing.T) {
+	r := &LightrunJavaAgentReconciler{}
+	template := &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "other"}},
+		},
+	}
+	_, err := r.patchPodTemplate(testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment), &corev1.Secret{}, template, 1)
+	if err == nil {
+		t.Errorf("patchPodTemplate() expected error when container selector doesn't match")
+	}
+}
+
+func Test_mapWorkloadToAgent(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	deploymentAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	statefulSetAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeStatefulSet)
+	statefulSetAgent.Name = "sts-agent"
+	otherNamespaceAgent := testLightrunJavaAgent(agentv1beta.WorkloadTypeDeployment)
+	otherNamespaceAgent.Namespace = "other"
+
+	r := &LightrunJavaAgentReconciler{
+		Client: fake.NewClientBuilder().
+			WithScheme(scheme).
+			WithObjects(deploymentAgent, statefulSetAgent, otherNamespaceAgent).
+			WithIndex(&agentv1beta.LightrunJavaAgent{}, workloadIndexField, indexAgentWorkload).
+			WithIndex(&agentv1beta.LightrunJavaAgent{}, selectorIndexField, indexAgentSelector).
+			Build(),
+		Log: zap.New(),
+	}
+
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "workload", Namespace: "default"}}
+	requests := r.mapWorkloadToAgent(agentv1beta.WorkloadTypeDeployment)(context.Background(), deployment)
+	if len(requests) != 1 || requests[0].Name != deploymentAgent.Name || requests[0].Namespace != "default" {
+		t.Errorf("mapWorkloadToAgent() = %v", requests)
+	}
+
+	// Agent of the StatefulSet with the same name is found by the workload type
+	statefulSet := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "workload", Namespace: "default"}}
+	requests = r.mapWorkloadToAgent(agentv1beta.WorkloadTypeStatefulSet)(context.Background(), statefulSet)
+	if len(requests) != 1 || requests[0].Name != statefulSetAgent.Name {
+		t.Errorf("mapWorkloadToAgent() = %v", requests)
+	}
+
+	notTargeted := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "workload", Namespace: "default"}}
+	if requests = r.mapWorkloadToAgent(agentv1beta.WorkloadTypeDaemonSet)(context.Background(), notTargeted); len(requests) != 0 {
+		t.Errorf("mapWorkloadToAgent() = %v, want no requests", requests)
+	}
+}
+
+func Test_mapWorkloadToAgent_selector(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := agentv1beta.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	selectorAgent := testLightrunJavaAgent("")
+	selectorAgent.Spec.WorkloadName = ""
+	selectorAgent.Spec.WorkloadSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "my-app"}}
+
+	r := &LightrunJavaAgentReconciler{
+		Client: fake.NewClientBuilder().
+			WithScheme(scheme).
+			WithObjects(selectorAgent).
+			WithIndex(&agentv1beta.LightrunJavaAgent{}, workloadIndexField, indexAgentWorkload).
+			WithIndex(&agentv1beta.LightrunJavaAgent{}, selectorIndexField, indexAgentSelector).
+			Build(),
+		Log: zap.New(),
+	}
+
+	tests := []struct {
+		name     string
+		kind     agentv1beta.WorkloadType
+		workload client.Object
+		want     int
+	}{
+		{
+			name:     "matching deployment",
+			kind:     agentv1beta.WorkloadTypeDeployment,
+			workload: &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "any", Namespace: "default", Labels: map[string]string{"app": "my-app"}}},
+			want:     1,
+		},
+		{
+			name:     "not matching statefulset",
+			kind:     agentv1beta.WorkloadTypeStatefulSet,
+			workload: &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "any", Namespace: "default", Labels: map[string]string{"app": "other"}}},
+			want:     0,
+		},
+		{
+			name: "not matching deployment patched by the agent",
+			kind: agentv1beta.WorkloadTypeDeployment,
+			workload: &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "any", Namespace: "default",
+				Annotations: map[string]string{annotationAgentName: selectorAgent.Name}}},
+			want: 1,
+		},
+		{
+			name:     "matching daemonset not in default kinds",
+			kind:     agentv1beta.WorkloadTypeDaemonSet,
+			workload: &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "any", Namespace: "default", Labels: map[string]string{"app": "my-app"}}},
+			want:     0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if requests := r.mapWorkloadToAgent(tt.kind)(context.Background(), tt.workload); len(requests) != tt.want {
+				t.Errorf("mapWorkloadToAgent() = %v, want %d requests", requests, tt.want)
+			}
+		})
+	}
+}
+
+func Test_workloadStatus(t *testing.T) {
+	template := corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "busybox"}, {Name: "proxy", Image: "envoy"}},
+		},
+	}
+	rollout := &unstructured.Unstructured{}
+	rollout.SetGroupVersionKind(rolloutGVK)
+	rolloutTemplate, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = unstructured.SetNestedMap(rollout.Object, rolloutTemplate, "spec", "template"); err != nil {
+		t.Fatal(err)
+	}
+	if err = unstructured.SetNestedField(rollout.Object, int64(4), "spec", "replicas"); err != nil {
+		t.Fatal(err)
+	}
+	if err = unstructured.SetNestedField(rollout.Object, int64(2), "status", "updatedReplicas"); err != nil {
+		t.Fatal(err)
+	}
+	if err = unstructured.SetNestedField(rollout.Object, int64(3), "status", "readyReplicas"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		kind    agentv1beta.WorkloadType
+		obj     client.Object
+		sidecar bool
+		// desired, updated and ready pods, nil if not set
+		replicas []int32
+		hash     string
+	}{
+		{
+			kind:     agentv1beta.WorkloadTypeDeployment,
+			obj:      &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: template}, Status: appsv1.DeploymentStatus{UpdatedReplicas: 1}},
+			replicas: []int32{1, 1, 0},
+			hash:     "42",
+		},
+		{
+			kind:     agentv1beta.WorkloadTypeStatefulSet,
+			obj:      &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Replicas: pointer.Int32(3), Template: template}, Status: appsv1.StatefulSetStatus{UpdatedReplicas: 2, ReadyReplicas: 3}},
+			sidecar:  true,
+			replicas: []int32{3, 2, 3},
+		},
+		{
+			kind:     agentv1beta.WorkloadTypeDaemonSet,
+			obj:      &appsv1.DaemonSet{Spec: appsv1.DaemonSetSpec{Template: template}, Status: appsv1.DaemonSetStatus{DesiredNumberScheduled: 5, UpdatedNumberScheduled: 4, NumberReady: 5}},
+			replicas: []int32{5, 4, 5},
+			hash:     "42",
+		},
+		{
+			kind: agentv1beta.WorkloadTypeCronJob,
+			obj:  &batchv1.CronJob{Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}}}},
+			hash: "42",
+		},
+		{
+			kind:     agentv1beta.WorkloadTypeRollout,
+			obj:      rollout,
+			replicas: []int32{4, 2, 3},
+			hash:     "42",
+		},
+	}
+	r := &LightrunJavaAgentReconciler{ImageRegistryMirror: "mirror.example.com"}
+	for _, tt := range tests {
+		t.Run(string(tt.kind), func(t *testing.T) {
+			lightrunJavaAgent := testLightrunJavaAgent(tt.kind)
+			lightrunJavaAgent.Spec.AgentEnvVarName = "JAVA_TOOL_OPTIONS"
+			lightrunJavaAgent.Spec.ContainerSelector = []string{"app", "missing"}
+			lightrunJavaAgent.Spec.InitContainer.Sidecar = tt.sidecar
+			adapter, err := newWorkloadAdapter(tt.kind, lightrunJavaAgent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj := tt.obj.DeepCopyObject().(client.Object)
+			obj.SetName("workload")
+			obj.SetUID("uid")
+
+			status := r.workloadStatus(lightrunJavaAgent, adapter, obj, 42)
+			if status.Kind != tt.kind || status.Name != "workload" || status.UID != "uid" || status.Status != workloadStatusPatched {
+				t.Errorf("workloadStatus() = %+v", status)
+			}
+			if len(status.Containers) != 1 || status.Containers[0] != "app" {
+				t.Errorf("workloadStatus() containers = %v, want [app]", status.Containers)
+			}
+			if status.AgentImage != "mirror.example.com/library/init" {
+				t.Errorf("workloadStatus() agentImage = %q", status.AgentImage)
+			}
+			if status.PatchedEnvVar != "JAVA_TOOL_OPTIONS" {
+				t.Errorf("workloadStatus() patchedEnvVar = %q", status.PatchedEnvVar)
+			}
+			if status.ConfigMapHash != tt.hash {
+				t.Errorf("workloadStatus() configMapHash = %q, want %q", status.ConfigMapHash, tt.hash)
+			}
+			if tt.replicas == nil {
+				if status.Replicas != nil || status.UpdatedReplicas != nil || status.ReadyReplicas != nil {
+					t.Errorf("workloadStatus() replicas are set for %s", tt.kind)
+				}
+				return
+			}
+			if status.Replicas == nil || status.UpdatedReplicas == nil || status.ReadyReplicas == nil {
+				t.Fatalf("workloadStatus() replicas are not set")
+			}
+			got := []int32{*status.Replicas, *status.UpdatedReplicas, *status.ReadyReplicas}
+			for i := range got {
+				if got[i] != tt.replicas[i] {
+					t.Errorf("workloadStatus() replicas = %v, want %v", got, tt.replicas)
+					break
+				}
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@
 # 3. Merges configuration files
 # 4. Updates configuration with values from files
 # 5. Copies the final configuration to destination
+# 6. When running as a native sidecar (LIGHTRUN_SYNC_CONFIG=true), keeps the configuration in sync with the ConfigMap
 
 set -e
 
@@ -15,6 +16,8 @@ WORK_DIR="${TMP_DIR}/agent-workdir"
 FINAL_DEST="${TMP_DIR}/agent"
 CONFIG_MAP_DIR="${TMP_DIR}/cm"
 SECRET_DIR="/etc/lightrun/secret"
+READY_FILE="${FINAL_DEST}/.ready"
+SYNC_INTERVAL=10
 
 # Function to get value from either environment variable or file
 get_value() {
@@ -140,10 +143,51 @@ update_config() {
 
 # Function to copy final configuration
 copy_final_config() {
+    if [ -d "${FINAL_DEST}" ]; then
+        # Sidecar was restarted, the agent is already in use by the app, only refresh the config
+        sync_config_files
+        return
+    fi
     echo "Copying configured agent to final destination ${FINAL_DEST}"
     cp -R "${WORK_DIR}" "${FINAL_DEST}"
 }
 
+# Function to replace config files in the final destination. Files are renamed, so the agent never reads a partial file
+sync_config_files() {
+    echo "Updating configuration in ${FINAL_DEST}"
+    for file in agent.config agent.metadata.json; do
+        cp "${WORK_DIR}/${file}" "${FINAL_DEST}/.${file}.tmp"
+        mv "${FINAL_DEST}/.${file}.tmp" "${FINAL_DEST}/${file}"
+    done
+}
+
+# Function to get checksum of the mounted ConfigMap and secret. Kubelet updates them when the source objects change
+config_checksum() {
+    cat "${CONFIG_MAP_DIR}"/* "${SECRET_DIR}"/* 2>/dev/null | md5sum
+}
+
+# Function to keep the configuration in sync with the ConfigMap
+sync_loop() {
+    trap 'exit 0' TERM INT
+    local last_checksum=$(config_checksum)
+    touch "${READY_FILE}"
+    echo "Watching ${CONFIG_MAP_DIR} for changes"
+    while true; do
+        sleep "${SYNC_INTERVAL}" &
+        wait $!
+        local checksum=$(config_checksum)
+        if [ "${checksum}" != "${last_checksum}" ]; then
+            echo "Configuration changed"
+            setup_working_dir
+            merge_configs
+            update_config
+            sync_config_files
+            cleanup
+            last_checksum="${checksum}"
+        fi
+    done
+}
+
 # Function to cleanup
 cleanup() {
     echo "Cleaning up working directory"
@@ -159,6 +203,9 @@ main() {
     copy_final_config
     cleanup
     echo "Configuration completed successfully"
+    if [ "${LIGHTRUN_SYNC_CONFIG}" = "true" ]; then
+        sync_loop
+    fi
 }
 
 # Execute main function